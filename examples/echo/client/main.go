@@ -9,7 +9,7 @@ import (
 	"github.com/cloudwebrtc/nats-grpc/examples/protos/echo"
 	nrpc "github.com/cloudwebrtc/nats-grpc/pkg/rpc"
 	"github.com/nats-io/nats.go"
-	log "github.com/pion/ion-log"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
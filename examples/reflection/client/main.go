@@ -9,7 +9,7 @@ import (
 	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/reflection"
 	"github.com/jhump/protoreflect/grpcreflect"
 	"github.com/nats-io/nats.go"
-	log "github.com/pion/ion-log"
+	log "github.com/sirupsen/logrus"
 	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 )
 
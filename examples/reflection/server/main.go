@@ -13,7 +13,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	log "github.com/pion/ion-log"
+	log "github.com/sirupsen/logrus"
 )
 
 type echoServer struct {
@@ -0,0 +1,198 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	sizes  = []int{16, 1024, 64 * 1024}
+	depths = []int{1, 64}
+)
+
+// connect returns a connection to the server of NRPC_BENCH_NATS_URL, or to
+// an embedded one.
+func connect(b *testing.B) *nats.Conn {
+	url := os.Getenv("NRPC_BENCH_NATS_URL")
+	if len(url) == 0 {
+		return nrpctest.RunNats(b)
+	}
+	nc, err := nats.Connect(url)
+	if err != nil {
+		b.Fatalf("connect %v: %v", url, err)
+	}
+	b.Cleanup(nc.Close)
+	return nc
+}
+
+// latencies records call durations and reports their percentiles.
+type latencies []time.Duration
+
+func (l latencies) report(b *testing.B) {
+	if len(l) == 0 {
+		return
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	b.ReportMetric(float64(l[len(l)*50/100]), "p50-ns")
+	b.ReportMetric(float64(l[len(l)*99/100]), "p99-ns")
+}
+
+func BenchmarkUnary(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("size=%v", size), func(b *testing.B) {
+			cli, _ := echo.StartEchoServer(b, connect(b), "bench")
+			ctx := context.Background()
+			req := &echo.EchoRequest{Message: "bench", ResponseSize: int32(size)}
+			lat := make(latencies, 0, b.N)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := cli.Unary(ctx, req); err != nil {
+					b.Fatalf("Unary: %v", err)
+				}
+				lat = append(lat, time.Since(start))
+			}
+			b.StopTimer()
+			lat.report(b)
+		})
+	}
+}
+
+func BenchmarkUnaryParallel(b *testing.B) {
+	cli, _ := echo.StartEchoServer(b, connect(b), "bench")
+	req := &echo.EchoRequest{Message: "bench"}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ctx := context.Background()
+		for pb.Next() {
+			if _, err := cli.Unary(ctx, req); err != nil {
+				b.Errorf("Unary: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkUnaryFlood measures bursts of concurrent unary calls with one
+// goroutine per handler and with a handler pool.
+func BenchmarkUnaryFlood(b *testing.B) {
+	const calls = 10000
+	for _, pool := range []int{0, 64} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			var opts []rpc.ServerOption
+			if pool > 0 {
+				opts = append(opts, rpc.WithHandlerPool(pool))
+			}
+			cli, _ := echo.StartEchoServer(b, connect(b), "bench", opts...)
+			req := &echo.EchoRequest{Message: "bench"}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				errs := make(chan error, calls)
+				for j := 0; j < calls; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if _, err := cli.Unary(context.Background(), req); err != nil {
+							errs <- err
+						}
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				if err := <-errs; err != nil {
+					b.Fatalf("Unary: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServerStream(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("size=%v", size), func(b *testing.B) {
+			cli, _ := echo.StartEchoServer(b, connect(b), "bench")
+			req := &echo.EchoRequest{ResponseSize: int32(size), ResponseCount: int32(b.N)}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			stream, err := cli.ServerStream(context.Background(), req)
+			if err != nil {
+				b.Fatalf("ServerStream: %v", err)
+			}
+			for i := 0; i < b.N; i++ {
+				if _, err := stream.Recv(); err != nil {
+					b.Fatalf("Recv: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkClientStream(b *testing.B) {
+	for _, depth := range depths {
+		for _, size := range sizes {
+			b.Run(fmt.Sprintf("depth=%v/size=%v", depth, size), func(b *testing.B) {
+				cli, _ := echo.StartEchoServer(b, connect(b), "bench", rpc.WithStreamRecvBuffer(depth))
+				stream, err := cli.ClientStream(context.Background())
+				if err != nil {
+					b.Fatalf("ClientStream: %v", err)
+				}
+				req := &echo.EchoRequest{Message: string(make([]byte, size))}
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := stream.Send(req); err != nil {
+						b.Fatalf("Send: %v", err)
+					}
+				}
+				resp, err := stream.CloseAndRecv()
+				if err != nil {
+					b.Fatalf("CloseAndRecv: %v", err)
+				}
+				if int(resp.Index) != b.N {
+					b.Fatalf("server received %v of %v messages", resp.Index, b.N)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkBidiStream(b *testing.B) {
+	for _, depth := range depths {
+		b.Run(fmt.Sprintf("depth=%v", depth), func(b *testing.B) {
+			cli, _ := echo.StartEchoServer(b, connect(b), "bench", rpc.WithStreamRecvBuffer(depth))
+			stream, err := cli.BidiStream(context.Background())
+			if err != nil {
+				b.Fatalf("BidiStream: %v", err)
+			}
+			req := &echo.EchoRequest{Message: "bench"}
+			lat := make(latencies, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if err := stream.Send(req); err != nil {
+					b.Fatalf("Send: %v", err)
+				}
+				if _, err := stream.Recv(); err != nil {
+					b.Fatalf("Recv: %v", err)
+				}
+				lat = append(lat, time.Since(start))
+			}
+			b.StopTimer()
+			stream.CloseSend()
+			lat.report(b)
+		})
+	}
+}
@@ -0,0 +1,12 @@
+// Package bench holds the benchmarks of unary and streaming calls over NATS,
+// for the tunables the rpc package exposes, such as the stream receive
+// buffer depth, the handler pool and the message size.
+//
+// Run them with
+//
+//	go test -run - -bench . ./pkg/bench
+//
+// They start an embedded nats-server unless NRPC_BENCH_NATS_URL names one to
+// use instead, e.g. nats://127.0.0.1:4222. Unary and bidi benchmarks also
+// report the p50 and p99 call latency.
+package bench
@@ -0,0 +1,39 @@
+module github.com/cloudwebrtc/nats-grpc/pkg/otelnats
+
+go 1.23
+
+require (
+	github.com/cloudwebrtc/nats-grpc v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.21.0
+	go.opentelemetry.io/otel/sdk v1.21.0
+	go.opentelemetry.io/otel/trace v1.21.0
+	google.golang.org/grpc v1.36.1
+)
+
+require (
+	github.com/go-logr/logr v1.3.0 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/klauspost/compress v1.13.4 // indirect
+	github.com/minio/highwayhash v1.0.1 // indirect
+	github.com/nats-io/jwt/v2 v2.0.3 // indirect
+	github.com/nats-io/nats-server/v2 v2.5.0 // indirect
+	github.com/nats-io/nats.go v1.12.1 // indirect
+	github.com/nats-io/nkeys v0.3.0 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/sirupsen/logrus v1.8.1 // indirect
+	go.opentelemetry.io/otel/metric v1.21.0 // indirect
+	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e // indirect
+	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4 // indirect
+	golang.org/x/sys v0.14.0 // indirect
+	golang.org/x/text v0.3.5 // indirect
+	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1 // indirect
+	google.golang.org/genproto v0.0.0-20210505142820-a42aa055cf76 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
+)
+
+// The version required above is a placeholder resolved by this replace,
+// which builds against the checkout the module is part of. Modules
+// requiring this one ignore the replace: before tagging a release of this
+// module, tag the root module and require that tag here instead.
+replace github.com/cloudwebrtc/nats-grpc => ../..
@@ -0,0 +1,175 @@
+// Package otelnats traces the calls a nats-grpc server handles with
+// OpenTelemetry. It is a separate module so that the core packages do not
+// depend on OpenTelemetry.
+//
+//	s := rpc.NewServer(nc, nid, otelnats.WithTracing())
+package otelnats
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// tracerName is the instrumentation name of the spans.
+const tracerName = "github.com/cloudwebrtc/nats-grpc/pkg/otelnats"
+
+// Option configures WithTracing.
+type Option func(*config)
+
+type config struct {
+	provider    trace.TracerProvider
+	propagators propagation.TextMapPropagator
+	tracer      trace.Tracer
+}
+
+// WithTracerProvider sets the provider of the tracer creating the spans,
+// the global one by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.provider = tp
+	}
+}
+
+// WithPropagators sets how the trace context of the caller is read from
+// the metadata of a call, W3C traceparent and tracestate by default.
+func WithPropagators(p propagation.TextMapPropagator) Option {
+	return func(c *config) {
+		c.propagators = p
+	}
+}
+
+// WithTracing makes the server start a span for every call it handles,
+// named after its method, like "echo.Echo/SayHello", and child of the span
+// whose trace context the metadata of the call carries. The span is in the
+// context of the handler, so that the spans it starts nest under it, and
+// ends with the stream of the call, with the status code the stream ended
+// with, see rpc.StreamDoneReason: a deadline or an abort after the handler
+// returned counts, as a panic of the handler does. The option chains
+// interceptors after those already installed.
+func WithTracing(opts ...Option) rpc.ServerOption {
+	c := &config{
+		provider:    otel.GetTracerProvider(),
+		propagators: propagation.TraceContext{},
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	c.tracer = c.provider.Tracer(tracerName)
+	unary := rpc.WithUnaryInterceptor(c.unary)
+	stream := rpc.WithStreamInterceptor(c.stream)
+	return func(s *rpc.Server) {
+		unary(s)
+		stream(s)
+	}
+}
+
+func (c *config) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, span := c.start(ctx, info.FullMethod)
+	defer finish(ctx, span, &err)
+	return handler(ctx, req)
+}
+
+func (c *config) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, span := c.start(ss.Context(), info.FullMethod)
+	defer finish(ctx, span, &err)
+	return handler(srv, &tracedStream{ServerStream: ss, ctx: ctx})
+}
+
+// start starts the span of the call to fullMethod.
+func (c *config) start(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = c.propagators.Extract(ctx, metadataCarrier(md))
+	name := strings.TrimPrefix(fullMethod, "/")
+	attrs := []attribute.KeyValue{attribute.String("rpc.system", "nrpc")}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		attrs = append(attrs,
+			attribute.String("rpc.service", name[:i]),
+			attribute.String("rpc.method", name[i+1:]))
+	}
+	if id, ok := rpc.CallIDFromContext(ctx); ok {
+		attrs = append(attrs, attribute.String("nrpc.call_id", id))
+	}
+	return c.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+}
+
+// finish ends span once the stream of the call whose context is ctx ends,
+// with the status the stream ended with, the one of *err, the error the
+// handler returned, when the stream does not tell. A panic of the handler
+// counts as codes.Internal, and goes on once recorded.
+func finish(ctx context.Context, span trace.Span, err *error) {
+	fallback := *err
+	r := recover()
+	if r != nil {
+		fallback = status.Errorf(codes.Internal, "panic in handler: %v", r)
+	}
+	if ctx.Done() == nil {
+		// not the context of a stream, it never ends
+		end(span, status.Convert(fallback))
+	} else {
+		go func() {
+			<-ctx.Done()
+			st := rpc.StreamDoneReason(ctx)
+			if st == nil {
+				st = status.Convert(fallback)
+			}
+			end(span, st)
+		}()
+	}
+	if r != nil {
+		panic(r)
+	}
+}
+
+// end ends the span of a call with st.
+func end(span trace.Span, st *status.Status) {
+	span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(st.Code())))
+	if st.Code() != codes.OK {
+		span.SetStatus(otelcodes.Error, st.Message())
+	}
+	span.End()
+}
+
+// tracedStream is a grpc.ServerStream whose context carries the span.
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// metadataCarrier reads and writes a trace context in gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,171 @@
+package otelnats_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/otelnats"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID    = "00f067aa0ba902b7"
+	traceparent = "00-" + traceID + "-" + parentID + "-01"
+)
+
+func setup(t *testing.T, opts ...rpc.ServerOption) (echo.EchoClient, *tracetest.SpanRecorder, context.Context) {
+	return setupServer(t, &echo.Server{}, opts...)
+}
+
+func setupServer(t *testing.T, impl echo.EchoServer, opts ...rpc.ServerOption) (echo.EchoClient, *tracetest.SpanRecorder, context.Context) {
+	nc := nrpctest.RunNats(t)
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	opts = append([]rpc.ServerOption{otelnats.WithTracing(otelnats.WithTracerProvider(tp))}, opts...)
+	cli, _ := echo.StartServer(t, nc, "srv", impl, opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return cli, sr, metadata.AppendToOutgoingContext(ctx, "traceparent", traceparent)
+}
+
+// ended waits until sr recorded n ended spans, as spans end with their
+// stream, after the client got the response.
+func ended(t *testing.T, ctx context.Context, sr *tracetest.SpanRecorder, n int) []sdktrace.ReadOnlySpan {
+	t.Helper()
+	for {
+		spans := sr.Ended()
+		if len(spans) >= n {
+			if len(spans) > n {
+				t.Fatalf("got %d spans, want %d", len(spans), n)
+			}
+			return spans
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("got %d spans, want %d", len(spans), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// statusCode returns the rpc.grpc.status_code attribute of span.
+func statusCode(span sdktrace.ReadOnlySpan) (int64, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == attribute.Key("rpc.grpc.status_code") {
+			return kv.Value.AsInt64(), true
+		}
+	}
+	return 0, false
+}
+
+func TestUnarySpans(t *testing.T) {
+	var handlerSpan trace.SpanContext
+	capture := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return handler(ctx, req)
+	}
+	cli, sr, ctx := setup(t, rpc.WithUnaryInterceptor(capture))
+
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	span := ended(t, ctx, sr, 1)[0]
+	if span.Name() != "nrpctest.echo.Echo/Unary" || span.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("got span %q of kind %v, want a server span named after the method", span.Name(), span.SpanKind())
+	}
+	if got := span.Parent().TraceID().String(); got != traceID || span.Parent().SpanID().String() != parentID {
+		t.Fatalf("got parent %v, want the span of the traceparent", span.Parent())
+	}
+	if handlerSpan.SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("got span %v in the handler context, want %v", handlerSpan.SpanID(), span.SpanContext().SpanID())
+	}
+	if code, ok := statusCode(span); !ok || code != int64(codes.OK) || span.Status().Code != otelcodes.Unset {
+		t.Fatalf("got code %v and status %v, want OK", code, span.Status())
+	}
+
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{ErrorCode: int32(codes.NotFound), ErrorMessage: "gone"}); err == nil {
+		t.Fatal("Unary succeeded, want NotFound")
+	}
+	span = ended(t, ctx, sr, 2)[1]
+	if code, ok := statusCode(span); !ok || code != int64(codes.NotFound) || span.Status().Code != otelcodes.Error || span.Status().Description != "gone" {
+		t.Fatalf("got code %v and status %v, want NotFound", code, span.Status())
+	}
+}
+
+func TestStreamSpans(t *testing.T) {
+	cli, sr, ctx := setup(t)
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: 3})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Fatal("Recv succeeded after the last response")
+	}
+	spans := ended(t, ctx, sr, 1)
+	if spans[0].Name() != "nrpctest.echo.Echo/ServerStream" {
+		t.Fatalf("got %d spans, want the one of the stream", len(spans))
+	}
+	if got := spans[0].Parent().TraceID().String(); got != traceID {
+		t.Fatalf("got trace %v, want %v", got, traceID)
+	}
+}
+
+// sleepyServer answers Unary after delay, whatever the deadline, and
+// panics on ServerStream.
+type sleepyServer struct {
+	echo.Server
+	delay time.Duration
+}
+
+func (s *sleepyServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	time.Sleep(s.delay)
+	return &echo.EchoResponse{}, nil
+}
+
+func (s *sleepyServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	panic("boom")
+}
+
+func TestSpanStatusOfStream(t *testing.T) {
+	cli, sr, ctx := setupServer(t, &sleepyServer{delay: 300 * time.Millisecond})
+
+	// the handler returns no error, but past the deadline of the call
+	callCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := cli.Unary(callCtx, &echo.EchoRequest{}); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	span := ended(t, ctx, sr, 1)[0]
+	if code, _ := statusCode(span); code != int64(codes.DeadlineExceeded) || span.Status().Code != otelcodes.Error {
+		t.Fatalf("got code %v and status %v, want DeadlineExceeded", code, span.Status())
+	}
+
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+	span = ended(t, ctx, sr, 2)[1]
+	if code, _ := statusCode(span); code != int64(codes.Internal) || span.Status().Code != otelcodes.Error {
+		t.Fatalf("got code %v and status %v, want Internal", code, span.Status())
+	}
+}
@@ -0,0 +1,200 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"google.golang.org/grpc"
+)
+
+// StreamAcksKey is the metadata key by which the client of a streaming call
+// asks for acknowledged responses, see WithStreamAcks.
+const StreamAcksKey = "nrpc-stream-acks"
+
+const (
+	defaultAckWindow = 64
+	defaultAckResend = time.Second
+	// maxResendBackoff bounds the doublings of the resend interval while
+	// the client acknowledges nothing.
+	maxResendBackoff = 5
+)
+
+// WithAckWindow sets how many responses the server sends ahead of the
+// acknowledgments of a call with WithStreamAcks, 64 by default, SendMsg
+// blocking beyond it, and how long it waits for an acknowledgment before
+// resending the responses not acknowledged yet, a second by default. The
+// wait doubles, up to 32 times resend, with each resend that brings no
+// acknowledgment.
+func WithAckWindow(window int, resend time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ackWindow = window
+		s.ackResend = resend
+	}
+}
+
+// StreamAcksOption is a grpc.CallOption asking for acknowledged responses,
+// see WithStreamAcks.
+type StreamAcksOption struct {
+	grpc.EmptyCallOption
+}
+
+// WithStreamAcks makes the server of a streaming call number its responses
+// and keep those the client has not acknowledged, resending them when no
+// acknowledgment comes in time. The client acknowledges each response as
+// soon as it receives it, however slowly RecvMsg is called, and drops
+// duplicates and responses past a lost one, so that RecvMsg returns every
+// response once and in order even when NATS drops some. The server holds
+// its End until every response is acknowledged. A client gone away is
+// detected with WithKeepalive, not by its missing acknowledgments. Unary
+// calls ignore it.
+func WithStreamAcks() grpc.CallOption {
+	return StreamAcksOption{}
+}
+
+// ackState tracks the responses of a stream sent but not acknowledged yet.
+type ackState struct {
+	mu       sync.Mutex
+	window   int
+	sent     uint64        // seq of the last response sent
+	acked    uint64        // highest seq acknowledged by the client
+	unacked  [][]byte      // payloads of the responses acked+1 to sent
+	progress chan struct{} // closed and replaced when acked moves
+}
+
+func newAckState(window int) *ackState {
+	if window <= 0 {
+		window = defaultAckWindow
+	}
+	return &ackState{
+		window:   window,
+		progress: make(chan struct{}),
+	}
+}
+
+// reserve numbers the response data once the window has room for it.
+func (a *ackState) reserve(ctx context.Context, data []byte) (uint64, error) {
+	for {
+		a.mu.Lock()
+		if len(a.unacked) < a.window {
+			a.sent++
+			seq := a.sent
+			a.unacked = append(a.unacked, data)
+			a.mu.Unlock()
+			return seq, nil
+		}
+		progress := a.progress
+		a.mu.Unlock()
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// ack releases the responses up to seq, and returns their size.
+func (a *ackState) ack(seq uint64) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if seq <= a.acked || seq > a.sent {
+		return 0
+	}
+	n := 0
+	for _, data := range a.unacked[:seq-a.acked] {
+		n += len(data)
+	}
+	a.unacked = a.unacked[seq-a.acked:]
+	a.acked = seq
+	close(a.progress)
+	a.progress = make(chan struct{})
+	return n
+}
+
+// pending returns the highest seq acknowledged and the payloads of the
+// responses after it.
+func (a *ackState) pending() (uint64, [][]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.acked, append([][]byte(nil), a.unacked...)
+}
+
+// backlog returns the number of responses not acknowledged yet.
+func (a *ackState) backlog() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.unacked)
+}
+
+// wait blocks until every response sent is acknowledged or ctx ends.
+func (a *ackState) wait(ctx context.Context) {
+	for {
+		a.mu.Lock()
+		progress, done := a.progress, len(a.unacked) == 0
+		a.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendData writes a response, numbered when the client acknowledges them.
+func (s *serverStream) sendData(data []byte) error {
+	if s.acks == nil {
+		return s.writeData(&nrpc.Data{Data: data})
+	}
+	// counted before the client can acknowledge it
+	s.hold(len(data))
+	seq, err := s.acks.reserve(s.ctx, data)
+	if err != nil {
+		s.release(len(data))
+		return err
+	}
+	if s.ctx.Err() != nil {
+		s.releaseAll()
+	}
+	return s.writeData(&nrpc.Data{Data: data, Seq: seq})
+}
+
+// resendUnacked resends the responses not acknowledged once interval
+// passes without an acknowledgment, doubling the interval while the client
+// stays silent, until the stream ends.
+func (s *serverStream) resendUnacked(interval time.Duration) {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	var last uint64
+	backoff := 0
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+			acked, unacked := s.acks.pending()
+			if acked != last || len(unacked) == 0 {
+				last, backoff = acked, 0
+			} else {
+				for i, data := range unacked {
+					s.writeData(&nrpc.Data{Data: data, Seq: acked + uint64(i) + 1})
+				}
+				if backoff < maxResendBackoff {
+					backoff++
+				}
+			}
+			t.Reset(interval << backoff)
+		}
+	}
+}
+
+func (c *clientStream) writeAck(seq uint64) error {
+	return c.writeRequest(&nrpc.Request{
+		Type: &nrpc.Request_Ack{
+			Ack: &nrpc.Ack{Seq: seq},
+		},
+	})
+}
@@ -0,0 +1,83 @@
+package rpc_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+// lossyConn drops the first publish of the numbered responses in drop.
+type lossyConn struct {
+	*nats.Conn
+	mu   sync.Mutex
+	drop map[uint64]bool
+}
+
+func (c *lossyConn) Publish(subject string, data []byte) error {
+	response := &nrpc.Response{}
+	if proto.Unmarshal(data, response) == nil {
+		if d := response.GetData(); d != nil {
+			c.mu.Lock()
+			drop := c.drop[d.Seq]
+			delete(c.drop, d.Seq)
+			c.mu.Unlock()
+			if drop {
+				return nil
+			}
+		}
+	}
+	return c.Conn.Publish(subject, data)
+}
+
+func TestStreamAcks(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	conn := &lossyConn{Conn: nc, drop: map[uint64]bool{2: true, 5: true, 10: true}}
+	cli, _ := echo.StartEchoServer(t, conn, "srv", rpc.WithAckWindow(4, 50*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: 10}, rpc.WithStreamAcks())
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	for i := int32(0); i < 10; i++ {
+		if resp, err := stream.Recv(); err != nil || resp.Index != i {
+			t.Fatalf("got %v, %v, want response %d", resp, err, i)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestStreamAcksSlowReader(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithAckWindow(2, 50*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: 4}, rpc.WithStreamAcks())
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	// read far slower than the server resends, the responses received are
+	// acknowledged anyway
+	for i := int32(0); i < 4; i++ {
+		time.Sleep(500 * time.Millisecond)
+		if resp, err := stream.Recv(); err != nil || resp.Index != i {
+			t.Fatalf("got %v, %v, want response %d", resp, err, i)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Package admin is the optional Admin service operating an nrpc server, for
+// tools and operators.
+package admin
+
+import (
+	"context"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AuthorizeFunc decides whether the caller of the Admin method fullMethod,
+// known by the incoming metadata of ctx, may call it. The error, a status
+// error usually, is returned to callers that may not.
+type AuthorizeFunc func(ctx context.Context, fullMethod string) error
+
+// Register serves the Admin service for s. Every call is passed to
+// authorize first; a nil authorize refuses all calls.
+func Register(s *rpc.Server, authorize AuthorizeFunc) {
+	RegisterAdminServer(s, &server{s: s, authorize: authorize})
+}
+
+type server struct {
+	UnimplementedAdminServer
+	s         *rpc.Server
+	authorize AuthorizeFunc
+}
+
+func (a *server) check(ctx context.Context, fullMethod string) error {
+	if a.authorize == nil {
+		return status.Error(codes.PermissionDenied, "admin: no authorization configured")
+	}
+	return a.authorize(ctx, fullMethod)
+}
+
+func (a *server) EvictPeer(ctx context.Context, req *EvictPeerRequest) (*EvictPeerResponse, error) {
+	if err := a.check(ctx, "/nrpc.admin.Admin/EvictPeer"); err != nil {
+		return nil, err
+	}
+	if len(req.Nid) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "admin: missing nid")
+	}
+	if codes.Code(req.Code) == codes.OK {
+		return nil, status.Error(codes.InvalidArgument, "admin: eviction status must not be OK")
+	}
+	n := a.s.EvictPeer(req.Nid, status.New(codes.Code(req.Code), req.Message))
+	return &EvictPeerResponse{Streams: int32(n)}, nil
+}
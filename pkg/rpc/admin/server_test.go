@@ -0,0 +1,79 @@
+package admin_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/admin"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const adminToken = "secret"
+
+func authorize(ctx context.Context, fullMethod string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("admin-token"); len(v) == 0 || v[0] != adminToken {
+		return status.Error(codes.PermissionDenied, "not an admin")
+	}
+	return nil
+}
+
+func TestEvictPeer(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	admin.Register(s, authorize)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	victim := rpc.NewClient(nc, "srv", "victim")
+	defer victim.Close()
+	stream, err := echo.NewEchoClient(victim).BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	cli := rpc.NewClient(nc, "srv", "operator")
+	defer cli.Close()
+	ac := admin.NewAdminClient(cli)
+	req := &admin.EvictPeerRequest{Nid: "victim", Code: int32(codes.Aborted), Message: "bye"}
+	if _, err := ac.EvictPeer(ctx, req); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want %v", err, codes.PermissionDenied)
+	}
+	resp, err := ac.EvictPeer(metadata.AppendToOutgoingContext(ctx, "admin-token", adminToken), req)
+	if err != nil {
+		t.Fatalf("EvictPeer: %v", err)
+	}
+	if resp.Streams != 1 {
+		t.Fatalf("evicted %d streams, want 1", resp.Streams)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Aborted {
+		t.Fatalf("got %v, want %v", err, codes.Aborted)
+	}
+}
+
+func TestRegisterWithoutAuthorization(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	admin.Register(s, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli := rpc.NewClient(nc, "srv", "operator")
+	defer cli.Close()
+	_, err := admin.NewAdminClient(cli).EvictPeer(ctx, &admin.EvictPeerRequest{Nid: "victim", Code: int32(codes.Aborted)})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want %v", err, codes.PermissionDenied)
+	}
+}
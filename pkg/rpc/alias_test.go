@@ -0,0 +1,81 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+)
+
+type versionedServer struct {
+	echo.Server
+	version string
+}
+
+func (v *versionedServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{Message: v.version + ":" + req.Message}, nil
+}
+
+func TestSubjectAlias(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv")
+	defer s.Stop()
+	s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &versionedServer{version: "v1"}, rpc.WithSubjectAlias("echo.v1.Echo"))
+	s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &versionedServer{version: "v2"}, rpc.WithSubjectAlias("echo.v2.Echo"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		override string
+		want     string
+	}{
+		{"", "v1:hello"},
+		{"echo.v1.Echo", "v1:hello"},
+		{"echo.v2.Echo", "v2:hello"},
+	} {
+		var opts []rpc.ClientOption
+		if tc.override != "" {
+			opts = append(opts, rpc.WithServiceNameOverride(tc.override))
+		}
+		cli := rpc.NewClient(nc, "srv", "cli", opts...)
+		defer cli.Close()
+		reply, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{Message: "hello"})
+		if err != nil {
+			t.Fatalf("Unary via %q: %v", tc.override, err)
+		}
+		if reply.Message != tc.want {
+			t.Fatalf("got %q via %q, want %q", reply.Message, tc.override, tc.want)
+		}
+	}
+
+	if got := s.GetServiceInfo(); len(got) != 1 {
+		t.Fatalf("got %d services, want only the canonical one", len(got))
+	}
+	routes := map[string]rpc.Route{}
+	for _, r := range s.Routes() {
+		routes[r.Subject] = r
+	}
+	for _, subject := range []string{
+		"nrpc.srv.nrpctest.echo.Echo.Unary",
+		"nrpc.srv.echo.v1.Echo.Unary",
+		"nrpc.srv.echo.v2.Echo.BidiStream",
+	} {
+		r, ok := routes[subject]
+		if !ok {
+			t.Fatalf("missing route %v in %v", subject, routes)
+		}
+		if !strings.HasPrefix(r.FullMethod, "/nrpctest.echo.Echo/") {
+			t.Fatalf("route %v has method %v, want the canonical method", subject, r.FullMethod)
+		}
+		if alias := r.Service != "nrpctest.echo.Echo"; r.Alias != alias {
+			t.Fatalf("route %v has Alias %v, want %v", subject, r.Alias, alias)
+		}
+	}
+	if got, want := len(routes), 3*4; got != want {
+		t.Fatalf("got %d routes, want %d", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/utils"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/metadata"
+)
+
+// Headers carrying the status of the response to a bare NATS request, see
+// WithBareNATSCompat. BareStatusHeader is also set on the End of every call
+// with WithStatusHeader.
+const (
+	BareStatusHeader  = "Nrpc-Status"  // numeric gRPC status code
+	BareMessageHeader = "Nrpc-Message" // status message, unset when empty
+)
+
+// isBare reports whether msg, sent to a method accepting bare NATS requests,
+// lacks the nrpc envelope. The Call of an nrpc client names the subject it
+// was sent to, and its other frames belong to a known stream.
+func (s *Server) isBare(msg *nats.Msg, request *nrpc.Request, err error) bool {
+	if err != nil {
+		return true
+	}
+	if r, ok := request.Type.(*nrpc.Request_Call); ok {
+		return r.Call.Method != msg.Subject
+	}
+	_, ok := s.streams[msg.Reply]
+	return !ok
+}
+
+// serveBare runs a unary call to h whose request message is the payload of
+// msg, with its NATS headers as incoming metadata.
+func (s *Server) serveBare(msg *nats.Msg, h *methodHandler, log Logger) {
+	if len(msg.Reply) == 0 {
+		log.Errorf("bare request without reply subject")
+		return
+	}
+	stream := newServerStream(s, msg.Subject, msg.Reply, log, 1)
+	stream.bare = true
+	stream.handler = h
+	stream.processCall(&nrpc.Call{
+		Method:   msg.Subject,
+		Metadata: bareMetadata(msg.Header),
+		Unary:    true,
+	})
+	stream.processData(&nrpc.Data{Data: msg.Data})
+	stream.processEnd(&nrpc.End{})
+}
+
+// bareMetadata converts NATS headers to metadata, whose keys are lowercase.
+func bareMetadata(h nats.Header) *nrpc.Metadata {
+	md := metadata.MD{}
+	for k, vs := range h {
+		md.Append(strings.ToLower(k), vs...)
+	}
+	return utils.MakeMetadata(md)
+}
+
+// writeBare answers a bare request with a single message: the response
+// payload, with the header and trailer metadata and the status as NATS
+// headers.
+func (s *serverStream) writeBare(response *nrpc.Response) error {
+	switch r := response.Type.(type) {
+	case *nrpc.Response_Data:
+		s.bareData = r.Data.Data
+	case *nrpc.Response_End:
+		reply := nats.NewMsg(s.reply)
+		reply.Data = s.bareData
+		for _, md := range []metadata.MD{s.header, s.trailer} {
+			for k, vs := range md {
+				for _, v := range vs {
+					reply.Header.Add(k, v)
+				}
+			}
+		}
+		reply.Header.Set(BareStatusHeader, strconv.Itoa(int(r.End.Status.GetCode())))
+		if m := r.End.Status.GetMessage(); len(m) > 0 {
+			reply.Header.Set(BareMessageHeader, m)
+		}
+		nc, ok := s.server.nc.(interface{ PublishMsg(*nats.Msg) error })
+		if !ok {
+			return errors.New("nrpc: NatsConn does not support headers")
+		}
+		s.server.record(false, s.reply, "", reply.Data)
+		return nc.PublishMsg(reply)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package rpc_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBareNATSCompat(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv")
+	defer s.Stop()
+	s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}, rpc.WithBareNATSCompat("Unary"))
+
+	// nrpc clients are served as usual
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{Message: "nrpc"})
+	if err != nil || reply.Message != "nrpc" {
+		t.Fatalf("got %v, %v, want nrpc", reply, err)
+	}
+
+	for _, tc := range []struct {
+		req  *echo.EchoRequest
+		code codes.Code
+	}{
+		{&echo.EchoRequest{Message: "bare"}, codes.OK},
+		{&echo.EchoRequest{ErrorCode: int32(codes.NotFound), ErrorMessage: "gone"}, codes.NotFound},
+	} {
+		data, err := proto.Marshal(tc.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := nats.NewMsg("nrpc.srv.nrpctest.echo.Echo.Unary")
+		msg.Data = data
+		msg.Header.Set("Echo-Header-Id", "42")
+		resp, err := nc.RequestMsg(msg, 5*time.Second)
+		if err != nil {
+			t.Fatalf("RequestMsg: %v", err)
+		}
+		if got := resp.Header.Get(rpc.BareStatusHeader); got != strconv.Itoa(int(tc.code)) {
+			t.Fatalf("got status %v, want %d", got, tc.code)
+		}
+		if tc.code != codes.OK {
+			if got := resp.Header.Get(rpc.BareMessageHeader); got != tc.req.ErrorMessage {
+				t.Fatalf("got message %q, want %q", got, tc.req.ErrorMessage)
+			}
+			continue
+		}
+		if got := resp.Header.Get("echo-header-id"); got != "42" {
+			t.Fatalf("got header %q, want 42", got)
+		}
+		reply := &echo.EchoResponse{}
+		if err := proto.Unmarshal(resp.Data, reply); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if reply.Message != "bare" {
+			t.Fatalf("got %q, want bare", reply.Message)
+		}
+	}
+}
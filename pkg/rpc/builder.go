@@ -0,0 +1,248 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ServerBuilder assembles a Server from chainable settings and validates
+// them before any subscription is made. NewServer remains the simple path
+// for servers that need no checking.
+//
+// Setters never fail, problems are collected and reported by Validate and
+// Build.
+type ServerBuilder struct {
+	nid         string
+	tenant      string
+	pushMethods []string
+	opts        []ServerOption // of the valid settings below, in order
+	errs        []error
+}
+
+// NewServerBuilder returns an empty ServerBuilder.
+func NewServerBuilder() *ServerBuilder {
+	return &ServerBuilder{}
+}
+
+// Nid sets the unique ID the services are registered under.
+func (b *ServerBuilder) Nid(nid string) *ServerBuilder {
+	b.nid = nid
+	return b
+}
+
+// UnaryInterceptor adds a unary interceptor, chained after those already
+// added as with WithUnaryInterceptor.
+func (b *ServerBuilder) UnaryInterceptor(i grpc.UnaryServerInterceptor) *ServerBuilder {
+	if i == nil {
+		b.errs = append(b.errs, errors.New("nrpc: nil unary interceptor"))
+		return b
+	}
+	b.opts = append(b.opts, WithUnaryInterceptor(i))
+	return b
+}
+
+// StreamInterceptor adds a stream interceptor, chained after those already
+// added as with WithStreamInterceptor.
+func (b *ServerBuilder) StreamInterceptor(i grpc.StreamServerInterceptor) *ServerBuilder {
+	if i == nil {
+		b.errs = append(b.errs, errors.New("nrpc: nil stream interceptor"))
+		return b
+	}
+	b.opts = append(b.opts, WithStreamInterceptor(i))
+	return b
+}
+
+// Options adds opts as they are, for the settings the builder has no
+// setter for. They take effect in order with the other settings.
+func (b *ServerBuilder) Options(opts ...ServerOption) *ServerBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+// UnaryPush enables the hybrid unary mode for methods, see WithUnaryPush.
+func (b *ServerBuilder) UnaryPush(methods ...string) *ServerBuilder {
+	b.pushMethods = append(b.pushMethods, methods...)
+	return b
+}
+
+// SubjectPrefix sets the first subject token(s), see WithSubjectPrefix.
+func (b *ServerBuilder) SubjectPrefix(prefix string) *ServerBuilder {
+	if err := validatePrefix(prefix); err != nil {
+		b.errs = append(b.errs, err)
+		return b
+	}
+	b.opts = append(b.opts, WithSubjectPrefix(prefix))
+	return b
+}
+
+// Tenant serves the services under the subject token tenant following
+// the prefix, where the Tenant of a Target addresses them.
+func (b *ServerBuilder) Tenant(tenant string) *ServerBuilder {
+	if err := validateToken("tenant", tenant); err != nil {
+		b.errs = append(b.errs, err)
+		return b
+	}
+	b.tenant = tenant
+	return b
+}
+
+// QueueGroup sets the queue group of each service, see WithQueueGroup.
+func (b *ServerBuilder) QueueGroup(fn func(serviceName string) string) *ServerBuilder {
+	if fn == nil {
+		b.errs = append(b.errs, errors.New("nrpc: nil queue group function"))
+		return b
+	}
+	b.opts = append(b.opts, WithQueueGroup(fn))
+	return b
+}
+
+// Logger makes the server log to l, see WithLogger.
+func (b *ServerBuilder) Logger(l Logger) *ServerBuilder {
+	if l == nil {
+		b.errs = append(b.errs, errors.New("nrpc: nil logger"))
+		return b
+	}
+	b.opts = append(b.opts, WithLogger(l))
+	return b
+}
+
+// HandlerPool runs the handlers on size goroutines, see WithHandlerPool.
+func (b *ServerBuilder) HandlerPool(size int) *ServerBuilder {
+	if size <= 0 {
+		b.errs = append(b.errs, fmt.Errorf("nrpc: invalid handler pool size %d: must be positive", size))
+		return b
+	}
+	b.opts = append(b.opts, WithHandlerPool(size))
+	return b
+}
+
+// HandlerQueue bounds the calls waiting for the pool, see WithHandlerQueue.
+func (b *ServerBuilder) HandlerQueue(n int) *ServerBuilder {
+	if n <= 0 {
+		b.errs = append(b.errs, fmt.Errorf("nrpc: invalid handler queue %d: must be positive", n))
+		return b
+	}
+	b.opts = append(b.opts, WithHandlerQueue(n))
+	return b
+}
+
+// MaxRecvMsgSize bounds the size of a request, see WithMaxRecvMsgSize.
+func (b *ServerBuilder) MaxRecvMsgSize(bytes int) *ServerBuilder {
+	if bytes <= 0 {
+		b.errs = append(b.errs, fmt.Errorf("nrpc: invalid max receive message size %d: must be positive", bytes))
+		return b
+	}
+	b.opts = append(b.opts, WithMaxRecvMsgSize(bytes))
+	return b
+}
+
+// StreamRecvBuffer sets the receive buffer of a stream, see
+// WithStreamRecvBuffer.
+func (b *ServerBuilder) StreamRecvBuffer(n int) *ServerBuilder {
+	if n <= 0 {
+		b.errs = append(b.errs, fmt.Errorf("nrpc: invalid receive buffer %d: must be positive", n))
+		return b
+	}
+	b.opts = append(b.opts, WithStreamRecvBuffer(n))
+	return b
+}
+
+// MemoryBudget bounds the requests buffered, see WithMemoryBudget.
+func (b *ServerBuilder) MemoryBudget(n int64) *ServerBuilder {
+	if n <= 0 {
+		b.errs = append(b.errs, fmt.Errorf("nrpc: invalid memory budget %d: must be positive", n))
+		return b
+	}
+	b.opts = append(b.opts, WithMemoryBudget(n))
+	return b
+}
+
+// Keepalive pings the clients of the streams, see WithKeepalive.
+func (b *ServerBuilder) Keepalive(interval, timeout time.Duration) *ServerBuilder {
+	if interval <= 0 || timeout <= interval {
+		b.errs = append(b.errs, fmt.Errorf("nrpc: invalid keepalive %v, %v: the timeout must exceed the positive interval", interval, timeout))
+		return b
+	}
+	b.opts = append(b.opts, WithKeepalive(interval, timeout))
+	return b
+}
+
+// Validate reports the first problem found in the configuration, in a
+// setting or between settings.
+func (b *ServerBuilder) Validate() error {
+	if err := validateToken("nid", b.nid); err != nil {
+		return err
+	}
+	if len(b.errs) > 0 {
+		return b.errs[0]
+	}
+	for _, m := range b.pushMethods {
+		if _, _, err := splitMethod(m); err != nil {
+			return fmt.Errorf("nrpc: invalid push method: %v", err)
+		}
+	}
+	s := b.settings()
+	if budget := s.memoryBudget; budget > 0 {
+		if max := int64(s.maxRecvMsgSize); max > budget {
+			return fmt.Errorf("nrpc: max receive message size %d exceeds the memory budget of %d bytes", max, budget)
+		}
+		if full := int64(s.recvBuffer) * int64(s.maxRecvMsgSize); full > budget {
+			return fmt.Errorf("nrpc: receive buffer of %d messages of up to %d bytes exceeds the memory budget of %d bytes", s.recvBuffer, s.maxRecvMsgSize, budget)
+		}
+	}
+	return nil
+}
+
+// settings returns a Server holding the fields the options of b set, over
+// the defaults of NewServer, for Validate and Build to check them.
+func (b *ServerBuilder) settings() *Server {
+	s := &Server{
+		prefix:         defaultPrefix,
+		recvBuffer:     defaultRecvBuffer,
+		maxRecvMsgSize: defaultMaxRecvMsgSize,
+	}
+	for _, o := range b.opts {
+		o(s)
+	}
+	return s
+}
+
+// Build validates the configuration and creates the Server on nc.
+func (b *ServerBuilder) Build(nc NatsConn) (*Server, error) {
+	if nc == nil {
+		return nil, errors.New("nrpc: nil NatsConn")
+	}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	opts := append([]ServerOption(nil), b.opts...)
+	if len(b.tenant) > 0 {
+		opts = append(opts, WithSubjectPrefix(buildSubject(b.settings().prefix, b.tenant)))
+	}
+	if len(b.pushMethods) > 0 {
+		opts = append(opts, WithUnaryPush(b.pushMethods...))
+	}
+	return NewServer(nc, b.nid, opts...), nil
+}
+
+// validateToken checks that v can be used as a single NATS subject token.
+// An empty value is allowed, the token is omitted from the subject then.
+func validateToken(name, v string) error {
+	if strings.ContainsAny(v, ".*> \t\r\n") {
+		return fmt.Errorf("nrpc: invalid %v %q: must not contain '.', '*', '>' or whitespace", name, v)
+	}
+	return nil
+}
+
+// splitMethod splits a full gRPC method name "/service/method".
+func splitMethod(fullMethod string) (service, method string, err error) {
+	parts := strings.Split(fullMethod, "/")
+	if len(parts) != 3 || parts[0] != "" || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("%q is not of the form /service/method", fullMethod)
+	}
+	return parts[1], parts[2], nil
+}
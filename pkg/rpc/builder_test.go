@@ -0,0 +1,208 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+)
+
+func noopUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(ctx, req)
+}
+
+func noopStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, ss)
+}
+
+func TestServerBuilderValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		b    *rpc.ServerBuilder
+		msg  string
+	}{
+		{
+			name: "valid",
+			b: rpc.NewServerBuilder().Nid("node-1").UnaryInterceptor(noopUnary).UnaryPush("/echo.Echo/SayHello").
+				SubjectPrefix("my.app").HandlerPool(4).HandlerQueue(64).MaxRecvMsgSize(1<<20).StreamRecvBuffer(8).
+				MemoryBudget(1<<24).Keepalive(time.Second, 3*time.Second).Tenant("acme").
+				QueueGroup(func(service string) string { return "acme." + service }).
+				Options(rpc.WithServiceRateLimit("echo.Echo", 10, 10)),
+		},
+		{
+			name: "empty nid",
+			b:    rpc.NewServerBuilder(),
+		},
+		{
+			name: "dotted nid",
+			b:    rpc.NewServerBuilder().Nid("node.1"),
+			msg:  `nrpc: invalid nid "node.1": must not contain '.', '*', '>' or whitespace`,
+		},
+		{
+			name: "wildcard nid",
+			b:    rpc.NewServerBuilder().Nid("*"),
+			msg:  `nrpc: invalid nid "*": must not contain '.', '*', '>' or whitespace`,
+		},
+		{
+			name: "nid with space",
+			b:    rpc.NewServerBuilder().Nid("node 1"),
+			msg:  `nrpc: invalid nid "node 1": must not contain '.', '*', '>' or whitespace`,
+		},
+		{
+			name: "chained interceptors",
+			b: rpc.NewServerBuilder().UnaryInterceptor(noopUnary).UnaryInterceptor(noopUnary).
+				StreamInterceptor(noopStream).StreamInterceptor(noopStream),
+		},
+		{
+			name: "nil unary interceptor",
+			b:    rpc.NewServerBuilder().UnaryInterceptor(nil),
+			msg:  "nrpc: nil unary interceptor",
+		},
+		{
+			name: "nil stream interceptor",
+			b:    rpc.NewServerBuilder().StreamInterceptor(nil),
+			msg:  "nrpc: nil stream interceptor",
+		},
+		{
+			name: "dotted tenant",
+			b:    rpc.NewServerBuilder().Tenant("acme.eu"),
+			msg:  `nrpc: invalid tenant "acme.eu": must not contain '.', '*', '>' or whitespace`,
+		},
+		{
+			name: "nil queue group",
+			b:    rpc.NewServerBuilder().QueueGroup(nil),
+			msg:  "nrpc: nil queue group function",
+		},
+		{
+			name: "nil logger",
+			b:    rpc.NewServerBuilder().Logger(nil),
+			msg:  "nrpc: nil logger",
+		},
+		{
+			name: "empty prefix",
+			b:    rpc.NewServerBuilder().SubjectPrefix(""),
+			msg:  "nrpc: invalid prefix: must not be empty",
+		},
+		{
+			name: "wildcard prefix",
+			b:    rpc.NewServerBuilder().SubjectPrefix("my.*"),
+			msg:  `nrpc: invalid prefix "my.*": must not contain '*', '>' or whitespace`,
+		},
+		{
+			name: "empty pool",
+			b:    rpc.NewServerBuilder().HandlerPool(0),
+			msg:  "nrpc: invalid handler pool size 0: must be positive",
+		},
+		{
+			name: "empty handler queue",
+			b:    rpc.NewServerBuilder().HandlerQueue(0),
+			msg:  "nrpc: invalid handler queue 0: must be positive",
+		},
+		{
+			name: "negative max message size",
+			b:    rpc.NewServerBuilder().MaxRecvMsgSize(-1),
+			msg:  "nrpc: invalid max receive message size -1: must be positive",
+		},
+		{
+			name: "empty receive buffer",
+			b:    rpc.NewServerBuilder().StreamRecvBuffer(0),
+			msg:  "nrpc: invalid receive buffer 0: must be positive",
+		},
+		{
+			name: "empty memory budget",
+			b:    rpc.NewServerBuilder().MemoryBudget(0),
+			msg:  "nrpc: invalid memory budget 0: must be positive",
+		},
+		{
+			name: "keepalive timeout below interval",
+			b:    rpc.NewServerBuilder().Keepalive(time.Second, time.Second),
+			msg:  "nrpc: invalid keepalive 1s, 1s: the timeout must exceed the positive interval",
+		},
+		{
+			name: "max message size over the memory budget",
+			b:    rpc.NewServerBuilder().MemoryBudget(1 << 20).MaxRecvMsgSize(2 << 20),
+			msg:  "nrpc: max receive message size 2097152 exceeds the memory budget of 1048576 bytes",
+		},
+		{
+			name: "default max message size over the memory budget",
+			b:    rpc.NewServerBuilder().Options(rpc.WithMemoryBudget(1 << 20)),
+			msg:  "nrpc: max receive message size 4194304 exceeds the memory budget of 1048576 bytes",
+		},
+		{
+			name: "receive buffer over the memory budget",
+			b:    rpc.NewServerBuilder().MemoryBudget(1 << 20).MaxRecvMsgSize(1 << 16).StreamRecvBuffer(32),
+			msg:  "nrpc: receive buffer of 32 messages of up to 65536 bytes exceeds the memory budget of 1048576 bytes",
+		},
+		{
+			name: "push method without service",
+			b:    rpc.NewServerBuilder().UnaryPush("SayHello"),
+			msg:  `nrpc: invalid push method: "SayHello" is not of the form /service/method`,
+		},
+		{
+			name: "push method with empty method",
+			b:    rpc.NewServerBuilder().UnaryPush("/echo.Echo/"),
+			msg:  `nrpc: invalid push method: "/echo.Echo/" is not of the form /service/method`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.b.Validate()
+			if tc.msg == "" {
+				if err != nil {
+					t.Fatalf("got %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.msg {
+				t.Fatalf("got %v, want %s", err, tc.msg)
+			}
+		})
+	}
+}
+
+func TestServerBuilderBuild(t *testing.T) {
+	if _, err := rpc.NewServerBuilder().Build(nil); err == nil || err.Error() != "nrpc: nil NatsConn" {
+		t.Fatalf("got %v, want nil NatsConn error", err)
+	}
+
+	nc := nrpctest.RunNats(t)
+	if _, err := rpc.NewServerBuilder().Nid("a.b").Build(nc); err == nil {
+		t.Fatalf("Build accepted an invalid nid")
+	}
+
+	var order []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			order = append(order, name)
+			return handler(ctx, req)
+		}
+	}
+	s, err := rpc.NewServerBuilder().
+		Nid("srv").
+		Tenant("acme").
+		UnaryInterceptor(interceptor("first")).
+		Options(rpc.WithUnaryInterceptor(interceptor("second"))).
+		UnaryInterceptor(interceptor("third")).
+		Build(nc)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	defer s.Stop()
+	echo.RegisterEchoServer(s, &echo.Server{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the tenant follows the prefix
+	cli := echo.NewEchoClient(rpc.NewClient(nc, "srv", "cli", rpc.WithClientSubjectPrefix("nrpc.acme")))
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if got, want := strings.Join(order, " "), "first second third"; got != want {
+		t.Fatalf("interceptors ran as %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+)
+
+// CallIDKey is the metadata key carrying the identifier of a call. The
+// client mints it, unless the outgoing metadata already has one, and the
+// server mints one for the calls that arrive without it.
+const CallIDKey = "nrpc-call-id"
+
+// IDGenerator returns a new identifier on every call. It is called
+// concurrently on the path of every call, so it must be safe for concurrent
+// use and cheap.
+type IDGenerator func() string
+
+var idEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewID is the default IDGenerator, it returns 128 bits from crypto/rand as
+// 26 base32 characters.
+func NewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return idEncoding.EncodeToString(b[:])
+}
+
+// WithIDGenerator sets how the server mints the call ID of the calls that
+// arrive without one, NewID by default.
+func WithIDGenerator(gen IDGenerator) ServerOption {
+	return func(s *Server) {
+		s.newID = gen
+	}
+}
+
+// WithClientIDGenerator sets how the client mints call IDs, NewID by
+// default. The ID travels in the metadata of the call only, the reply inbox
+// of the call is random whatever the generator, so that it can be neither
+// guessed nor shared by two calls.
+func WithClientIDGenerator(gen IDGenerator) ClientOption {
+	return func(p *Client) {
+		p.newID = gen
+	}
+}
+
+type callIDKey struct{}
+
+// CallIDFromContext returns the call ID of the call a handler serves.
+func CallIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(callIDKey{}).(string)
+	return id, ok
+}
@@ -0,0 +1,112 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/metadata"
+)
+
+type callIDServer struct {
+	echo.Server
+}
+
+func (c *callIDServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	id, _ := rpc.CallIDFromContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	return &echo.EchoResponse{Message: id + " " + strings.Join(md.Get(rpc.CallIDKey), ",")}, nil
+}
+
+func (c *callIDServer) BidiStream(stream echo.Echo_BidiStreamServer) error {
+	id, _ := rpc.CallIDFromContext(stream.Context())
+	return stream.Send(&echo.EchoResponse{Message: id})
+}
+
+func sequence(prefix string) rpc.IDGenerator {
+	var n int32
+	return func() string {
+		return fmt.Sprintf("%v-%04d", prefix, atomic.AddInt32(&n, 1))
+	}
+}
+
+func TestCallID(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	replies := make(chan string, 16)
+	s := rpc.NewServer(nc, "srv", rpc.WithIDGenerator(sequence("srv")), rpc.WithMsgObserver(func(info rpc.MsgInfo) {
+		replies <- info.Reply
+	}))
+	defer s.Stop()
+	echo.RegisterEchoServer(s, &callIDServer{})
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithClientIDGenerator(sequence("cli")))
+	defer cli.Close()
+	ec := echo.NewEchoClient(cli)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := ec.Unary(ctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if want := "cli-0001 cli-0001"; reply.Message != want {
+		t.Fatalf("got %q, want %q", reply.Message, want)
+	}
+	// the call ID does not name the inbox, another call could
+	if got := <-replies; !strings.HasPrefix(got, nats.InboxPrefix) || strings.Contains(got, "cli-0001") {
+		t.Fatalf("got reply subject %v, want a random inbox", got)
+	}
+
+	stream, err := ec.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if reply, err := stream.Recv(); err != nil || reply.Message != "cli-0002" {
+		t.Fatalf("got %v, %v, want cli-0002", reply, err)
+	}
+
+	// set by the caller
+	md := metadata.AppendToOutgoingContext(ctx, rpc.CallIDKey, "parent")
+	if reply, err := ec.Unary(md, &echo.EchoRequest{}); err != nil || reply.Message != "parent parent" {
+		t.Fatalf("got %v, %v, want the ID of the caller", reply, err)
+	}
+}
+
+func TestCallIDMinted(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv", rpc.WithIDGenerator(sequence("srv")))
+	defer s.Stop()
+	echo.RegisterEchoServer(s, &callIDServer{})
+
+	// a call made without the nrpc client carries no ID
+	reply, err := rawUnary(t, nc, nats.NewInbox(), &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if want := "srv-0001 srv-0001"; reply.Message != want {
+		t.Fatalf("got %q, want %q", reply.Message, want)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := rpc.NewID()
+		if len(id) != 26 || strings.ContainsAny(id, ".*> ") {
+			t.Fatalf("got invalid ID %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("got %q twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,111 @@
+package rpc
+
+import "github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+
+// chunkOverhead is the room left in a NATS message for the envelope
+// around the payload of a chunk.
+const chunkOverhead = 1024
+
+// WithMaxChunkSize makes the server split the messages it sends larger
+// than n bytes into chunks of n bytes, which the client reassembles, so
+// that they fit the max payload of NATS. By default n is the max payload
+// of the connection, less room for the envelope.
+func WithMaxChunkSize(n int) ServerOption {
+	return func(s *Server) {
+		s.chunkSize = n
+	}
+}
+
+// WithClientMaxChunkSize is WithMaxChunkSize for the messages the client
+// sends.
+func WithClientMaxChunkSize(n int) ClientOption {
+	return func(p *Client) {
+		p.chunkSize = n
+	}
+}
+
+// chunkSize returns the size of the chunks of the messages sent on nc, n
+// when set, none when nc does not tell its max payload.
+func chunkSize(nc NatsConn, n int) int {
+	if n > 0 {
+		return n
+	}
+	if c, ok := nc.(interface{ MaxPayload() int64 }); ok {
+		if n := int(c.MaxPayload()) - chunkOverhead; n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// writeChunks writes data with write, split into chunks of at most size
+// bytes, each with the seq of data.
+func writeChunks(data *nrpc.Data, size int, write func(*nrpc.Data) error) error {
+	if size <= 0 || len(data.Data) <= size {
+		return write(data)
+	}
+	for offset := 0; offset < len(data.Data); offset += size {
+		end := offset + size
+		if end > len(data.Data) {
+			end = len(data.Data)
+		}
+		err := write(&nrpc.Data{
+			Data:   data.Data[offset:end],
+			Seq:    data.Seq,
+			More:   end < len(data.Data),
+			Offset: uint64(offset),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addChunk adds a chunk of a request to the reassembly of the stream, and
+// returns the request once it is complete. The chunks collected count
+// against the memory budget as they arrive, and once complete the request
+// does, until it is read or the stream ends.
+func (s *serverStream) addChunk(data *nrpc.Data) (*nrpc.Data, bool) {
+	before := len(s.chunks.buf)
+	data, ok := s.chunks.add(data)
+	after := len(s.chunks.buf)
+	if ok {
+		after = len(data.Data)
+	}
+	if after > before {
+		s.hold(after - before)
+	} else {
+		s.release(before - after)
+	}
+	return data, ok
+}
+
+// reassembly collects the chunks of a message, see writeChunks.
+type reassembly struct {
+	buf []byte
+	seq uint64
+}
+
+// add adds a chunk, and returns the message once it is complete. A chunk
+// not following the ones collected, as when a resend of an acknowledged
+// stream starts over after a lost chunk, drops them.
+func (r *reassembly) add(data *nrpc.Data) (*nrpc.Data, bool) {
+	if data.Offset != uint64(len(r.buf)) || data.Seq != r.seq && len(r.buf) > 0 {
+		r.buf = nil
+		if data.Offset != 0 {
+			return nil, false
+		}
+	}
+	if data.More {
+		r.buf = append(r.buf, data.Data...)
+		r.seq = data.Seq
+		return nil, false
+	}
+	if r.buf == nil {
+		return data, true
+	}
+	whole := &nrpc.Data{Data: append(r.buf, data.Data...), Seq: data.Seq}
+	r.buf = nil
+	return whole, true
+}
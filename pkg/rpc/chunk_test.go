@@ -0,0 +1,97 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChunking(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// past the max payload of the connection, and the default bound of a
+	// received message
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithMaxRecvMsgSize(8*1024*1024))
+	big := strings.Repeat("0123456789", 512*1024)
+	res, err := cli.Unary(ctx, &echo.EchoRequest{Message: big})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if res.Message != big {
+		t.Fatalf("got a message of %d bytes, want %d", len(res.Message), len(big))
+	}
+
+	// chunks of a set size, on a stream with acknowledgments
+	echo.StartEchoServer(t, nc, "small", rpc.WithMaxChunkSize(1000))
+	conn := rpc.NewClient(nc, "small", "cli", rpc.WithClientMaxChunkSize(1000))
+	defer conn.Close()
+	stream, err := echo.NewEchoClient(conn).BidiStream(ctx, rpc.WithStreamAcks())
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		msg := strings.Repeat(string(rune('a'+i)), 2500*(i+1))
+		if err := stream.Send(&echo.EchoRequest{Message: msg}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if res.Message != msg {
+			t.Fatalf("got %d bytes, want %d", len(res.Message), len(msg))
+		}
+	}
+}
+
+func TestChunksMemoryBudget(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv", rpc.WithMemoryBudget(16))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the first chunk of a request, the rest never comes
+	const subject = "nrpc.srv.nrpctest.echo.Echo.BidiStream"
+	inbox := nats.NewInbox()
+	publish := func(r *nrpc.Request) {
+		data, _ := proto.Marshal(r)
+		if err := nc.PublishRequest(subject, inbox, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(&nrpc.Request{Type: &nrpc.Request_Call{Call: &nrpc.Call{Method: subject, Nid: "raw"}}})
+	publish(&nrpc.Request{Type: &nrpc.Request_Data{Data: &nrpc.Data{Data: make([]byte, 32), More: true}}})
+	for s.BufferedBytes() != 32 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d bytes buffered, want the chunk", s.BufferedBytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+
+	// released with the stream
+	publish(&nrpc.Request{Type: &nrpc.Request_End{End: &nrpc.End{Status: status.New(codes.Canceled, "gone").Proto()}}})
+	for s.BufferedBytes() != 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d bytes buffered, want 0", s.BufferedBytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
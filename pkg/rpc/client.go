@@ -7,53 +7,230 @@ import (
 	"io"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
 	"github.com/cloudwebrtc/nats-grpc/pkg/utils"
 	"github.com/nats-io/nats.go"
-	log "github.com/pion/ion-log"
 	"github.com/sirupsen/logrus"
 	grpc "google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
 type Client struct {
-	nc      NatsConn
-	ctx     context.Context
-	cancel  context.CancelFunc
-	log     *logrus.Logger
-	streams map[string]*clientStream
-	svcid   string
-	nid     string
-	mu      sync.Mutex
+	nc               NatsConn
+	ctx              context.Context
+	cancel           context.CancelFunc
+	log              Logger
+	streams          map[string]*clientStream
+	svcid            string
+	nid              string
+	mu               sync.Mutex
+	codecs           map[string]encoding.Codec // service name -> codec
+	service          string                    // service token override, see WithServiceNameOverride
+	prefix           string                    // first subject token(s), see WithClientSubjectPrefix
+	margin           time.Duration             // deadline margin per hop, see WithHopMargin
+	timeouts         map[string]time.Duration  // default timeout per method, see WithMethodTimeouts
+	newID            IDGenerator               // mints call IDs, see WithClientIDGenerator
+	keepaliveTimeout time.Duration             // see WithKeepaliveTimeout
+	chunkSize        int                       // see WithClientMaxChunkSize
+	marshal          proto.MarshalOptions
+	contentCodecs    map[string]encoding.Codec // content-subtype -> codec, see WithClientContentCodecs
+	hashKey          KeyFunc                   // see WithConsistentHash
+	ring             *hashRing                 // guarded by mu
+	closing          bool                      // set by Close, guarded by mu
+	calls            sync.WaitGroup            // unary calls in flight
+	readers          sync.WaitGroup            // goroutines reading stream responses
 }
 
-func NewClient(nc NatsConn, svcid string, nid string) *Client {
+// ErrClientClosed is returned by the calls made once Close has been called.
+var ErrClientClosed = status.Error(codes.Canceled, "nrpc: the client is closing")
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithClientCodec sets the codec used for the messages of service, it must
+// match the codec the service was registered with (see WithServiceCodec).
+func WithClientCodec(service string, c encoding.Codec) ClientOption {
+	return func(p *Client) {
+		if p.codecs == nil {
+			p.codecs = make(map[string]encoding.Codec)
+		}
+		p.codecs[service] = c
+	}
+}
+
+// WithClientDeterministicMarshal makes the client marshal the messages it
+// sends deterministically, see WithDeterministicMarshal.
+func WithClientDeterministicMarshal() ClientOption {
+	return func(p *Client) {
+		p.marshal.Deterministic = true
+	}
+}
+
+// WithServiceNameOverride targets the service token name instead of the
+// service name of the called method, to reach a service registered with
+// WithSubjectAlias through its generated stubs.
+func WithServiceNameOverride(name string) ClientOption {
+	return func(p *Client) {
+		p.service = name
+	}
+}
+
+// WithClientSubjectPrefix calls the servers configured with the same
+// WithSubjectPrefix. It panics on an invalid prefix.
+func WithClientSubjectPrefix(prefix string) ClientOption {
+	mustValidatePrefix(prefix)
+	return func(p *Client) {
+		p.prefix = prefix
+	}
+}
+
+// WithClientLogger makes the client log to l instead of its own logrus
+// logger at debug level, see LogrusLogger.
+func WithClientLogger(l Logger) ClientOption {
+	return func(p *Client) {
+		p.log = l
+	}
+}
+
+// WithHopMargin shortens the deadline of every call by margin, see
+// ShortenDeadline. Use it for the clients a service calls other services
+// with.
+func WithHopMargin(margin time.Duration) ClientOption {
+	return func(p *Client) {
+		p.margin = margin
+	}
+}
+
+// WithMethodTimeouts sets the timeout of the calls to the given methods,
+// named like "/echo.Echo/SayHello", whose context has no deadline and that
+// are made without WithCallTimeout.
+func WithMethodTimeouts(timeouts map[string]time.Duration) ClientOption {
+	return func(p *Client) {
+		if p.timeouts == nil {
+			p.timeouts = make(map[string]time.Duration)
+		}
+		for m, d := range timeouts {
+			p.timeouts[m] = d
+		}
+	}
+}
+
+// CallTimeoutOption is a grpc.CallOption bounding the duration of a call,
+// see WithCallTimeout.
+type CallTimeoutOption struct {
+	grpc.EmptyCallOption
+	Timeout time.Duration
+}
+
+// WithCallTimeout bounds the duration of a single call, which ends with
+// codes.DeadlineExceeded if it has not completed after d. The deadline of
+// the context of the call still applies when it is earlier.
+func WithCallTimeout(d time.Duration) grpc.CallOption {
+	return CallTimeoutOption{Timeout: d}
+}
+
+func NewClient(nc NatsConn, svcid string, nid string, opts ...ClientOption) *Client {
 	c := &Client{
 		nc:      nc,
 		svcid:   svcid,
 		nid:     nid,
 		streams: make(map[string]*clientStream),
-		log:     log.NewLoggerWithFields(log.DebugLevel, "nats-grpc.Client", log.Fields{"svc-id": svcid, "self-nid": nid}),
+		prefix:  defaultPrefix,
+		newID:   NewID,
+		log:     newLogger(logrus.DebugLevel, Fields{"svc-id": svcid, "self-nid": nid}),
 	}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
+	for _, o := range opts {
+		o(c)
+	}
 	return c
 }
 
-// Close gracefully stops a Client
+// codec returns the codec of the service method belongs to.
+func (c *Client) codec(method string) encoding.Codec {
+	if service, _, err := splitMethod(method); err == nil {
+		if codec, ok := c.codecs[service]; ok {
+			return codec
+		}
+	}
+	return protoCodec{opts: c.marshal}
+}
+
+// callContext returns the context of a call to method: ctx bounded by the
+// call or method timeout, and shortened by the hop margin. It lives as long
+// as the call, whose end cancels it and releases its timer.
+func (c *Client) callContext(ctx context.Context, method string, opts []grpc.CallOption) (context.Context, context.CancelFunc) {
+	var timeout time.Duration
+	for _, o := range opts {
+		if o, ok := o.(CallTimeoutOption); ok {
+			timeout = o.Timeout
+		}
+	}
+	if _, ok := ctx.Deadline(); !ok && timeout == 0 {
+		timeout = c.timeouts[method]
+	}
+	parent, ok := ctx.Deadline()
+	deadline := parent
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	deadline = deadline.Add(-c.margin)
+	if !ok || deadline.Equal(parent) {
+		// the deadline of ctx, if any, applies as is
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// subject returns the subject method is called on at the server nid.
+func (c *Client) subject(nid, method string) string {
+	service, m, err := splitMethod(method)
+	if err != nil {
+		return buildSubject(c.prefix, nid) + strings.ReplaceAll(method, "/", ".")
+	}
+	if len(c.service) > 0 {
+		service = c.service
+	}
+	return buildSubject(c.prefix, nid, service, m)
+}
+
+// Close stops a Client. New calls fail with ErrClientClosed, and the calls
+// in flight, unary or streaming, are cancelled on the server and fail with
+// ErrClientClosed. Close returns once every reply subscription has been
+// removed and the goroutines of the client have exited.
 func (p *Client) Close() error {
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+	// the reader of every stream closes it as well, see ReadMsg
 	p.cancel()
-	for name, st := range p.streams {
-		err := st.done()
-		if err != nil {
-			p.log.Errorf("Unsubscribe [%v] failed %v", name, err)
-			return err
+
+	p.mu.Lock()
+	streams := make([]*clientStream, 0, len(p.streams))
+	for _, st := range p.streams {
+		streams = append(streams, st)
+	}
+	p.mu.Unlock()
+	var err error
+	for _, st := range streams {
+		if e := st.close(ErrClientClosed); e != nil {
+			p.log.Errorf("Unsubscribe [%v] failed %v", st.reply, e)
+			if err == nil {
+				err = e
+			}
 		}
 	}
-	return nil
+	p.calls.Wait()
+	p.readers.Wait()
+	return err
 }
 
 func (p *Client) CloseStream(nid string) bool {
@@ -64,70 +241,236 @@ func (p *Client) CloseStream(nid string) bool {
 	return false
 }
 
-func (c *Client) remove(subj string) {
+// register adds stream to the client and starts reading its responses,
+// unless the client is closing.
+func (c *Client) register(stream *clientStream) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return ErrClientClosed
+	}
+	c.streams[stream.reply] = stream
+	c.readers.Add(1)
+	go func() {
+		defer c.readers.Done()
+		defer close(stream.ended)
+		stream.ReadMsg()
+	}()
+	return nil
+}
+
+func (c *Client) remove(reply string) {
 	c.mu.Lock()
-	delete(c.streams, subj)
+	delete(c.streams, reply)
 	c.mu.Unlock()
 }
 
 // Invoke performs a unary RPC and returns after the request is received
 // into reply.
 func (c *Client) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
-	prefix := "nrpc"
-	if len(c.svcid) > 0 {
-		prefix = fmt.Sprintf("nrpc.%v", c.svcid)
+	return c.invoke(ctx, c.target(ctx, method), method, args, reply, opts...)
+}
+
+// invoke performs a unary RPC on the server nid, retried as the server
+// hints with WithHintedRetries, and until a server listens with
+// grpc.WaitForReady(true).
+func (c *Client) invoke(ctx context.Context, nid, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	attempts := 1
+	for _, o := range opts {
+		if o, ok := o.(HintedRetriesOption); ok && o.MaxAttempts > 1 {
+			attempts = o.MaxAttempts
+		}
+	}
+	ready := waitForReady(opts)
+	wait := 50 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		stream, err := c.invokeOnce(ctx, nid, method, args, reply, opts...)
+		if err == nil || stream == nil {
+			return err
+		}
+		if ready && status.Code(err) == codes.Unavailable {
+			if <-stream.ended; stream.noResponders {
+				// waiting for a server does not use up the attempts
+				attempt--
+				if !sleep(ctx, wait) {
+					return status.FromContextError(ctx.Err()).Err()
+				}
+				if wait *= 2; wait > readyBackoff {
+					wait = readyBackoff
+				}
+				continue
+			}
+		}
+		if attempt >= attempts {
+			return err
+		}
+		// the trailer is complete once the stream is no longer read
+		<-stream.ended
+		delay, ok := retryDelay(ctx, err, stream.Trailer())
+		if !ok {
+			return err
+		}
+		c.log.Infof("retrying %v in %v, attempt %d failed: %v", method, delay, attempt, err)
+		if !sleep(ctx, delay) {
+			return err
+		}
+		// the header and trailer are those of the last attempt
+		for _, o := range opts {
+			switch o := o.(type) {
+			case grpc.HeaderCallOption:
+				*o.HeaderAddr = nil
+			case grpc.TrailerCallOption:
+				*o.TrailerAddr = nil
+			}
+		}
 	}
-	subj := prefix + strings.ReplaceAll(method, "/", ".")
-	stream := newClientStream(ctx, c, subj, c.log, opts...)
+}
+
+// invokeOnce performs an attempt of a unary RPC on the server nid, and
+// returns its stream, if it got to start it, along with its error.
+func (c *Client) invokeOnce(ctx context.Context, nid, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) (*clientStream, error) {
 	c.mu.Lock()
-	c.streams[stream.reply] = stream
+	if c.closing {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	c.calls.Add(1)
 	c.mu.Unlock()
-	return stream.Invoke(ctx, method, args, reply, opts...)
+	defer c.calls.Done()
+	stream, err := newClientStream(ctx, c, method, c.log, opts...)
+	if err != nil {
+		return nil, err
+	}
+	stream.subject = c.subject(nid, method)
+	if err := c.register(stream); err != nil {
+		stream.done()
+		return nil, err
+	}
+	return stream, stream.Invoke(ctx, method, args, reply, opts...)
 }
 
-//NewStream begins a streaming RPC.
+// NewStream begins a streaming RPC.
 func (c *Client) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-	prefix := "nrpc"
-	if len(c.svcid) > 0 {
-		prefix = fmt.Sprintf("nrpc.%v", c.svcid)
+	stream, err := newClientStream(ctx, c, method, c.log, opts...)
+	if err != nil {
+		return nil, err
+	}
+	stream.subject = c.subject(c.target(ctx, method), method)
+	if err := c.register(stream); err != nil {
+		stream.done()
+		return nil, err
 	}
-	subj := prefix + strings.ReplaceAll(method, "/", ".")
-	stream := newClientStream(ctx, c, subj, c.log, opts...)
-	c.mu.Lock()
-	c.streams[stream.reply] = stream
-	c.mu.Unlock()
 	return stream, nil
 }
 
+// ServerStream starts the server-streaming call method with req and delivers
+// the responses on a channel, each one allocated by newReply. Once the call
+// ends the final error, nil when the server finished with OK, is sent on the
+// error channel and the response channel is closed. Cancelling ctx stops the
+// call and discards unread responses.
+func (c *Client) ServerStream(ctx context.Context, method string, req interface{}, newReply func() interface{}, opts ...grpc.CallOption) (<-chan interface{}, <-chan error) {
+	ch := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		errCh <- c.serverStream(ctx, method, req, newReply, ch, opts...)
+	}()
+	return ch, errCh
+}
+
+func (c *Client) serverStream(ctx context.Context, method string, req interface{}, newReply func() interface{}, ch chan<- interface{}, opts ...grpc.CallOption) error {
+	stream, err := c.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method, opts...)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		reply := newReply()
+		if err := stream.RecvMsg(reply); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		select {
+		case ch <- reply:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
 type clientStream struct {
-	md        *metadata.MD
-	header    *metadata.MD
-	trailer   *metadata.MD
-	lastErr   error
-	ctx       context.Context
-	cancel    context.CancelFunc
-	log       *logrus.Logger
-	client    *Client
-	subject   string
-	reply     string
-	msgCh     chan *nats.Msg
-	sub       *nats.Subscription
-	closed    bool
-	recvRead  <-chan []byte
-	recvWrite chan<- []byte
-	hasBegun  bool
-	pnid      string
-}
-
-func newClientStream(ctx context.Context, client *Client, subj string, log *logrus.Logger, opts ...grpc.CallOption) *clientStream {
+	md           *metadata.MD
+	header       *metadata.MD
+	trailer      *metadata.MD
+	lastErr      error // terminal error returned by RecvMsg once recvRead is drained
+	ctx          context.Context
+	cancel       context.CancelFunc
+	log          Logger
+	client       *Client
+	id           string // call ID, see CallIDKey
+	subject      string
+	reply        string
+	msgCh        chan *nats.Msg
+	sub          *nats.Subscription
+	mu           sync.Mutex
+	closed       bool
+	closeErr     error // the error the client closed the stream with, guarded by mu
+	recvRead     <-chan []byte
+	recvWrite    chan<- []byte
+	hasBegun     bool
+	unary        bool
+	codec        encoding.Codec
+	contentType  string // sent when the call picked its codec, see WithContentCodecs
+	pnid         string
+	pinged       bool          // the server sends keepalives, read by ReadMsg only
+	noResponders bool          // no server received the call, set by ReadMsg before it fails the stream
+	answered     bool          // a message of the server arrived, read by ReadMsg only
+	ended        chan struct{} // closed once ReadMsg returns
+	acks         bool          // see WithStreamAcks
+	acked        uint64        // seq of the last response delivered, read by ReadMsg only
+	chunks       reassembly    // the response being received in chunks, read by ReadMsg only
+}
+
+func newClientStream(ctx context.Context, client *Client, method string, log Logger, opts ...grpc.CallOption) (*clientStream, error) {
 	stream := &clientStream{
 		client:  client,
-		log:     log,
-		subject: subj,
-		reply:   utils.NewInBox(),
+		codec:   client.codec(method),
+		subject: client.subject(client.svcid, method),
 		closed:  false,
+		ended:   make(chan struct{}),
+	}
+	for _, o := range opts {
+		if o, ok := o.(grpc.ContentSubtypeCallOption); ok {
+			name := strings.ToLower(o.ContentSubtype)
+			codec, err := client.contentCodec(name)
+			if err != nil {
+				return nil, err
+			}
+			stream.codec = codec
+			stream.contentType = contentTypePrefix + "+" + name
+		}
+	}
+	stream.ctx, stream.cancel = client.callContext(ctx, method, opts)
+
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		//log.Printf("stream outgoing md => %v", md)
+		stream.md = &md
+	}
+	if ids := md.Get(CallIDKey); len(ids) > 0 {
+		// set by the caller
+		stream.id = ids[0]
+	} else {
+		stream.id = client.newID()
 	}
-	stream.ctx, stream.cancel = context.WithCancel(ctx)
+	stream.reply = utils.NewInBox()
+	stream.log = log.WithFields(Fields{"call-id": stream.id})
 
 	recv := make(chan []byte, 1)
 	stream.recvRead = recv
@@ -136,12 +479,6 @@ func newClientStream(ctx context.Context, client *Client, subj string, log *logr
 	stream.msgCh = make(chan *nats.Msg, 8192)
 	stream.sub, _ = client.nc.ChanSubscribe(stream.reply, stream.msgCh)
 
-	md, ok := metadata.FromOutgoingContext(ctx)
-	if ok {
-		//log.Printf("stream outgoing md => %v", md)
-		stream.md = &md
-	}
-
 	for _, o := range opts {
 		switch o := o.(type) {
 		case grpc.HeaderCallOption:
@@ -157,11 +494,15 @@ func newClientStream(ctx context.Context, client *Client, subj string, log *logr
 		case grpc.MaxSendMsgSizeCallOption:
 		case grpc.CompressorCallOption:
 		case grpc.ContentSubtypeCallOption:
+			// picked the codec above
+		case grpc.ForceCodecCallOption:
+			stream.codec = o.Codec
+		case StreamAcksOption:
+			stream.acks = true
 		}
 	}
 
-	go stream.ReadMsg()
-	return stream
+	return stream, nil
 }
 
 func (c *clientStream) Header() (metadata.MD, error) {
@@ -179,18 +520,32 @@ func (c *clientStream) Trailer() metadata.MD {
 }
 
 func (c *clientStream) CloseSend() error {
-	c.log.Info("Client CloseSend")
-	c.writeEnd(&nrpc.End{
-		Status: status.Convert(nil).Proto(),
-	})
-	return c.done()
+	c.log.Infof("Client CloseSend")
+	if c.isClosed() {
+		return nil
+	}
+	c.beginMaybe()
+	// an End without status half-closes the stream, the server keeps
+	// sending until it writes its own End.
+	return c.writeEnd(&nrpc.End{})
 }
 
-func (c *clientStream) close(err error) {
+// close cancels the call on the server with err and releases the stream.
+func (c *clientStream) close(err error) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closeErr = err
+	c.mu.Unlock()
 	c.writeEnd(&nrpc.End{
 		Status: status.Convert(err).Proto(),
 	})
-	c.done()
+	if err := c.done(); err != errStreamClosed {
+		return err
+	}
+	return nil
 }
 
 func (c *clientStream) Context() context.Context {
@@ -201,7 +556,7 @@ func (c *clientStream) onMessage(msg *nats.Msg) error {
 	response := &nrpc.Response{}
 	err := proto.Unmarshal(msg.Data, response)
 	if err != nil {
-		c.log.WithField("data", string(msg.Data)).Error("unknown message")
+		c.log.WithFields(Fields{"data": string(msg.Data)}).Errorf("unknown message")
 		return err
 	}
 
@@ -215,66 +570,154 @@ func (c *clientStream) onMessage(msg *nats.Msg) error {
 	case *nrpc.Response_End:
 		//c.log.WithField("end", r.End).Info("recv end")
 		return c.processEnd(r.End)
+	case *nrpc.Response_Ping:
+		c.pinged = true
+		if !r.Ping.Pong {
+			c.writePing(true)
+		}
 	}
 	return nil
 }
 
 func (c *clientStream) ReadMsg() error {
+	// armed once the server pings, see WithKeepaliveTimeout
+	timeout := c.client.keepaliveTimeout
+	var idle *time.Timer
+	var expired <-chan time.Time
+	defer func() {
+		if idle != nil {
+			idle.Stop()
+		}
+	}()
 	for {
 		select {
 		case <-c.ctx.Done():
+			// cancelled by the caller, tell the server to stop as well
+			c.close(status.FromContextError(c.ctx.Err()).Err())
 			return c.ctx.Err()
-		case msg, ok := <-c.msgCh:
-			if ok {
-				err := c.onMessage(msg)
-				if err != nil {
-					c.lastErr = err
-					return err
+		case <-c.client.ctx.Done():
+			c.close(ErrClientClosed)
+			return ErrClientClosed
+		case <-expired:
+			err := status.Errorf(codes.Unavailable, "nrpc: no keepalive from the server for %v", timeout)
+			c.log.Warnf("%v", err)
+			c.fail(err)
+			return err
+		case msg := <-c.msgCh:
+			if noResponders(msg) {
+				if c.answered {
+					// every frame is a request, once a server answered the
+					// call a 503 only means that it stopped listening for
+					// frames, see GracefulStop, it may still be responding
+					c.log.Debugf("frame not delivered, no server listening on %v", c.subject)
+					continue
+				}
+				err := status.Errorf(codes.Unavailable, "nrpc: no server listening on %v", c.subject)
+				c.noResponders = true
+				c.fail(err)
+				return err
+			}
+			c.answered = true
+			err := c.onMessage(msg)
+			if err != nil {
+				return err
+			}
+			if c.recvWrite == nil {
+				// End received, the stream is finished
+				return nil
+			}
+			if timeout > 0 && c.pinged {
+				if idle == nil {
+					idle = time.NewTimer(timeout)
+					expired = idle.C
+				} else {
+					if !idle.Stop() {
+						<-idle.C
+					}
+					idle.Reset(timeout)
 				}
-				break
 			}
-			return io.EOF
 		}
 	}
 }
 
+func (c *clientStream) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// closedWith returns the error the client closed the stream with, nil
+// when the stream is open or ended otherwise.
+func (c *clientStream) closedWith() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeErr
+}
+
+var errStreamClosed = errors.New("Client Streaming already closed")
+
 func (c *clientStream) done() error {
-	if !c.closed {
-		c.closed = true
-		c.cancel()
-		err := c.sub.Unsubscribe()
-		close(c.msgCh)
-		c.client.remove(c.subject)
-		return err
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errStreamClosed
 	}
-	return errors.New("Client Streaming already closed")
+	c.closed = true
+	c.mu.Unlock()
+	c.cancel()
+	err := c.sub.Unsubscribe()
+	c.client.remove(c.reply)
+	return err
 }
 
-func (c *clientStream) SendMsg(m interface{}) error {
-	if c.closed {
-		return fmt.Errorf("client streaming closed=true")
+func (c *clientStream) beginMaybe() error {
+	if c.hasBegun {
+		return nil
+	}
+	c.hasBegun = true
+	call := &nrpc.Call{
+		Method: c.subject,
+		Nid:    c.client.nid,
+		Unary:  c.unary,
+	}
+	md := metadata.MD{}
+	if c.md != nil {
+		md = c.md.Copy()
+	}
+	md.Set(CallIDKey, c.id)
+	if len(c.contentType) > 0 {
+		md.Set(contentTypeKey, c.contentType)
+	}
+	if c.acks && !c.unary {
+		md.Set(StreamAcksKey, "true")
 	}
+	if deadline, ok := c.ctx.Deadline(); ok {
+		// the deadline travels as the remaining time, clocks may differ
+		md.Set(timeoutKey, encodeTimeout(time.Until(deadline)))
+	}
+	call.Metadata = utils.MakeMetadata(md)
+	//write call with metatdata
+	return c.writeCall(call)
+}
 
-	if !c.hasBegun {
-		c.hasBegun = true
-		call := &nrpc.Call{
-			Method: c.subject,
-			Nid:    c.client.nid,
-		}
-		if c.md != nil {
-			call.Metadata = utils.MakeMetadata(*c.md)
+func (c *clientStream) SendMsg(m interface{}) error {
+	if c.isClosed() {
+		if err := c.closedWith(); err != nil {
+			return err
 		}
-		//write call with metatdata
-		c.writeCall(call)
+		return fmt.Errorf("client streaming closed=true")
 	}
 
+	c.beginMaybe()
+
 	var data *nrpc.Data
 	if frame, ok := m.(*Frame); ok {
 		data = &nrpc.Data{
 			Data: frame.Payload,
 		}
 	} else {
-		payload, err := proto.Marshal(m.(proto.Message))
+		payload, err := c.codec.Marshal(m)
 		if err != nil {
 			c.log.Errorf("clientStream.SendMsg failed: %v", err)
 			return err
@@ -287,62 +730,72 @@ func (c *clientStream) SendMsg(m interface{}) error {
 	return c.writeData(data)
 }
 
+// Flush blocks until the NATS server has processed the messages sent so
+// far on the connection, which bounds how far a sender can get ahead.
+func (c *clientStream) Flush() error {
+	return c.client.nc.Flush()
+}
+
 func (c *clientStream) RecvMsg(m interface{}) error {
+	var bytes []byte
+	var ok bool
+	// prefer buffered data, the stream context is cancelled as soon as the
+	// server End has been processed.
 	select {
-	case <-c.ctx.Done():
-		if c.lastErr != nil {
-			return c.lastErr
-		}
-		return c.ctx.Err()
-	case bytes, ok := <-c.recvRead:
-		if ok && bytes != nil {
-			if frame, ok := m.(*Frame); ok {
-				frame.Payload = bytes
-				return nil
-			} else {
-				return proto.Unmarshal(bytes, m.(proto.Message))
+	case bytes, ok = <-c.recvRead:
+	default:
+		select {
+		case <-c.ctx.Done():
+			select {
+			case bytes, ok = <-c.recvRead:
+			default:
+				if err := c.closedWith(); err != nil {
+					return err
+				}
+				return status.FromContextError(c.ctx.Err()).Err()
 			}
+		case bytes, ok = <-c.recvRead:
 		}
-		return io.EOF
 	}
+	if !ok {
+		return c.lastErr
+	}
+	if frame, ok := m.(*Frame); ok {
+		frame.Payload = bytes
+		return nil
+	}
+	return c.codec.Unmarshal(bytes, m)
 }
 
 func (c *clientStream) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
-	payload, err := proto.Marshal(args.(proto.Message))
+	c.unary = true
+	err := c.SendMsg(args)
 	if err != nil {
-		c.log.Fatalf("%v for request", err)
+		c.close(err)
 		return err
 	}
 
-	//write call with metatdata
-	call := &nrpc.Call{
-		Method: method,
-	}
-	if c.md != nil {
-		call.Metadata = utils.MakeMetadata(*c.md)
-	}
-
-	c.writeCall(call)
-
-	//write grpc args
-	c.writeData(&nrpc.Data{
-		Data: payload,
-	})
-
 	err = c.RecvMsg(reply)
-
 	if err != nil {
 		c.log.Errorf("%v for c.RecvMsg", err)
+		return err
 	}
 
-	c.CloseSend()
-
+	// wait for the End carrying status and trailer, anything else is
+	// unexpected for a unary call and cancels it.
+	err = c.RecvMsg(&Frame{})
+	if err == io.EOF {
+		return nil
+	}
+	if err == nil {
+		c.close(status.Error(codes.Canceled, "unary call returned"))
+	}
 	return err
 }
 
 func (c *clientStream) writeRequest(request *nrpc.Request) error {
 	//c.log.WithField("request", request).Info("send")
-	data, err := proto.Marshal(request)
+	data, err := c.client.marshal.Marshal(request)
 	if err != nil {
 		return err
 	}
@@ -358,10 +811,12 @@ func (c *clientStream) writeCall(call *nrpc.Call) error {
 }
 
 func (c *clientStream) writeData(data *nrpc.Data) error {
-	return c.writeRequest(&nrpc.Request{
-		Type: &nrpc.Request_Data{
-			Data: data,
-		},
+	return writeChunks(data, chunkSize(c.client.nc, c.client.chunkSize), func(data *nrpc.Data) error {
+		return c.writeRequest(&nrpc.Request{
+			Type: &nrpc.Request_Data{
+				Data: data,
+			},
+		})
 	})
 }
 
@@ -379,6 +834,9 @@ func (c *clientStream) processBegin(begin *nrpc.Begin) error {
 		if c.header == nil {
 			c.header = &metadata.MD{}
 		}
+		if *c.header == nil {
+			*c.header = metadata.MD{}
+		}
 		for hdr, data := range begin.Header.Md {
 			c.header.Append(hdr, data.Values...)
 		}
@@ -389,31 +847,54 @@ func (c *clientStream) processBegin(begin *nrpc.Begin) error {
 
 func (c *clientStream) processData(data *nrpc.Data) {
 	if c.recvWrite == nil {
-		c.log.Error("data received after client closeSend")
+		c.log.Errorf("data received after server End")
+		return
+	}
+	data, ok := c.chunks.add(data)
+	if !ok {
 		return
 	}
-	c.recvWrite <- data.Data
+	if data.Seq > 0 && data.Seq != c.acked+1 {
+		// a duplicate, or past a lost response the server will resend:
+		// acknowledge again in case the acknowledgment was lost
+		c.writeAck(c.acked)
+		return
+	}
+	if data.Seq > 0 {
+		// on receipt, a caller slow to read must not make the server
+		// resend what is already here
+		c.acked = data.Seq
+		c.writeAck(data.Seq)
+	}
+	select {
+	case c.recvWrite <- data.Data:
+	case <-c.ctx.Done():
+	}
 }
 
 func (c *clientStream) processEnd(end *nrpc.End) error {
 
-	if end.Trailer != nil && c.trailer != nil {
+	if end.Trailer != nil {
 		if c.trailer == nil {
 			c.trailer = &metadata.MD{}
 		}
+		if *c.trailer == nil {
+			*c.trailer = metadata.MD{}
+		}
 		for hdr, data := range end.Trailer.Md {
 			c.trailer.Append(hdr, data.Values...)
 		}
 	}
 
-	if end.Status != nil {
-		c.log.WithField("status", end.Status).Info("cancel")
-		c.done()
-		return status.Error(codes.Code(end.Status.Code), end.Status.GetMessage())
+	c.lastErr = io.EOF
+	if end.Status != nil && codes.Code(end.Status.Code) != codes.OK {
+		c.log.WithFields(Fields{"status": end.Status}).Infof("cancel")
+		c.lastErr = status.ErrorProto(end.Status)
+	} else {
+		c.log.Infof("Server CloseSend")
 	}
-	c.log.Info("Server CloseSend")
-	c.recvWrite <- nil
 	close(c.recvWrite)
 	c.recvWrite = nil
+	c.done()
 	return nil
 }
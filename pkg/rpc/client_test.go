@@ -0,0 +1,288 @@
+package rpc_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const serverStreamMethod = "/nrpctest.echo.Echo/ServerStream"
+
+func newEchoResponse() interface{} { return &echo.EchoResponse{} }
+
+func TestClientServerStream(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ch, errCh := cli.ServerStream(ctx, serverStreamMethod, &echo.EchoRequest{Message: "hello", ResponseCount: 3}, newEchoResponse)
+	var n int32
+	for m := range ch {
+		reply := m.(*echo.EchoResponse)
+		if reply.Message != "hello" || reply.Index != n {
+			t.Fatalf("got %v, want hello #%d", reply, n)
+		}
+		n++
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if n != 3 {
+		t.Fatalf("got %d responses, want 3", n)
+	}
+}
+
+func TestClientServerStreamError(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &echo.EchoRequest{ErrorCode: int32(codes.NotFound), ErrorMessage: "gone"}
+	ch, errCh := cli.ServerStream(ctx, serverStreamMethod, req, newEchoResponse)
+	for m := range ch {
+		t.Fatalf("unexpected response %v", m)
+	}
+	if got := status.Code(<-errCh); got != codes.NotFound {
+		t.Fatalf("got %v, want %v", got, codes.NotFound)
+	}
+}
+
+func TestClientServerStreamCancel(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sctx, scancel := context.WithCancel(ctx)
+	ch, errCh := cli.ServerStream(sctx, serverStreamMethod, &echo.EchoRequest{ResponseCount: 100}, newEchoResponse)
+	<-ch
+	scancel()
+	for range ch {
+	}
+	if got := status.Code(<-errCh); got != codes.Canceled {
+		t.Fatalf("got %v, want %v", got, codes.Canceled)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv")
+	ctx := context.Background()
+
+	_, err := cli.Unary(ctx, &echo.EchoRequest{DelayMs: 500}, rpc.WithCallTimeout(50*time.Millisecond))
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}, rpc.WithCallTimeout(time.Second)); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+func TestCallTimeoutNoLeak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("10k calls")
+	}
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv")
+	ctx := context.Background()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10000; i++ {
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{}, rpc.WithCallTimeout(time.Minute)); err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+	}
+	// let the goroutines of the last calls exit
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+5 {
+		t.Fatalf("%d goroutines after 10k calls, %d before", n, before)
+	}
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithMethodTimeouts(map[string]time.Duration{
+		"/nrpctest.echo.Echo/Unary": 50 * time.Millisecond,
+	}))
+	defer cli.Close()
+	ec := echo.NewEchoClient(cli)
+	req := &echo.EchoRequest{DelayMs: 300}
+
+	if _, err := ec.Unary(context.Background(), req); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+	// methods without a default are not bounded
+	stream, err := ec.ServerStream(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	// an explicit deadline overrides the default
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := ec.Unary(ctx, req); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	entered := make(chan struct{}, 1)
+	s.SetUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		entered <- struct{}{}
+		return handler(ctx, req)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	before := runtime.NumGoroutine()
+
+	cli := rpc.NewClient(nc, "srv", "cli")
+	ec := echo.NewEchoClient(cli)
+	stream, err := ec.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ec.Unary(ctx, &echo.EchoRequest{DelayMs: 200})
+		errc <- err
+	}()
+	<-entered
+
+	if err := cli.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// the unary call in flight and the open stream are cancelled
+	select {
+	case err := <-errc:
+		if err != rpc.ErrClientClosed {
+			t.Fatalf("Unary in flight: got %v, want %v", err, rpc.ErrClientClosed)
+		}
+	default:
+		t.Fatal("Close returned before the unary call in flight")
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Fatalf("got %v, want %v", err, codes.Canceled)
+	}
+	if _, err := ec.Unary(ctx, &echo.EchoRequest{}); err != rpc.ErrClientClosed {
+		t.Fatalf("got %v, want %v", err, rpc.ErrClientClosed)
+	}
+	if _, err := ec.BidiStream(ctx); err != rpc.ErrClientClosed {
+		t.Fatalf("got %v, want %v", err, rpc.ErrClientClosed)
+	}
+	// the handler of the cancelled stream exits as well
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines after Close, %d before the client", n, before)
+	}
+}
+
+func TestClientCloseBlockedUnary(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	entered := make(chan struct{}, 1)
+	s.SetUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		entered <- struct{}{}
+		return handler(ctx, req)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cli := rpc.NewClient(nc, "srv", "cli")
+	ec := echo.NewEchoClient(cli)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ec.Unary(ctx, &echo.EchoRequest{DelayMs: 3000})
+		errc <- err
+	}()
+	<-entered
+
+	start := time.Now()
+	if err := cli.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Close took %v, waiting for the handler", d)
+	}
+	select {
+	case err := <-errc:
+		if err != rpc.ErrClientClosed {
+			t.Fatalf("got %v, want %v", err, rpc.ErrClientClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Unary still blocked after Close")
+	}
+}
+
+func TestClientCloseBlockedStream(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cli := rpc.NewClient(nc, "srv", "cli")
+	ec := echo.NewEchoClient(cli)
+	server, err := ec.ServerStream(ctx, &echo.EchoRequest{DelayMs: 10000})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	bidi, err := ec.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	recv := make(chan error, 1)
+	go func() {
+		_, err := server.Recv()
+		recv <- err
+	}()
+
+	if err := cli.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// the Recv in progress returns without waiting for the server
+	select {
+	case err := <-recv:
+		if err != rpc.ErrClientClosed {
+			t.Fatalf("got %v, want %v", err, rpc.ErrClientClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Recv still blocked after Close")
+	}
+	if err := bidi.Send(&echo.EchoRequest{}); err != rpc.ErrClientClosed {
+		t.Fatalf("got %v, want %v", err, rpc.ErrClientClosed)
+	}
+	if _, err := bidi.Recv(); err != rpc.ErrClientClosed {
+		t.Fatalf("got %v, want %v", err, rpc.ErrClientClosed)
+	}
+}
@@ -4,7 +4,13 @@ import (
 	"fmt"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 // Codec returns a proxying grpc.Codec with the default protobuf codec as parent.
@@ -54,17 +60,119 @@ func (c *RawCodec) String() string {
 	return fmt.Sprintf("proxy>%s", c.parentCodec.String())
 }
 
+// Name makes RawCodec an encoding.Codec as well.
+func (c *RawCodec) Name() string {
+	return c.String()
+}
+
 // protoCodec is a Codec implementation with protobuf. It is the default rawCodec for gRPC.
-type protoCodec struct{}
+type protoCodec struct {
+	opts proto.MarshalOptions
+}
 
-func (protoCodec) Marshal(v interface{}) ([]byte, error) {
-	return proto.Marshal(v.(proto.Message))
+func (c protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, notMessage(v)
+	}
+	return c.opts.Marshal(m)
 }
 
 func (protoCodec) Unmarshal(data []byte, v interface{}) error {
-	return proto.Unmarshal(data, v.(proto.Message))
+	m, ok := v.(proto.Message)
+	if !ok {
+		return notMessage(v)
+	}
+	return proto.Unmarshal(data, m)
 }
 
 func (protoCodec) String() string {
 	return "proto"
 }
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+// JSONCodec returns a codec encoding messages as protobuf JSON, for services
+// whose callers do not speak protobuf.
+func JSONCodec() encoding.Codec {
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, notMessage(v)
+	}
+	r := &registryResolver{}
+	data, err := protojson.MarshalOptions{Resolver: r}.Marshal(m)
+	return data, r.wrap(err)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return notMessage(v)
+	}
+	r := &registryResolver{}
+	return r.wrap(protojson.UnmarshalOptions{Resolver: r}.Unmarshal(data, m))
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// notMessage is the error of the codecs for values that are not messages.
+func notMessage(v interface{}) error {
+	logger.Errorf("codec: %T is not a proto.Message", v)
+	return status.Errorf(codes.Internal, "nrpc: %T is not a proto.Message", v)
+}
+
+// registryResolver resolves types from the global registry and remembers
+// the first type it could not find, so the codec error can name it.
+type registryResolver struct {
+	missing string
+}
+
+func (r *registryResolver) notFound(name string, err error) {
+	if err == protoregistry.NotFound && len(r.missing) == 0 {
+		r.missing = name
+	}
+}
+
+func (r *registryResolver) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(name)
+	r.notFound(string(name), err)
+	return mt, err
+}
+
+func (r *registryResolver) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByURL(url)
+	r.notFound(url, err)
+	return mt, err
+}
+
+func (r *registryResolver) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	xt, err := protoregistry.GlobalTypes.FindExtensionByName(field)
+	r.notFound(string(field), err)
+	return xt, err
+}
+
+func (r *registryResolver) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	xt, err := protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+	r.notFound(fmt.Sprintf("%v.%v", message, field), err)
+	return xt, err
+}
+
+// wrap turns err into codes.Internal naming the type missing from the
+// registry, if a lookup failed.
+func (r *registryResolver) wrap(err error) error {
+	if err == nil || len(r.missing) == 0 {
+		return err
+	}
+	logger.Errorf("codec: type %q not found in the proto registry", r.missing)
+	return status.Errorf(codes.Internal, "nrpc: type %q not found in the proto registry: %v", r.missing, err)
+}
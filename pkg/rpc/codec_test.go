@@ -0,0 +1,129 @@
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestServiceCodec(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv")
+	defer s.Stop()
+	s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}, rpc.WithServiceCodec(rpc.JSONCodec()))
+
+	// capture the request payload as it travels over NATS
+	sniffed := make(chan []byte, 8)
+	sub, err := nc.Subscribe("nrpc.srv.nrpctest.echo.Echo.>", func(msg *nats.Msg) {
+		req := &nrpc.Request{}
+		if proto.Unmarshal(msg.Data, req) == nil && req.GetData() != nil {
+			sniffed <- req.GetData().Data
+		}
+	})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli := echo.NewEchoClient(rpc.NewClient(nc, "srv", "cli", rpc.WithClientCodec("nrpctest.echo.Echo", rpc.JSONCodec())))
+	resp, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hi"})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if resp.Message != "hi" {
+		t.Fatalf("got %q, want %q", resp.Message, "hi")
+	}
+	payload := <-sniffed
+	var v map[string]interface{}
+	if err := json.Unmarshal(payload, &v); err != nil || v["message"] != "hi" {
+		t.Fatalf("request payload %q is not the JSON encoded request", payload)
+	}
+}
+
+func TestServiceCodecMismatch(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv")
+	defer s.Stop()
+	s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}, rpc.WithServiceCodec(rpc.JSONCodec()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// a protobuf client cannot talk to the JSON service
+	cli := echo.NewEchoClient(rpc.NewClient(nc, "srv", "cli"))
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hi"}); err == nil {
+		t.Fatalf("protobuf request to a JSON service succeeded")
+	}
+}
+
+const missingTypeURL = "type.googleapis.com/missing.Type"
+
+func TestJSONCodecMissingType(t *testing.T) {
+	codec := rpc.JSONCodec()
+	err := codec.Unmarshal([]byte(`{"@type":"`+missingTypeURL+`"}`), &anypb.Any{})
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), missingTypeURL) {
+		t.Fatalf("Unmarshal: got %v, want codes.Internal naming %v", err, missingTypeURL)
+	}
+	_, err = codec.Marshal(&anypb.Any{TypeUrl: missingTypeURL})
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), missingTypeURL) {
+		t.Fatalf("Marshal: got %v, want codes.Internal naming %v", err, missingTypeURL)
+	}
+}
+
+// rawCodec sends pre-encoded payloads as they are.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error)      { return v.([]byte), nil }
+func (rawCodec) Unmarshal(data []byte, v interface{}) error { return nil }
+func (rawCodec) Name() string                               { return "raw" }
+
+func TestCodecMissingType(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv")
+	defer s.Stop()
+	s.RegisterServiceWithOptions(&grpc.ServiceDesc{
+		ServiceName: "test.Any",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Echo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &anypb.Any{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return in, nil
+			},
+		}},
+	}, struct{}{}, rpc.WithServiceCodec(rpc.JSONCodec()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+
+	// the server cannot resolve the type of the request
+	req := []byte(`{"@type":"` + missingTypeURL + `"}`)
+	err := cli.Invoke(ctx, "/test.Any/Echo", req, &anypb.Any{}, grpc.ForceCodec(rawCodec{}))
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), missingTypeURL) {
+		t.Fatalf("server: got %v, want codes.Internal naming %v", err, missingTypeURL)
+	}
+	// the client cannot encode a value that is not a message
+	err = cli.Invoke(ctx, "/test.Any/Echo", "hello", &anypb.Any{})
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "string") {
+		t.Fatalf("client: got %v, want codes.Internal naming string", err)
+	}
+}
@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// contentTypeKey is the metadata key naming the codec of a call, as
+// contentTypePrefix followed by "+" and the name of the codec, like
+// "application/grpc+json". Without a codec name it stands for the codec of
+// the service.
+const (
+	contentTypeKey    = "content-type"
+	contentTypePrefix = "application/grpc"
+)
+
+// WithContentCodecs registers codecs the clients may pick for their calls
+// with grpc.CallContentSubtype, by the Name of the codec, on top of the
+// codec each service was registered with. The messages of such a call,
+// requests and responses, go through the codec it picked. Codecs are
+// looked up in this registry, then among those registered with
+// encoding.RegisterCodec. Calls naming a codec the server does not know
+// are refused with codes.InvalidArgument. Bare NATS requests always use
+// the codec of their service.
+func WithContentCodecs(codecs ...encoding.Codec) ServerOption {
+	return func(s *Server) {
+		if s.contentCodecs == nil {
+			s.contentCodecs = make(map[string]encoding.Codec)
+		}
+		for _, c := range codecs {
+			s.contentCodecs[strings.ToLower(c.Name())] = c
+		}
+	}
+}
+
+// WithClientContentCodecs registers the codecs the calls of the client
+// may pick with grpc.CallContentSubtype, see WithContentCodecs. The call
+// fails with codes.Internal when the client knows no codec of that name.
+func WithClientContentCodecs(codecs ...encoding.Codec) ClientOption {
+	return func(p *Client) {
+		if p.contentCodecs == nil {
+			p.contentCodecs = make(map[string]encoding.Codec)
+		}
+		for _, c := range codecs {
+			p.contentCodecs[strings.ToLower(c.Name())] = c
+		}
+	}
+}
+
+// contentSubtype returns the codec name of a content type, empty when it
+// names none.
+func contentSubtype(contentType string) (string, bool) {
+	if !strings.HasPrefix(contentType, contentTypePrefix) {
+		return "", false
+	}
+	rest := contentType[len(contentTypePrefix):]
+	switch {
+	case len(rest) == 0 || rest[0] == ';':
+		return "", true
+	case rest[0] == '+':
+		return strings.ToLower(strings.SplitN(rest[1:], ";", 2)[0]), true
+	}
+	return "", false
+}
+
+// lookupCodec returns the codec called name from codecs, the proto codec
+// with opts, or the grpc registry.
+func lookupCodec(codecs map[string]encoding.Codec, name string, proto protoCodec) encoding.Codec {
+	if c, ok := codecs[name]; ok {
+		return c
+	}
+	if name == proto.Name() {
+		return proto
+	}
+	return encoding.GetCodec(name)
+}
+
+// contentCodec returns the codec a call with contentType picked, service
+// being the codec of its service.
+func (s *Server) contentCodec(service encoding.Codec, contentType string) (encoding.Codec, error) {
+	name, ok := contentSubtype(contentType)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "nrpc: invalid content-type %q", contentType)
+	}
+	if len(name) == 0 || name == strings.ToLower(service.Name()) {
+		return service, nil
+	}
+	if c := lookupCodec(s.contentCodecs, name, protoCodec{opts: s.marshal}); c != nil {
+		return c, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "nrpc: no codec registered for content-subtype %q", name)
+}
+
+// contentCodec returns the codec called name for the calls of the client.
+func (c *Client) contentCodec(name string) (encoding.Codec, error) {
+	if codec := lookupCodec(c.contentCodecs, name, protoCodec{opts: c.marshal}); codec != nil {
+		return codec, nil
+	}
+	return nil, status.Errorf(codes.Internal, "nrpc: no codec registered for content-subtype %q", name)
+}
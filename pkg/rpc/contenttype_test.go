@@ -0,0 +1,71 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestContentCodecs(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	rec := &rpc.MemoryRecorder{}
+	echo.StartEchoServer(t, nc, "srv", rpc.WithRecorder(rec), rpc.WithContentCodecs(rpc.JSONCodec()))
+	echo.StartEchoServer(t, nc, "proto-only")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithClientContentCodecs(rpc.JSONCodec()))
+	defer cli.Close()
+	for _, subtype := range []string{"json", "proto"} {
+		reply, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{Message: subtype}, grpc.CallContentSubtype(subtype))
+		if err != nil || reply.Message != subtype {
+			t.Fatalf("%s: got %v, %v, want %s", subtype, reply, err, subtype)
+		}
+	}
+	// the request and the response of the first call are JSON
+	var payloads []string
+	for _, r := range rec.Records() {
+		var data *nrpc.Data
+		if r.Inbound {
+			var req nrpc.Request
+			proto.Unmarshal(r.Data, &req)
+			data = req.GetData()
+		} else {
+			var resp nrpc.Response
+			proto.Unmarshal(r.Data, &resp)
+			data = resp.GetData()
+		}
+		if data != nil {
+			payloads = append(payloads, string(data.Data))
+		}
+	}
+	if len(payloads) != 4 {
+		t.Fatalf("got %d payloads, want 4", len(payloads))
+	}
+	for i, p := range payloads {
+		if isJSON := strings.HasPrefix(p, "{"); isJSON != (i < 2) {
+			t.Fatalf("got payloads %q, want the first two in JSON", payloads)
+		}
+	}
+
+	other := rpc.NewClient(nc, "proto-only", "cli", rpc.WithClientContentCodecs(rpc.JSONCodec()))
+	defer other.Close()
+	_, err := echo.NewEchoClient(other).Unary(ctx, &echo.EchoRequest{}, grpc.CallContentSubtype("json"))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unknown to the server: got %v, want %v", err, codes.InvalidArgument)
+	}
+	_, err = echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{}, grpc.CallContentSubtype("xml"))
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("unknown to the client: got %v, want %v", err, codes.Internal)
+	}
+}
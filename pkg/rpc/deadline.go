@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// timeoutKey is the metadata key carrying the remaining time of a call to
+// the server, encoded as gRPC does.
+const timeoutKey = "grpc-timeout"
+
+// ShortenDeadline returns a copy of ctx whose deadline is margin earlier
+// than the deadline of ctx, or ctx's own deadline if it has none.
+//
+// A handler calling other services shortens the deadline it received for
+// each downstream call, so that with a chain of hops every caller has at
+// least margin left to handle the failure of the call it made, instead of
+// timing out together with it: with a margin of 100ms a call arriving with
+// 1s left gives the next hop 900ms, which gives its own next hop 800ms. A
+// call left with no more than margin fails right away with
+// codes.DeadlineExceeded. WithHopMargin applies it to every call of a
+// Client.
+func ShortenDeadline(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok && margin > 0 {
+		return context.WithDeadline(ctx, deadline.Add(-margin))
+	}
+	return context.WithCancel(ctx)
+}
+
+// encodeTimeout formats t as the value of the grpc-timeout header: at most
+// eight digits followed by the unit.
+func encodeTimeout(t time.Duration) string {
+	const maxTimeoutValue int64 = 100000000 - 1
+	if t <= 0 {
+		return "0n"
+	}
+	for _, u := range []struct {
+		d    time.Duration
+		unit string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+	} {
+		// round up, the server must not time out before the client
+		if v := int64((t + u.d - 1) / u.d); v <= maxTimeoutValue {
+			return strconv.FormatInt(v, 10) + u.unit
+		}
+	}
+	return strconv.FormatInt(int64((t+time.Hour-1)/time.Hour), 10) + "H"
+}
+
+// decodeTimeout parses the value of the grpc-timeout header.
+func decodeTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("nrpc: malformed timeout %q", s)
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'n':
+		unit = time.Nanosecond
+	case 'u':
+		unit = time.Microsecond
+	case 'm':
+		unit = time.Millisecond
+	case 'S':
+		unit = time.Second
+	case 'M':
+		unit = time.Minute
+	case 'H':
+		unit = time.Hour
+	default:
+		return 0, fmt.Errorf("nrpc: malformed timeout %q", s)
+	}
+	v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("nrpc: malformed timeout %q", s)
+	}
+	if max := int64(1<<63-1) / int64(unit); v > max {
+		return time.Duration(1<<63 - 1), nil
+	}
+	return time.Duration(v) * unit, nil
+}
+
+// handlerDeadline returns the deadline of the handler of a call, the
+// earliest of the server bound and of the deadline of the client, see
+// WithDefaultTimeout.
+func (s *serverStream) handlerDeadline(timeout time.Duration) (time.Time, bool) {
+	now := time.Now()
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = now.Add(timeout)
+	}
+	if vs := s.md.Get(timeoutKey); len(vs) > 0 {
+		d, err := decodeTimeout(vs[0])
+		if err != nil {
+			s.log.Warnf("ignoring the deadline of the client: %v", err)
+		} else if client := now.Add(d); deadline.IsZero() || client.Before(deadline) {
+			deadline = client
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// watchDeadline ends the stream when ctx, the context of its handler,
+// reaches its deadline before the handler ends. cancel releases ctx.
+func (s *serverStream) watchDeadline(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+	<-ctx.Done()
+	if ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	s.log.Warnf("deadline exceeded")
+	s.abort(status.New(codes.DeadlineExceeded, "nrpc: deadline exceeded"), nil)
+}
@@ -0,0 +1,229 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestShortenDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	parent, _ := ctx.Deadline()
+
+	short, cancel := rpc.ShortenDeadline(ctx, 200*time.Millisecond)
+	defer cancel()
+	if got, _ := short.Deadline(); !got.Equal(parent.Add(-200 * time.Millisecond)) {
+		t.Fatalf("got deadline %v, want %v", got, parent.Add(-200*time.Millisecond))
+	}
+
+	spent, cancel := rpc.ShortenDeadline(ctx, 2*time.Second)
+	defer cancel()
+	if spent.Err() != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", spent.Err(), context.DeadlineExceeded)
+	}
+
+	none, cancel := rpc.ShortenDeadline(context.Background(), time.Second)
+	defer cancel()
+	if _, ok := none.Deadline(); ok {
+		t.Fatalf("got a deadline for a context without one")
+	}
+}
+
+// timeoutServer replies with the grpc-timeout it received.
+type timeoutServer struct {
+	echo.Server
+}
+
+func (*timeoutServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return &echo.EchoResponse{Message: strings.Join(md.Get("grpc-timeout"), ",")}, nil
+}
+
+// parseTimeout decodes a grpc-timeout value.
+func parseTimeout(t *testing.T, v string) time.Duration {
+	units := map[byte]string{'n': "ns", 'u': "us", 'm': "ms", 'S': "s", 'M': "m", 'H': "h"}
+	if len(v) < 2 || units[v[len(v)-1]] == "" {
+		t.Fatalf("invalid grpc-timeout %q", v)
+	}
+	d, err := time.ParseDuration(v[:len(v)-1] + units[v[len(v)-1]])
+	if err != nil {
+		t.Fatalf("invalid grpc-timeout %q: %v", v, err)
+	}
+	return d
+}
+
+func TestHopMargin(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartServer(t, nc, "srv", &timeoutServer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		margin   time.Duration
+		min, max time.Duration
+	}{
+		{0, 1500 * time.Millisecond, 2 * time.Second},
+		{500 * time.Millisecond, time.Second, 1500 * time.Millisecond},
+	} {
+		cli := rpc.NewClient(nc, "srv", "cli", rpc.WithHopMargin(tc.margin))
+		defer cli.Close()
+		resp, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{})
+		if err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+		if got := parseTimeout(t, resp.Message); got <= tc.min || got > tc.max {
+			t.Fatalf("margin %v: server got timeout %v, want in (%v, %v]", tc.margin, got, tc.min, tc.max)
+		}
+	}
+
+	// no time left for the next hop
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithHopMargin(5*time.Second))
+	defer cli.Close()
+	_, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+}
+
+// deadlineServer replies with the time left to its handler, ignoring the
+// deadline for Delay beforehand.
+type deadlineServer struct {
+	echo.Server
+	delay time.Duration
+}
+
+func (s *deadlineServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	time.Sleep(s.delay)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return &echo.EchoResponse{Message: "none"}, nil
+	}
+	return &echo.EchoResponse{Message: time.Until(deadline).String()}, nil
+}
+
+func TestHopMarginServerDeadline(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartServer(t, nc, "srv", &deadlineServer{})
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithHopMargin(500*time.Millisecond))
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// the handler runs under the shortened deadline, not only told of it
+	resp, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	left, err := time.ParseDuration(resp.Message)
+	if err != nil {
+		t.Fatalf("got %q, want the time left to the handler", resp.Message)
+	}
+	if left <= time.Second || left > 1500*time.Millisecond {
+		t.Fatalf("handler had %v left, want in (1s, 1.5s]", left)
+	}
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	for _, tc := range []struct {
+		name     string
+		opts     []rpc.ServiceOption
+		timeout  time.Duration // of the client, none when 0
+		min, max time.Duration
+	}{
+		{"default", nil, 0, 500 * time.Millisecond, time.Second},
+		{"client", nil, 200 * time.Millisecond, 0, 200 * time.Millisecond},
+		{"method", []rpc.ServiceOption{rpc.WithMethodTimeout(3*time.Second, "Unary")}, 0, 2 * time.Second, 3 * time.Second},
+		{"method-and-client", []rpc.ServiceOption{rpc.WithMethodTimeout(3*time.Second, "Unary")}, 2 * time.Second, time.Second, 2 * time.Second},
+		{"other-method", []rpc.ServiceOption{rpc.WithMethodTimeout(3*time.Second, "BidiStream")}, 0, 500 * time.Millisecond, time.Second},
+	} {
+		s := rpc.NewServer(nc, tc.name, rpc.WithDefaultTimeout(time.Second))
+		s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &deadlineServer{}, tc.opts...)
+		cli := rpc.NewClient(nc, tc.name, "cli")
+		ctx := context.Background()
+		cancel := context.CancelFunc(func() {})
+		if tc.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+		}
+		resp, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{})
+		cancel()
+		cli.Close()
+		s.Stop()
+		if err != nil {
+			t.Fatalf("%s: Unary: %v", tc.name, err)
+		}
+		left, err := time.ParseDuration(resp.Message)
+		if err != nil {
+			t.Fatalf("%s: got %q, want the time left", tc.name, resp.Message)
+		}
+		if left <= tc.min || left > tc.max {
+			t.Fatalf("%s: handler had %v left, want in (%v, %v]", tc.name, left, tc.min, tc.max)
+		}
+	}
+
+	// a handler ignoring its deadline does not hold the call
+	cli, _ := echo.StartServer(t, nc, "slow", &deadlineServer{delay: 5 * time.Second}, rpc.WithDefaultTimeout(200*time.Millisecond))
+	start := time.Now()
+	_, err := cli.Unary(context.Background(), &echo.EchoRequest{})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("call ended after %v, want about 200ms", elapsed)
+	}
+}
+
+// blockingServer blocks its unary handler until its context ends, and
+// reports why.
+type blockingServer struct {
+	echo.Server
+	ended chan error
+}
+
+func (s *blockingServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	<-ctx.Done()
+	s.ended <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestClientDeadline(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &blockingServer{ended: make(chan error, 1)}
+	cli, _ := echo.StartServer(t, nc, "srv", impl)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// the client cancels the call at its deadline, the server may see
+	// either first
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+	select {
+	case err := <-impl.ended:
+		if err == nil {
+			t.Fatal("handler context ended without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler context never ended")
+	}
+
+	// a client that never cancels relies on the deadline of the server
+	md := &nrpc.Metadata{Md: map[string]*nrpc.Strings{"grpc-timeout": {Values: []string{"200m"}}}}
+	if _, err := rawUnaryMetadata(t, nc, nats.NewInbox(), md, &echo.EchoRequest{}); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+	if err := <-impl.ended; err != context.DeadlineExceeded {
+		t.Fatalf("handler context ended with %v, want %v", err, context.DeadlineExceeded)
+	}
+}
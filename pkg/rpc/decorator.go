@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// CallMeta describes a call to the context decorators.
+type CallMeta struct {
+	FullMethod string      // gRPC method name, /service/method
+	Subject    string      // subject the call arrived on
+	Peer       string      // nid of the client
+	Metadata   metadata.MD // a copy of the incoming metadata
+}
+
+// ContextDecorator returns ctx enriched for the handler of the call
+// described by info, typically with context.WithValue.
+type ContextDecorator func(ctx context.Context, info CallMeta) context.Context
+
+// WithContextDecorator adds d to the decorators of the handler contexts.
+// They run in the order they were added, once the incoming metadata is in
+// the context and before the interceptors. Only the values of the context
+// they return are kept: its deadline and cancellation remain the ones of
+// the call, so that a decorator cannot detach the handler from it.
+func WithContextDecorator(d ContextDecorator) ServerOption {
+	return func(s *Server) {
+		s.decorators = append(s.decorators, d)
+	}
+}
+
+// decoratedContext is the context of a call, with the values of the
+// context returned by the decorators.
+type decoratedContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c decoratedContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// decorate returns ctx, the context of the handler of the stream, passed
+// through ds.
+func (s *serverStream) decorate(ctx context.Context, ds []ContextDecorator) context.Context {
+	info := CallMeta{
+		FullMethod: s.fullMethod,
+		Subject:    s.method,
+		Peer:       s.pnid,
+	}
+	values := ctx
+	for _, d := range ds {
+		info.Metadata = s.md.Copy()
+		values = d(values, info)
+	}
+	return decoratedContext{Context: ctx, values: values}
+}
@@ -0,0 +1,120 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type tenantKey struct{}
+type flagKey struct{}
+
+type decoratedServer struct {
+	echo.Server
+	cancelled chan struct{}
+}
+
+func (d *decoratedServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{Message: fmt.Sprint(ctx.Value(tenantKey{}), " ", ctx.Value(flagKey{}))}, nil
+}
+
+func (d *decoratedServer) BidiStream(stream echo.Echo_BidiStreamServer) error {
+	if err := stream.Send(&echo.EchoResponse{Message: fmt.Sprint(stream.Context().Value(tenantKey{}))}); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	close(d.cancelled)
+	return nil
+}
+
+func TestContextDecorator(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartServer(t, nc, "srv", &decoratedServer{},
+		rpc.WithContextDecorator(func(ctx context.Context, info rpc.CallMeta) context.Context {
+			tenant := info.Metadata.Get("tenant")
+			if len(tenant) == 0 || info.Peer != echo.ClientNid || info.Subject == "" {
+				return ctx
+			}
+			return context.WithValue(ctx, tenantKey{}, tenant[0]+"@"+info.FullMethod)
+		}),
+		rpc.WithContextDecorator(func(ctx context.Context, info rpc.CallMeta) context.Context {
+			// runs after the first one
+			return context.WithValue(ctx, flagKey{}, ctx.Value(tenantKey{}) != nil)
+		}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "tenant", "acme")
+
+	reply, err := cli.Unary(ctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if want := "acme@/nrpctest.echo.Echo/Unary true"; reply.Message != want {
+		t.Fatalf("got %q, want %q", reply.Message, want)
+	}
+}
+
+func TestContextDecoratorDetached(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &decoratedServer{cancelled: make(chan struct{})}
+	cli, _ := echo.StartServer(t, nc, "srv", impl,
+		rpc.WithContextDecorator(func(ctx context.Context, info rpc.CallMeta) context.Context {
+			return context.WithValue(context.Background(), tenantKey{}, "detached")
+		}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the values of the detached context are kept, cancellation still
+	// reaches the handler
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	stream, err := cli.BidiStream(streamCtx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if reply, err := stream.Recv(); err != nil || reply.Message != "detached" {
+		t.Fatalf("got %v, %v, want the decorated value", reply, err)
+	}
+	cancelStream()
+	select {
+	case <-impl.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancellation did not reach the handler")
+	}
+}
+
+func TestContextDecoratorStop(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv",
+		rpc.WithContextDecorator(func(ctx context.Context, info rpc.CallMeta) context.Context {
+			// still setting up the call when the server stops
+			time.Sleep(200 * time.Millisecond)
+			return ctx
+		}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		// with a deadline, which the server swaps in as well
+		_, err := cli.Unary(ctx, &echo.EchoRequest{})
+		errc <- err
+	}()
+	// no synchronization with the decorator, for the race detector to see
+	// Stop end the stream while the call is set up
+	time.Sleep(50 * time.Millisecond)
+	s.Stop()
+	if err := <-errc; status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want %v", err, codes.Unavailable)
+	}
+}
@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stopped is the status of the streams ended by the server stopping.
+var stopped = status.New(codes.Unavailable, "nrpc: server stopped")
+
+// StreamDoneReason returns why the stream served by the handler whose
+// context is ctx ended, nil while it is in progress. Handlers holding
+// resources read it once ctx is done to tell a client that cancelled,
+// whose status it returns, from a stream the server ended, with the
+// status it sent or the one of its timeouts, and from the server
+// stopping, codes.Unavailable. A stream ended with CloseStream has
+// codes.Canceled, as one dropped without End.
+func StreamDoneReason(ctx context.Context) *status.Status {
+	s, ok := ctx.Value(serverStreamKey{}).(*serverStream)
+	if !ok {
+		return nil
+	}
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	if s.reason == nil {
+		if s.server.ctx.Err() != nil {
+			// Stop cancels the streams at once, before they end one by one
+			return stopped
+		}
+		if s.ctx.Err() == context.DeadlineExceeded {
+			// the deadline ends the context before the stream
+			return status.New(codes.DeadlineExceeded, "nrpc: deadline exceeded")
+		}
+	}
+	return s.reason
+}
+
+// setReason records the first status the stream ended with.
+func (s *serverStream) setReason(st *status.Status) {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	if s.reason != nil {
+		return
+	}
+	if st == nil {
+		// status.Convert(nil) of a handler that returned nil, not in progress
+		st = status.New(codes.OK, "")
+	}
+	if st == canceled && s.server.ctx.Err() != nil {
+		st = stopped
+	}
+	s.reason = st
+}
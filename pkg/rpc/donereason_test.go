@@ -0,0 +1,114 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// reasonServer reports why its bidirectional streams ended.
+type reasonServer struct {
+	echo.Server
+	started chan struct{}
+	reasons chan *status.Status
+}
+
+func (s *reasonServer) BidiStream(stream echo.Echo_BidiStreamServer) error {
+	ctx := stream.Context()
+	if st := rpc.StreamDoneReason(ctx); st != nil {
+		s.reasons <- st
+		return nil
+	}
+	s.started <- struct{}{}
+	<-ctx.Done()
+	s.reasons <- rpc.StreamDoneReason(ctx)
+	return nil
+}
+
+func TestStreamDoneReason(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []rpc.ServerOption
+		timeout time.Duration
+		end     func(s *rpc.Server, cancel context.CancelFunc)
+		code    codes.Code
+	}{
+		{
+			name: "client cancel",
+			end:  func(s *rpc.Server, cancel context.CancelFunc) { cancel() },
+			code: codes.Canceled,
+		},
+		{
+			name:    "deadline",
+			timeout: 100 * time.Millisecond,
+			end:     func(*rpc.Server, context.CancelFunc) {},
+			code:    codes.DeadlineExceeded,
+		},
+		{
+			name: "idle timeout",
+			opts: []rpc.ServerOption{rpc.WithStreamIdleTimeout(100 * time.Millisecond)},
+			end:  func(*rpc.Server, context.CancelFunc) {},
+			code: codes.DeadlineExceeded,
+		},
+		{
+			name: "evicted",
+			end: func(s *rpc.Server, cancel context.CancelFunc) {
+				s.EvictPeer(echo.ClientNid, status.New(codes.PermissionDenied, "evicted"))
+			},
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "closed",
+			end:  func(s *rpc.Server, cancel context.CancelFunc) { s.CloseStream(echo.ClientNid) },
+			code: codes.Canceled,
+		},
+		{
+			name: "stop",
+			end:  func(s *rpc.Server, cancel context.CancelFunc) { s.Stop() },
+			code: codes.Unavailable,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nc := nrpctest.RunNats(t)
+			impl := &reasonServer{started: make(chan struct{}, 1), reasons: make(chan *status.Status, 1)}
+			cli, s := echo.StartServer(t, nc, "srv", impl, tc.opts...)
+			timeout := tc.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			stream, err := cli.BidiStream(ctx)
+			if err != nil {
+				t.Fatalf("BidiStream: %v", err)
+			}
+			if err := stream.Send(&echo.EchoRequest{}); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			select {
+			case <-impl.started:
+			case st := <-impl.reasons:
+				t.Fatalf("got reason %v as the handler started, want none", st)
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler not called")
+			}
+			tc.end(s, cancel)
+			select {
+			case st := <-impl.reasons:
+				if st.Code() != tc.code {
+					t.Fatalf("got reason %v, want %v", st, tc.code)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream not ended")
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"container/list"
+	"time"
+)
+
+// maxRecentReplies bounds the reply subjects remembered by
+// WithDuplicateCallWindow.
+const maxRecentReplies = 4096
+
+// WithDuplicateCallWindow refuses with codes.AlreadyExists the calls made on
+// a reply subject whose previous call ended less than d ago, most likely a
+// duplicate of it delivered late or replayed. Only the last 4096 reply
+// subjects are remembered. Calls on reused reply subjects are served as new
+// calls without it, or once d has passed.
+func WithDuplicateCallWindow(d time.Duration) ServerOption {
+	return func(s *Server) {
+		if d <= 0 {
+			s.recent = nil
+			return
+		}
+		s.recent = &recentReplies{
+			window: d,
+			order:  list.New(),
+			index:  make(map[string]*list.Element),
+		}
+	}
+}
+
+// recentReplies is an LRU of the reply subjects of the calls that ended
+// within the window, guarded by Server.mu.
+type recentReplies struct {
+	window time.Duration
+	order  *list.List // of *recentReply, oldest first
+	index  map[string]*list.Element
+}
+
+type recentReply struct {
+	reply string
+	ended time.Time
+}
+
+// add records that the call on reply ended at now.
+func (r *recentReplies) add(reply string, now time.Time) {
+	if e, ok := r.index[reply]; ok {
+		e.Value.(*recentReply).ended = now
+		r.order.MoveToBack(e)
+		return
+	}
+	r.index[reply] = r.order.PushBack(&recentReply{reply, now})
+	if r.order.Len() > maxRecentReplies {
+		r.evict(r.order.Front())
+	}
+}
+
+// endedWithin reports whether a call on reply ended less than the window
+// ago, forgetting the calls that ended before.
+func (r *recentReplies) endedWithin(reply string, now time.Time) bool {
+	for e := r.order.Front(); e != nil; e = r.order.Front() {
+		if now.Sub(e.Value.(*recentReply).ended) < r.window {
+			break
+		}
+		r.evict(e)
+	}
+	_, ok := r.index[reply]
+	return ok
+}
+
+func (r *recentReplies) evict(e *list.Element) {
+	r.order.Remove(e)
+	delete(r.index, e.Value.(*recentReply).reply)
+}
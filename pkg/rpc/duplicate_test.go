@@ -0,0 +1,99 @@
+package rpc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// rawUnary calls Echo.Unary of the server srv without the nrpc client, on
+// the reply subject inbox.
+func rawUnary(t *testing.T, nc *nats.Conn, inbox string, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	t.Helper()
+	return rawUnaryMetadata(t, nc, inbox, nil, req)
+}
+
+// rawUnaryMetadata is rawUnary sending md with the call as it is.
+func rawUnaryMetadata(t *testing.T, nc *nats.Conn, inbox string, md *nrpc.Metadata, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	t.Helper()
+	const subject = "nrpc.srv.nrpctest.echo.Echo.Unary"
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	payload, _ := proto.Marshal(req)
+	for _, r := range []*nrpc.Request{
+		{Type: &nrpc.Request_Call{Call: &nrpc.Call{Method: subject, Nid: "raw", Unary: true, Metadata: md}}},
+		{Type: &nrpc.Request_Data{Data: &nrpc.Data{Data: payload}}},
+		{Type: &nrpc.Request_End{End: &nrpc.End{}}},
+	} {
+		data, _ := proto.Marshal(r)
+		if err := nc.PublishRequest(subject, inbox, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reply *echo.EchoResponse
+	for {
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("NextMsg: %v", err)
+		}
+		resp := &nrpc.Response{}
+		if err := proto.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatal(err)
+		}
+		if data := resp.GetData(); data != nil {
+			reply = &echo.EchoResponse{}
+			if err := proto.Unmarshal(data.Data, reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if end := resp.GetEnd(); end != nil {
+			if end.Status != nil && codes.Code(end.Status.Code) != codes.OK {
+				return nil, status.ErrorProto(end.Status)
+			}
+			return reply, nil
+		}
+	}
+}
+
+func TestDuplicateCallWindow(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv", rpc.WithDuplicateCallWindow(300*time.Millisecond))
+	inbox, other := nats.NewInbox(), nats.NewInbox()
+
+	if _, err := rawUnary(t, nc, inbox, &echo.EchoRequest{Message: "first"}); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	// rapid reuse of the reply subject is refused, other subjects are not
+	if _, err := rawUnary(t, nc, inbox, &echo.EchoRequest{Message: "again"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("got %v, want %v", err, codes.AlreadyExists)
+	}
+	if _, err := rawUnary(t, nc, other, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("call on another reply subject: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if reply, err := rawUnary(t, nc, inbox, &echo.EchoRequest{Message: "later"}); err != nil || reply.Message != "later" {
+		t.Fatalf("got %v, %v after the window, want a fresh call", reply, err)
+	}
+}
+
+func TestDuplicateCallWindowDisabled(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	inbox := nats.NewInbox()
+	for _, m := range []string{"first", "again"} {
+		if reply, err := rawUnary(t, nc, inbox, &echo.EchoRequest{Message: m}); err != nil || reply.Message != m {
+			t.Fatalf("got %v, %v, want %v", reply, err, m)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithHandlerPool runs the handlers on a pool of size goroutines instead of
+// one goroutine per call, so that a flood of calls cannot grow the server
+// without bound. The calls beyond size wait in a queue, in the order they
+// arrived, until a handler returns, their deadlines running meanwhile, and
+// those beyond the queue are refused, see WithHandlerQueue. Only
+// the handlers wait: the frames of the streams in progress are still
+// delivered, so a long-lived stream holding a goroutine of the pool keeps
+// receiving. Size the pool above the number of such streams, or they starve
+// the other calls.
+func WithHandlerPool(size int) ServerOption {
+	return func(s *Server) {
+		if size > 0 {
+			s.poolSize = size
+		}
+	}
+}
+
+// defaultHandlerQueue is the number of calls waiting for the handler pool
+// by default.
+const defaultHandlerQueue = 1024
+
+// WithHandlerQueue bounds the calls waiting for a goroutine of the pool of
+// WithHandlerPool to n, 1024 by default. The queue holds their decoded
+// requests, so a flood of calls on a busy pool would otherwise grow memory
+// without bound. A call arriving on a full queue is refused with
+// codes.ResourceExhausted.
+func WithHandlerQueue(n int) ServerOption {
+	return func(s *Server) {
+		if n > 0 {
+			s.poolQueue = n
+		}
+	}
+}
+
+// handlerPool runs functions on a fixed set of goroutines.
+type handlerPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []func()
+	limit  int // of the queue
+	closed bool
+}
+
+func newHandlerPool(size, limit int) *handlerPool {
+	p := &handlerPool{limit: limit}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// submit queues fn without blocking. It reports false, leaving fn out, when
+// the queue is full.
+func (p *handlerPool) submit(fn func()) bool {
+	p.mu.Lock()
+	if len(p.queue) >= p.limit {
+		p.mu.Unlock()
+		return false
+	}
+	p.queue = append(p.queue, fn)
+	p.mu.Unlock()
+	p.cond.Signal()
+	return true
+}
+
+func (p *handlerPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		fn := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+		fn()
+	}
+}
+
+// close stops the goroutines once the queue is empty.
+func (p *handlerPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// runHandler runs the handler of the stream on the pool, if any.
+func (s *Server) runHandler(stream *serverStream, fn handlerFunc, srv interface{}) {
+	if s.pool == nil {
+		go stream.runHandler(fn, srv)
+		return
+	}
+	queued := s.pool.submit(func() {
+		if stream.ctx.Err() != nil {
+			// ended while queued
+			return
+		}
+		stream.runHandler(fn, srv)
+	})
+	if !queued {
+		stream.log.Warnf("handler queue of %d calls full", s.poolQueue)
+		stream.close(status.Errorf(codes.ResourceExhausted, "nrpc: handler queue of %d calls full", s.poolQueue))
+	}
+}
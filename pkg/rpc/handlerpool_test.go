@@ -0,0 +1,102 @@
+package rpc_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHandlerPool(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithHandlerPool(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the stream holds the only goroutine of the pool
+	bidi, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := bidi.Send(&echo.EchoRequest{Message: "first"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := bidi.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	unary := make(chan error, 1)
+	go func() {
+		_, err := cli.Unary(ctx, &echo.EchoRequest{})
+		unary <- err
+	}()
+	// the frames of the stream still arrive while the call waits
+	if err := bidi.Send(&echo.EchoRequest{Message: "second"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if resp, err := bidi.Recv(); err != nil || resp.Message != "second" {
+		t.Fatalf("got %v, %v, want the second response", resp, err)
+	}
+	select {
+	case err := <-unary:
+		t.Fatalf("got %v, want the call queued while the pool is busy", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := bidi.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	if _, err := bidi.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	if err := <-unary; err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+func TestHandlerQueueFull(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithHandlerPool(1), rpc.WithHandlerQueue(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the stream holds the only goroutine of the pool
+	bidi, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := bidi.Send(&echo.EchoRequest{Message: "first"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := bidi.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	// the first call to arrive fills the queue, the second one is refused
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := cli.Unary(ctx, &echo.EchoRequest{})
+			results <- err
+		}()
+	}
+	if err := <-results; status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want %v", err, codes.ResourceExhausted)
+	}
+
+	if err := bidi.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	if _, err := bidi.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	if err := <-results; err != nil {
+		t.Fatalf("queued Unary: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// hashReplicas is the number of points of each nid on the ring, which
+// spreads the keys evenly across few nids.
+const hashReplicas = 100
+
+// KeyFunc returns the routing key of a call to method made with ctx, see
+// WithConsistentHash. Calls with an empty key go to the nid of the client.
+type KeyFunc func(ctx context.Context, method string) string
+
+// WithConsistentHash routes the calls with a routing key, as returned by
+// key, to one of nids picked by consistent hashing of the key, so that the
+// calls for a key reach the same server as long as it is in nids. SetNodes
+// changes the nids, which moves only the keys of the nids added or
+// removed.
+func WithConsistentHash(key KeyFunc, nids ...string) ClientOption {
+	return func(p *Client) {
+		p.hashKey = key
+		p.ring = newHashRing(nids)
+	}
+}
+
+// SetNodes replaces the nids the client routes calls to with
+// WithConsistentHash, as servers join and leave.
+func (c *Client) SetNodes(nids ...string) {
+	ring := newHashRing(nids)
+	c.mu.Lock()
+	c.ring = ring
+	c.mu.Unlock()
+}
+
+// target returns the nid of the server a call to method is made on.
+func (c *Client) target(ctx context.Context, method string) string {
+	if c.hashKey == nil {
+		return c.svcid
+	}
+	key := c.hashKey(ctx, method)
+	if len(key) == 0 {
+		return c.svcid
+	}
+	c.mu.Lock()
+	ring := c.ring
+	c.mu.Unlock()
+	if nid, ok := ring.get(key); ok {
+		return nid
+	}
+	return c.svcid
+}
+
+// hashRing maps keys to nids, it is never modified once built.
+type hashRing struct {
+	points []uint32
+	nids   map[uint32]string
+}
+
+func newHashRing(nids []string) *hashRing {
+	r := &hashRing{nids: make(map[uint32]string)}
+	for _, nid := range nids {
+		for i := 0; i < hashReplicas; i++ {
+			p := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + nid))
+			if _, ok := r.nids[p]; ok {
+				continue
+			}
+			r.nids[p] = nid
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// get returns the nid of key, the first point of the ring at or after its
+// hash, false when the ring is empty.
+func (r *hashRing) get(key string) (string, bool) {
+	if r == nil || len(r.points) == 0 {
+		return "", false
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nids[r.points[i]], true
+}
@@ -0,0 +1,73 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/metadata"
+)
+
+// nidServer answers with its nid.
+type nidServer struct {
+	echo.Server
+	nid string
+}
+
+func (s *nidServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{Message: s.nid}, nil
+}
+
+func TestConsistentHash(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	for _, nid := range []string{"a", "b", "c"} {
+		echo.StartServer(t, nc, nid, &nidServer{nid: nid})
+	}
+	shardKey := func(ctx context.Context, method string) string {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if keys := md.Get("shard-key"); len(keys) > 0 {
+			return keys[0]
+		}
+		return ""
+	}
+	cli := rpc.NewClient(nc, "a", "cli", rpc.WithConsistentHash(shardKey, "a", "b", "c"))
+	defer cli.Close()
+	ecli := echo.NewEchoClient(cli)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	route := func(key string) string {
+		t.Helper()
+		resp, err := ecli.Unary(metadata.AppendToOutgoingContext(ctx, "shard-key", key), &echo.EchoRequest{})
+		if err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+		return resp.Message
+	}
+	routes := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprint("key-", i)
+		routes[key] = route(key)
+		used[routes[key]] = true
+		if got := route(key); got != routes[key] {
+			t.Fatalf("%v: got %v, then %v, want the same nid", key, routes[key], got)
+		}
+	}
+	if len(used) != 3 {
+		t.Fatalf("got keys on %v, want them spread on a, b and c", used)
+	}
+
+	// only the keys of c move once it leaves
+	cli.SetNodes("a", "b")
+	for key, nid := range routes {
+		got := route(key)
+		if nid != "c" && got != nid || got == "c" {
+			t.Fatalf("%v: got %v, was %v", key, got, nid)
+		}
+	}
+}
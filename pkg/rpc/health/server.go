@@ -0,0 +1,139 @@
+// Package health is the standard gRPC health service, grpc.health.v1.Health,
+// for nrpc servers.
+package health
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements healthpb.HealthServer. The overall health of the
+// server is the status of the service "", SERVING from the start.
+type Server struct {
+	healthpb.UnimplementedHealthServer
+	mu       sync.Mutex
+	shutdown bool
+	statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+	// updates of each service, one per Watch call, holding the latest
+	// status not delivered yet
+	watchers map[string]map[chan healthpb.HealthCheckResponse_ServingStatus]struct{}
+}
+
+// NewServer returns a health server with the server SERVING.
+func NewServer() *Server {
+	return &Server{
+		statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{"": healthpb.HealthCheckResponse_SERVING},
+		watchers: make(map[string]map[chan healthpb.HealthCheckResponse_ServingStatus]struct{}),
+	}
+}
+
+// Register serves a new health server for s and returns it.
+func Register(s *rpc.Server) *Server {
+	h := NewServer()
+	healthpb.RegisterHealthServer(s, h)
+	return h
+}
+
+// Check returns the status of the service, codes.NotFound when it has none.
+func (h *Server) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.statuses[req.Service]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "health: unknown service %q", req.Service)
+	}
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch sends the status of the service, SERVICE_UNKNOWN when it has none,
+// and then every change of it until the call ends. A watcher slower than
+// the changes skips the intermediate ones.
+func (h *Server) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	updates := make(chan healthpb.HealthCheckResponse_ServingStatus, 1)
+	h.mu.Lock()
+	st, ok := h.statuses[req.Service]
+	if !ok {
+		st = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	updates <- st
+	if h.watchers[req.Service] == nil {
+		h.watchers[req.Service] = make(map[chan healthpb.HealthCheckResponse_ServingStatus]struct{})
+	}
+	h.watchers[req.Service][updates] = struct{}{}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.watchers[req.Service], updates)
+		if len(h.watchers[req.Service]) == 0 {
+			delete(h.watchers, req.Service)
+		}
+		h.mu.Unlock()
+	}()
+
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		select {
+		case st := <-updates:
+			if st == last {
+				continue
+			}
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// SetServingStatus sets the status of the service, "" for the whole
+// server, and tells its watchers. It does nothing after Shutdown.
+func (h *Server) SetServingStatus(service string, st healthpb.HealthCheckResponse_ServingStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return
+	}
+	h.setServingStatus(service, st)
+}
+
+// setServingStatus is SetServingStatus with h.mu held.
+func (h *Server) setServingStatus(service string, st healthpb.HealthCheckResponse_ServingStatus) {
+	h.statuses[service] = st
+	for updates := range h.watchers[service] {
+		// replace the status not delivered yet, if any
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- st
+	}
+}
+
+// Shutdown sets every service NOT_SERVING and ignores the changes of
+// status until Resume, for servers about to stop.
+func (h *Server) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = true
+	for service := range h.statuses {
+		h.setServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// Resume sets every service SERVING and accepts the changes of status
+// again.
+func (h *Server) Resume() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = false
+	for service := range h.statuses {
+		h.setServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+}
@@ -0,0 +1,69 @@
+package health_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/health"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealth(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	h := health.Register(s)
+	h.SetServingStatus("nrpctest.echo.Echo", healthpb.HealthCheckResponse_SERVING)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := rpc.NewClient(nc, "srv", "cli")
+	defer conn.Close()
+	cli := healthpb.NewHealthClient(conn)
+
+	check := func(service string, want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		res, err := cli.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil || res.Status != want {
+			t.Fatalf("Check(%q): got %v, %v, want %v", service, res, err, want)
+		}
+	}
+	check("", healthpb.HealthCheckResponse_SERVING)
+	check("nrpctest.echo.Echo", healthpb.HealthCheckResponse_SERVING)
+	if _, err := cli.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want %v", err, codes.NotFound)
+	}
+
+	watch, err := cli.Watch(ctx, &healthpb.HealthCheckRequest{Service: "nrpctest.echo.Echo"})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	next := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		res, err := watch.Recv()
+		if err != nil || res.Status != want {
+			t.Fatalf("Watch: got %v, %v, want %v", res, err, want)
+		}
+	}
+	next(healthpb.HealthCheckResponse_SERVING)
+	h.SetServingStatus("nrpctest.echo.Echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	next(healthpb.HealthCheckResponse_NOT_SERVING)
+	check("nrpctest.echo.Echo", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	// Shutdown overrides the statuses until Resume
+	h.SetServingStatus("nrpctest.echo.Echo", healthpb.HealthCheckResponse_SERVING)
+	next(healthpb.HealthCheckResponse_SERVING)
+	h.Shutdown()
+	next(healthpb.HealthCheckResponse_NOT_SERVING)
+	h.SetServingStatus("nrpctest.echo.Echo", healthpb.HealthCheckResponse_SERVING)
+	check("", healthpb.HealthCheckResponse_NOT_SERVING)
+	check("nrpctest.echo.Echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	h.Resume()
+	next(healthpb.HealthCheckResponse_SERVING)
+	check("", healthpb.HealthCheckResponse_SERVING)
+}
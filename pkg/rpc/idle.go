@@ -0,0 +1,38 @@
+package rpc
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithStreamIdleTimeout closes a stream on which nothing happened for d
+// with codes.DeadlineExceeded and forgets it: no request data or End
+// received from the client and no response sent by the handler. Unlike
+// WithReplyTTL, activity in either direction extends it, so it reclaims
+// the streams of clients gone mid-call without bounding the long ones.
+// Zero, the default, disables the timeout.
+func WithStreamIdleTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// touch restarts the idle timeout of the stream.
+func (s *serverStream) touch() {
+	if s.idle != nil && s.ctx.Err() == nil {
+		s.idle.Reset(s.server.idleTimeout)
+	}
+}
+
+// expireIdle ends a stream idle for the idle timeout, see
+// WithStreamIdleTimeout. The handler may still be writing, so the End
+// carries no trailer.
+func (s *serverStream) expireIdle() {
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.log.Warnf("stream idle for %v", s.server.idleTimeout)
+	s.abort(status.Newf(codes.DeadlineExceeded, "nrpc: stream idle for %v", s.server.idleTimeout), nil)
+}
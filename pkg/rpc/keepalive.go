@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithKeepalive makes the server ping the client of every call each
+// interval, and end the call with codes.Unavailable once it has heard
+// nothing from the client, pongs included, for timeout after a ping. It
+// detects clients that went away without ending their calls. It panics
+// unless timeout exceeds interval, a pong could not come back in time.
+func WithKeepalive(interval, timeout time.Duration) ServerOption {
+	if interval > 0 && timeout <= interval {
+		panic(fmt.Sprintf("nrpc: keepalive timeout %v must exceed the interval %v", timeout, interval))
+	}
+	return func(s *Server) {
+		s.keepalive = interval
+		s.keepaliveTimeout = timeout
+	}
+}
+
+// WithKeepaliveTimeout makes the client fail a call with codes.Unavailable
+// when the server, once it has started to ping, sends nothing for d. It is
+// meant for servers configured with WithKeepalive, d should exceed their
+// interval.
+func WithKeepaliveTimeout(d time.Duration) ClientOption {
+	return func(p *Client) {
+		p.keepaliveTimeout = d
+	}
+}
+
+// keepalive pings the client until the stream ends, and ends the stream
+// when the client has been silent for timeout since the first ping it has
+// not answered.
+func (s *serverStream) keepalive(interval, timeout time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var unanswered time.Time // when the first ping not answered was sent
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-t.C:
+			if time.Unix(0, atomic.LoadInt64(&s.lastSeen)).After(unanswered) {
+				// heard from the client since
+				unanswered = time.Time{}
+			}
+			if unanswered.IsZero() {
+				unanswered = now
+			} else if idle := now.Sub(unanswered); idle > timeout {
+				s.log.Warnf("no keepalive from the client for %v", idle)
+				s.abort(status.Newf(codes.Unavailable, "nrpc: no keepalive from the client for %v", timeout), nil)
+				return
+			}
+			s.writePing(false)
+		}
+	}
+}
+
+func (s *serverStream) writePing(pong bool) error {
+	return s.writeResponse(&nrpc.Response{
+		Type: &nrpc.Response_Ping{
+			Ping: &nrpc.Ping{Pong: pong},
+		},
+	})
+}
+
+func (c *clientStream) writePing(pong bool) error {
+	return c.writeRequest(&nrpc.Request{
+		Type: &nrpc.Request_Ping{
+			Ping: &nrpc.Ping{Pong: pong},
+		},
+	})
+}
+
+// fail ends the stream with err, which RecvMsg returns once the responses
+// received are read, and cancels the call on the server.
+func (c *clientStream) fail(err error) {
+	c.lastErr = err
+	close(c.recvWrite)
+	c.recvWrite = nil
+	c.close(err)
+}
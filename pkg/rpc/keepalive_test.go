@@ -0,0 +1,139 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestKeepaliveSilentStream(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv", rpc.WithKeepalive(50*time.Millisecond, 200*time.Millisecond))
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithKeepaliveTimeout(200*time.Millisecond))
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := echo.NewEchoClient(cli).BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.Send(&echo.EchoRequest{Message: "ping"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if reply, err := stream.Recv(); err != nil || reply.Message != "ping" {
+			t.Fatalf("got %v, %v after a silence", reply, err)
+		}
+		// silent on both sides, the keepalives are not data
+		time.Sleep(600 * time.Millisecond)
+	}
+}
+
+func TestKeepaliveDeadClient(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv", rpc.WithKeepalive(50*time.Millisecond, 200*time.Millisecond))
+
+	// a client that never answers pings
+	const subject = "nrpc.srv.nrpctest.echo.Echo.BidiStream"
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := proto.Marshal(&nrpc.Request{Type: &nrpc.Request_Call{Call: &nrpc.Call{Method: subject, Nid: "dead"}}})
+	if err := nc.PublishRequest(subject, inbox, data); err != nil {
+		t.Fatal(err)
+	}
+	pings := 0
+	for {
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("NextMsg: %v", err)
+		}
+		resp := &nrpc.Response{}
+		if err := proto.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetPing() != nil {
+			pings++
+		}
+		if end := resp.GetEnd(); end != nil {
+			if codes.Code(end.Status.GetCode()) != codes.Unavailable || pings == 0 {
+				t.Fatalf("got %v after %d pings, want %v", end.Status, pings, codes.Unavailable)
+			}
+			return
+		}
+	}
+}
+
+func TestKeepaliveDeadServer(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	// a server that pings once and goes silent
+	const subject = "nrpc.srv.nrpctest.echo.Echo.BidiStream"
+	data, _ := proto.Marshal(&nrpc.Response{Type: &nrpc.Response_Ping{Ping: &nrpc.Ping{}}})
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		req := &nrpc.Request{}
+		if proto.Unmarshal(msg.Data, req) == nil && req.GetCall() != nil {
+			nc.Publish(msg.Reply, data)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithKeepaliveTimeout(200*time.Millisecond))
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := echo.NewEchoClient(cli).BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	start := time.Now()
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want %v", err, codes.Unavailable)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("failed after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestKeepaliveSlowHandler(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithKeepalive(100*time.Millisecond, 150*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the client has nothing to send while the handler works, it only
+	// answers pings
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{DelayMs: 500}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+func TestKeepaliveTimeoutBelowInterval(t *testing.T) {
+	for _, timeout := range []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("WithKeepalive(100ms, %v) did not panic", timeout)
+				}
+			}()
+			rpc.WithKeepalive(100*time.Millisecond, timeout)
+		}()
+	}
+}
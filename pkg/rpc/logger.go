@@ -0,0 +1,48 @@
+package rpc
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are the structured fields of a Logger.
+type Fields map[string]interface{}
+
+// Logger is what the server and the client log to, see WithLogger and
+// WithClientLogger. Both log through logrus by default.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// WithFields returns a Logger adding fields to every entry.
+	WithFields(fields Fields) Logger
+}
+
+// newLogger returns the default logger of the server and the client, a
+// logrus logger writing the entries of level and above, with fields, to
+// the standard output.
+func newLogger(level logrus.Level, fields Fields) Logger {
+	l := logrus.New()
+	l.SetOutput(os.Stdout)
+	l.SetLevel(level)
+	l.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp:   true,
+		TimestampFormat: "2006-01-02 15:04:05.000",
+	})
+	return LogrusLogger(l.WithFields(logrus.Fields(fields)))
+}
+
+// LogrusLogger adapts a logrus logger or entry to Logger.
+func LogrusLogger(l logrus.FieldLogger) Logger {
+	return logrusLogger{l}
+}
+
+type logrusLogger struct {
+	logrus.FieldLogger
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{l.FieldLogger.WithFields(logrus.Fields(fields))}
+}
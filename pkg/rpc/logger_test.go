@@ -0,0 +1,86 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+)
+
+// entry is one line logged to a recordLogger.
+type entry struct {
+	msg    string
+	fields rpc.Fields
+}
+
+// recordLogger is a Logger recording its entries.
+type recordLogger struct {
+	mu      *sync.Mutex
+	entries *[]entry
+	fields  rpc.Fields
+}
+
+func newRecordLogger() recordLogger {
+	return recordLogger{mu: &sync.Mutex{}, entries: &[]entry{}}
+}
+
+func (l recordLogger) log(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.entries = append(*l.entries, entry{fmt.Sprintf(format, args...), l.fields})
+}
+
+func (l recordLogger) Debugf(format string, args ...interface{}) { l.log(format, args...) }
+func (l recordLogger) Infof(format string, args ...interface{})  { l.log(format, args...) }
+func (l recordLogger) Warnf(format string, args ...interface{})  { l.log(format, args...) }
+func (l recordLogger) Errorf(format string, args ...interface{}) { l.log(format, args...) }
+
+func (l recordLogger) WithFields(fields rpc.Fields) rpc.Logger {
+	merged := rpc.Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	l.fields = merged
+	return l
+}
+
+// find returns the first entry containing msg and having field key.
+func (l recordLogger) find(msg, key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range *l.entries {
+		if _, ok := e.fields[key]; strings.Contains(e.msg, msg) && (ok || len(key) == 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	srvLog, cliLog := newRecordLogger(), newRecordLogger()
+	echo.StartEchoServer(t, nc, "srv", rpc.WithLogger(srvLog))
+	if !srvLog.find("RegisterService", "") {
+		t.Fatalf("got entries %v, want the service registration logged", *srvLog.entries)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cli := rpc.NewClient(nc, "srv", echo.ClientNid, rpc.WithClientLogger(cliLog))
+	defer cli.Close()
+	if _, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if !cliLog.find("nrpc.Begin", "call-id") {
+		t.Fatalf("got entries %v, want the call logged with its call-id", *cliLog.entries)
+	}
+}
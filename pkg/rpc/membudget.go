@@ -0,0 +1,56 @@
+package rpc
+
+import "sync/atomic"
+
+// WithMemoryBudget caps the bytes of stream data the server buffers across
+// all its streams: the requests received and not read by their handlers
+// yet, including the chunks of those still arriving, see WithMaxChunkSize,
+// and the responses kept for resending until acknowledged, see
+// WithStreamAcks. Once the buffered data reaches n, new calls are refused
+// with codes.ResourceExhausted until enough is released, and so are the
+// streams already open whose requests overflow their receive buffer, see
+// WithStreamRecvBuffer.
+func WithMemoryBudget(n int64) ServerOption {
+	return func(s *Server) {
+		s.memoryBudget = n
+	}
+}
+
+// BufferedBytes returns the bytes of stream data the server buffers, as
+// counted by WithMemoryBudget.
+func (s *Server) BufferedBytes() int64 {
+	return atomic.LoadInt64(&s.buffered)
+}
+
+// overBudget reports whether the buffered data has reached the budget.
+func (s *Server) overBudget() bool {
+	return s.memoryBudget > 0 && atomic.LoadInt64(&s.buffered) >= s.memoryBudget
+}
+
+// hold counts n bytes buffered by the stream.
+func (s *serverStream) hold(n int) {
+	atomic.AddInt64(&s.buffered, int64(n))
+	atomic.AddInt64(&s.server.buffered, int64(n))
+}
+
+// release uncounts up to n bytes buffered by the stream, never more than
+// it holds, as release and releaseAll may race once the stream ends.
+func (s *serverStream) release(n int) {
+	for {
+		held := atomic.LoadInt64(&s.buffered)
+		m := int64(n)
+		if m > held {
+			m = held
+		}
+		if atomic.CompareAndSwapInt64(&s.buffered, held, held-m) {
+			atomic.AddInt64(&s.server.buffered, -m)
+			return
+		}
+	}
+}
+
+// releaseAll uncounts the data still buffered by an ended stream.
+func (s *serverStream) releaseAll() {
+	n := atomic.SwapInt64(&s.buffered, 0)
+	atomic.AddInt64(&s.server.buffered, -n)
+}
@@ -0,0 +1,45 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// incomingMetadata converts the metadata sent with a call. Keys are
+// lowercased, as metadata.MD expects them. Entries without values or with
+// a key gRPC would not accept are skipped with a warning rather than
+// handed to the handler.
+func incomingMetadata(m *nrpc.Metadata, log Logger) metadata.MD {
+	md := make(metadata.MD, len(m.GetMd()))
+	for key, vs := range m.GetMd() {
+		k := strings.ToLower(key)
+		if err := validateMetadataKey(k); err != nil {
+			log.Warnf("skipping metadata: %v", err)
+			continue
+		}
+		if len(vs.GetValues()) == 0 {
+			log.Warnf("skipping metadata %q: no values", key)
+			continue
+		}
+		md[k] = append(md[k], vs.GetValues()...)
+	}
+	return md
+}
+
+// validateMetadataKey checks that k, lowercased, is a valid gRPC metadata
+// key: not empty and made of digits, lowercase letters, '-', '_' and '.'.
+func validateMetadataKey(k string) error {
+	if len(k) == 0 {
+		return fmt.Errorf("nrpc: empty metadata key")
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("nrpc: invalid metadata key %q", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/metadata"
+)
+
+// metadataServer replies with the incoming metadata of the call, as sorted
+// key=values pairs, the call ID left out.
+type metadataServer struct {
+	echo.Server
+}
+
+func (*metadataServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var pairs []string
+	for k, vs := range md {
+		if k != rpc.CallIDKey {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, strings.Join(vs, ",")))
+		}
+	}
+	sort.Strings(pairs)
+	return &echo.EchoResponse{Message: strings.Join(pairs, " ")}, nil
+}
+
+func TestMalformedMetadata(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartServer(t, nc, "srv", &metadataServer{})
+	md := &nrpc.Metadata{Md: map[string]*nrpc.Strings{
+		"good":      {Values: []string{"1", "2"}},
+		"Upper":     {Values: []string{"3"}},
+		"":          {Values: []string{"empty key"}},
+		"no-values": {},
+		"nil":       nil,
+		"bad key":   {Values: []string{"4"}},
+		"colon:":    {Values: []string{"5"}},
+	}}
+	reply, err := rawUnaryMetadata(t, nc, nats.NewInbox(), md, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if want := "good=1,2 upper=3"; reply.Message != want {
+		t.Fatalf("got metadata %q, want %q", reply.Message, want)
+	}
+}
@@ -0,0 +1,34 @@
+package rpc
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Collector records the metrics of the calls a server handles, see
+// WithMetrics. Backed by Prometheus, CallStarted and CallEnded would
+// update a counter vector by method and code and a latency histogram, and
+// StreamsInFlight a gauge. The methods are called concurrently on the path
+// of every call, so they must be safe for concurrent use and cheap.
+type Collector interface {
+	// CallStarted is called as the handler of a call to method, the
+	// gRPC method, starts. Calls refused before reaching a handler do
+	// not start.
+	CallStarted(method string)
+	// CallEnded is called once as every call that started ends, with its
+	// status code, see WithStreamEndHook, and the time since the server
+	// received it.
+	CallEnded(method string, code codes.Code, latency time.Duration)
+	// StreamsInFlight is called with the number of streams in progress
+	// whenever it changes. It is called under a lock of the server, so it
+	// must not call the server.
+	StreamsInFlight(n int)
+}
+
+// WithMetrics makes the server record the metrics of its calls to c.
+func WithMetrics(c Collector) ServerOption {
+	return func(s *Server) {
+		s.metrics = c
+	}
+}
@@ -0,0 +1,123 @@
+package rpc_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+)
+
+// callKey is a method and a status code.
+type callKey struct {
+	method string
+	code   codes.Code
+}
+
+// memCollector keeps the metrics of a server in memory.
+type memCollector struct {
+	mu       sync.Mutex
+	started  map[string]int
+	ended    map[callKey]int
+	latency  time.Duration
+	inFlight int
+	peak     int
+}
+
+func (c *memCollector) CallStarted(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started[method]++
+}
+
+func (c *memCollector) CallEnded(method string, code codes.Code, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ended[callKey{method, code}]++
+	if latency > c.latency {
+		c.latency = latency
+	}
+}
+
+func (c *memCollector) StreamsInFlight(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight = n
+	if n > c.peak {
+		c.peak = n
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	c := &memCollector{started: map[string]int{}, ended: map[callKey]int{}}
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithMetrics(c))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{DelayMs: 10}); err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{ErrorCode: int32(codes.NotFound)}); err == nil {
+			t.Fatal("Unary succeeded, want NotFound")
+		}
+	}
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	c.mu.Lock()
+	inFlight := c.inFlight
+	c.mu.Unlock()
+	if inFlight != 1 {
+		t.Fatalf("got %d streams in flight, want the open stream", inFlight)
+	}
+	stream.CloseSend()
+	stream.Recv()
+
+	const unary, bidi = "/nrpctest.echo.Echo/Unary", "/nrpctest.echo.Echo/BidiStream"
+	want := map[callKey]int{
+		{unary, codes.OK}:       3,
+		{unary, codes.NotFound}: 2,
+		{bidi, codes.OK}:        1,
+	}
+	for {
+		c.mu.Lock()
+		done := len(c.ended) == len(want) && c.inFlight == 0
+		for k, n := range want {
+			done = done && c.ended[k] == n
+		}
+		c.mu.Unlock()
+		if done {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("got calls %v and %d in flight, want %v and none", c.ended, c.inFlight, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started[unary] != 5 || c.started[bidi] != 1 {
+		t.Fatalf("got started %v, want 5 unary calls and 1 stream", c.started)
+	}
+	if c.latency < 10*time.Millisecond {
+		t.Fatalf("got a max latency of %v, want the delay of the handler", c.latency)
+	}
+	if c.peak != 1 {
+		t.Fatalf("got a peak of %d streams, want 1", c.peak)
+	}
+}
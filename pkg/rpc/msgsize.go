@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultMaxRecvMsgSize is the largest message the server receives by
+// default, as in grpc-go.
+const defaultMaxRecvMsgSize = 4 * 1024 * 1024
+
+// WithMaxRecvMsgSize bounds the size of the messages the server receives,
+// 4MB by default. A larger message, or its first chunk that goes past the
+// bound, ends the stream with codes.ResourceExhausted before it is
+// buffered for the handler.
+func WithMaxRecvMsgSize(bytes int) ServerOption {
+	return func(s *Server) {
+		s.maxRecvMsgSize = bytes
+	}
+}
+
+// WithMaxSendMsgSize bounds the size of the messages the server sends, no
+// bound by default. SendMsg fails a larger message with
+// codes.ResourceExhausted, which ends the stream.
+func WithMaxSendMsgSize(bytes int) ServerOption {
+	return func(s *Server) {
+		s.maxSendMsgSize = bytes
+	}
+}
+
+// checkRecvSize ends the stream when the message received so far, size
+// bytes, is over the bound, and reports whether it is within it.
+func (s *serverStream) checkRecvSize(size int) bool {
+	max := s.server.maxRecvMsgSize
+	if max <= 0 || size <= max {
+		return true
+	}
+	s.log.Warnf("received message larger than max (%d vs. %d)", size, max)
+	s.abort(status.Newf(codes.ResourceExhausted, "nrpc: received message larger than max (%d vs. %d)", size, max), nil)
+	return false
+}
+
+// checkSendSize fails a message over the bound.
+func (s *serverStream) checkSendSize(size int) error {
+	if max := s.server.maxSendMsgSize; max > 0 && size > max {
+		return status.Errorf(codes.ResourceExhausted, "nrpc: trying to send message larger than max (%d vs. %d)", size, max)
+	}
+	return nil
+}
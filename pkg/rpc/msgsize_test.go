@@ -0,0 +1,89 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMaxRecvMsgSize(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	at := &echo.EchoRequest{Message: strings.Repeat("a", 100)}
+	over := &echo.EchoRequest{Message: strings.Repeat("a", 101)}
+	limit := proto.Size(at)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithMaxRecvMsgSize(limit))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Unary(ctx, at); err != nil {
+		t.Fatalf("Unary at the limit: %v", err)
+	}
+	_, err := cli.Unary(ctx, over)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted one byte over the limit", err)
+	}
+	if want := "(103 vs. 102)"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("got %v, want the sizes %v", err, want)
+	}
+
+	// the stream ends at the message over the limit
+	stream, err := cli.ClientStream(ctx)
+	if err != nil {
+		t.Fatalf("ClientStream: %v", err)
+	}
+	for _, req := range []*echo.EchoRequest{at, over} {
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+}
+
+func TestMaxRecvMsgSizeChunked(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv", rpc.WithMaxRecvMsgSize(1500))
+	conn := rpc.NewClient(nc, "srv", "cli", rpc.WithClientMaxChunkSize(1000))
+	defer conn.Close()
+	cli := echo.NewEchoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: strings.Repeat("a", 1200)}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	_, err := cli.Unary(ctx, &echo.EchoRequest{Message: strings.Repeat("a", 2000)})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted at the second chunk", err)
+	}
+}
+
+func TestMaxSendMsgSize(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	at := &echo.EchoRequest{ResponseSize: 100}
+	over := &echo.EchoRequest{ResponseSize: 101}
+	limit := proto.Size(&echo.EchoResponse{Payload: make([]byte, at.ResponseSize)})
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithMaxSendMsgSize(limit))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Unary(ctx, at); err != nil {
+		t.Fatalf("Unary at the limit: %v", err)
+	}
+	_, err := cli.Unary(ctx, over)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted one byte over the limit", err)
+	}
+	if want := "(103 vs. 102)"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("got %v, want the sizes %v", err, want)
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"time"
 
 	"github.com/nats-io/nats.go"
-	log "github.com/pion/ion-log"
+	"github.com/sirupsen/logrus"
 )
 
 var (
-	logger = log.NewLogger(log.InfoLevel, "nats-grpc")
+	logger = newLogger(logrus.InfoLevel, nil)
 )
 
 //NatsConn nats connection.
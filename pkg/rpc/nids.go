@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AddNid makes the server answer as nid too, besides the nid it was
+// created with: the services registered, and those registered later, are
+// also subscribed under the subjects of nid, with the same handlers. A
+// process can so answer both as its own node and as a well-known logical
+// name. The Begin of a call carries the nid the call arrived on.
+func (s *Server) AddNid(nid string) error {
+	if len(nid) == 0 {
+		return fmt.Errorf("nrpc: empty nid")
+	}
+	if err := validateToken("nid", nid); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.nids {
+		if n == nid {
+			return fmt.Errorf("nrpc: nid %q is already served", nid)
+		}
+	}
+	s.nids = append(s.nids, nid)
+	for token, info := range s.services {
+		// the handlers of the first nid, shared by the other ones
+		prefix := s.subjectPrefix(s.nid, token) + "."
+		handlers := make(map[string]*methodHandler)
+		for path, h := range s.handlers {
+			if name := strings.TrimPrefix(path, prefix); len(name) < len(path) && !strings.Contains(name, ".") {
+				handlers[name] = h
+			}
+		}
+		if err := s.subscribeNid(nid, token, info, handlers); err != nil {
+			s.removeNid(nid)
+			return fmt.Errorf("nrpc: cannot serve as %q: subscribe: %v", nid, err)
+		}
+	}
+	if s.unknown != nil {
+		if err := s.subscribeUnknown(nid); err != nil {
+			s.removeNid(nid)
+			return fmt.Errorf("nrpc: cannot serve as %q: subscribe: %v", nid, err)
+		}
+	}
+	if err := s.nc.Flush(); err != nil {
+		return fmt.Errorf("nrpc: %q is served but its subscriptions may not be in place yet: flush: %v", nid, err)
+	}
+	return nil
+}
+
+// removeNid removes nid, added by AddNid, when its subscriptions fail
+// midway. The caller holds s.mu.
+func (s *Server) removeNid(nid string) {
+	prefix := s.subjectPrefix(nid, "") + "."
+	for key, sub := range s.subs {
+		if strings.HasPrefix(key, prefix) {
+			sub.Unsubscribe()
+			delete(s.subs, key)
+		}
+	}
+	for path := range s.handlers {
+		if strings.HasPrefix(path, prefix) {
+			delete(s.handlers, path)
+		}
+	}
+	for i, n := range s.nids {
+		if n == nid {
+			s.nids = append(s.nids[:i], s.nids[i+1:]...)
+			break
+		}
+	}
+}
+
+// splitSubject returns the nid a subject of the server belongs to, and
+// the rest of the subject, service and method. The caller holds s.mu.
+func (s *Server) splitSubject(subject string) (nid, rest string) {
+	nid, rest = s.nid, subject
+	matched := -1
+	for _, n := range s.nids {
+		prefix := s.subjectPrefix(n, "") + "."
+		if strings.HasPrefix(subject, prefix) && len(prefix) > matched {
+			nid, rest, matched = n, subject[len(prefix):], len(prefix)
+		}
+	}
+	return nid, rest
+}
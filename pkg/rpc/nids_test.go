@@ -0,0 +1,99 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAddNid(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "node-7")
+	if err := s.AddNid("islb"); err != nil {
+		t.Fatalf("AddNid: %v", err)
+	}
+	if err := s.AddNid("islb"); err == nil {
+		t.Fatal("added the same nid twice")
+	}
+	if err := s.AddNid("bad.nid"); err == nil {
+		t.Fatal("added an invalid nid")
+	}
+	// services registered later are served under every nid too
+	later := rpc.NewServer(nc, "node-8")
+	defer later.Stop()
+	if err := later.AddNid("islb-later"); err != nil {
+		t.Fatalf("AddNid: %v", err)
+	}
+	echo.RegisterEchoServer(later, &echo.Server{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, nid := range []string{"node-7", "islb", "node-8", "islb-later"} {
+		cli := rpc.NewClient(nc, nid, "cli")
+		defer cli.Close()
+		// sees the responses of the call only, the previous ones are done
+		sub, err := nc.SubscribeSync(nats.InboxPrefix + ">")
+		if err != nil {
+			t.Fatalf("SubscribeSync: %v", err)
+		}
+		defer sub.Unsubscribe()
+		res, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{Message: nid})
+		if err != nil || res.Message != nid {
+			t.Fatalf("%v: got %v, %v, want %v", nid, res, err, nid)
+		}
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("NextMsg: %v", err)
+		}
+		resp := &nrpc.Response{}
+		if err := proto.Unmarshal(msg.Data, resp); err != nil || resp.GetBegin().GetNid() != nid {
+			t.Fatalf("got %v, %v, want a Begin with the nid %v", resp, err, nid)
+		}
+	}
+	// the 4 methods of the echo service under both nids
+	if got := len(s.Routes()); got != 8 {
+		t.Fatalf("got %d routes, want 8", got)
+	}
+}
+
+func TestAddNidDuringCalls(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				errc <- nil
+				return
+			default:
+			}
+			if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := s.AddNid(fmt.Sprintf("alias-%d", i)); err != nil {
+			t.Fatalf("AddNid: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	if err := <-errc; err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
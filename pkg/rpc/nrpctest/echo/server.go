@@ -0,0 +1,184 @@
+// Package echo is a test fixture service with unary, client-streaming,
+// server-streaming and bidirectional methods.
+//
+// The behaviour of each call is driven by the request: delay_ms delays every
+// response, error_code/error_message fail the call, response_size fills the
+// payload and response_count sets the number of ServerStream responses.
+// Incoming metadata whose key starts with HeaderEchoPrefix or
+// TrailerEchoPrefix is sent back as header or trailer.
+//
+// A complete integration test:
+//
+//	nc := nrpctest.RunNats(t)
+//	cli, _ := echo.StartEchoServer(t, nc, "node-1")
+//	resp, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hi"})
+package echo
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// HeaderEchoPrefix marks incoming metadata returned in the header.
+	HeaderEchoPrefix = "echo-header-"
+	// TrailerEchoPrefix marks incoming metadata returned in the trailer.
+	TrailerEchoPrefix = "echo-trailer-"
+	// ClientNid is the nid of clients created by StartEchoServer.
+	ClientNid = "nrpctest-client"
+)
+
+// Server is the fixture implementation of EchoServer.
+type Server struct {
+	UnimplementedEchoServer
+	// Delay is added before every response, on top of delay_ms.
+	Delay time.Duration
+}
+
+// StartEchoServer registers a Server on a new rpc.Server for nid and returns
+// a client for it. The server is stopped when the test finishes.
+func StartEchoServer(t testing.TB, nc rpc.NatsConn, nid string, opts ...rpc.ServerOption) (EchoClient, *rpc.Server) {
+	t.Helper()
+	return StartServer(t, nc, nid, &Server{}, opts...)
+}
+
+// StartServer is StartEchoServer with a custom implementation.
+func StartServer(t testing.TB, nc rpc.NatsConn, nid string, impl EchoServer, opts ...rpc.ServerOption) (EchoClient, *rpc.Server) {
+	t.Helper()
+	s := rpc.NewServer(nc, nid, opts...)
+	RegisterEchoServer(s, impl)
+	t.Cleanup(s.Stop)
+	cli := rpc.NewClient(nc, nid, ClientNid)
+	t.Cleanup(func() { cli.Close() })
+	return NewEchoClient(cli), s
+}
+
+func (s *Server) Unary(ctx context.Context, req *EchoRequest) (*EchoResponse, error) {
+	if err := grpc.SetHeader(ctx, echoed(ctx, HeaderEchoPrefix)); err != nil {
+		return nil, err
+	}
+	grpc.SetTrailer(ctx, echoed(ctx, TrailerEchoPrefix))
+	if err := s.handle(ctx, req); err != nil {
+		return nil, err
+	}
+	return response(req, 0), nil
+}
+
+func (s *Server) ClientStream(stream Echo_ClientStreamServer) error {
+	ctx := stream.Context()
+	stream.SetTrailer(echoed(ctx, TrailerEchoPrefix))
+	if err := stream.SendHeader(echoed(ctx, HeaderEchoPrefix)); err != nil {
+		return err
+	}
+	var last *EchoRequest
+	var n int32
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.handle(ctx, req); err != nil {
+			return err
+		}
+		last = req
+		n++
+	}
+	if last == nil {
+		last = &EchoRequest{}
+	}
+	return stream.SendAndClose(response(last, n))
+}
+
+func (s *Server) ServerStream(req *EchoRequest, stream Echo_ServerStreamServer) error {
+	ctx := stream.Context()
+	stream.SetTrailer(echoed(ctx, TrailerEchoPrefix))
+	if err := stream.SendHeader(echoed(ctx, HeaderEchoPrefix)); err != nil {
+		return err
+	}
+	count := req.ResponseCount
+	if count == 0 {
+		count = 1
+	}
+	for i := int32(0); i < count; i++ {
+		if err := s.handle(ctx, req); err != nil {
+			return err
+		}
+		if err := stream.Send(response(req, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) BidiStream(stream Echo_BidiStreamServer) error {
+	ctx := stream.Context()
+	stream.SetTrailer(echoed(ctx, TrailerEchoPrefix))
+	if err := stream.SendHeader(echoed(ctx, HeaderEchoPrefix)); err != nil {
+		return err
+	}
+	for i := int32(0); ; i++ {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.handle(ctx, req); err != nil {
+			return err
+		}
+		if err := stream.Send(response(req, i)); err != nil {
+			return err
+		}
+	}
+}
+
+// handle applies the delay and forced error requested by req.
+func (s *Server) handle(ctx context.Context, req *EchoRequest) error {
+	delay := s.Delay + time.Duration(req.DelayMs)*time.Millisecond
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if req.ErrorCode != 0 {
+		return status.Error(codes.Code(req.ErrorCode), req.ErrorMessage)
+	}
+	return nil
+}
+
+func response(req *EchoRequest, index int32) *EchoResponse {
+	return &EchoResponse{
+		Message: req.Message,
+		Payload: make([]byte, req.ResponseSize),
+		Index:   index,
+	}
+}
+
+// echoed returns the incoming metadata whose keys start with prefix.
+func echoed(ctx context.Context, prefix string) metadata.MD {
+	in, _ := metadata.FromIncomingContext(ctx)
+	md := metadata.MD{}
+	for k, v := range in {
+		if strings.HasPrefix(k, prefix) {
+			md[k] = v
+		}
+	}
+	return md
+}
@@ -0,0 +1,154 @@
+package echo_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnary(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "node-1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "echo-header-a", "1", "echo-trailer-b", "2", "other", "3")
+	var header, trailer metadata.MD
+	resp, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hi", ResponseSize: 1024}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if resp.Message != "hi" || len(resp.Payload) != 1024 {
+		t.Fatalf("got message %q with %d bytes payload", resp.Message, len(resp.Payload))
+	}
+	if got := header.Get("echo-header-a"); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("got header %v", header)
+	}
+	if got := trailer.Get("echo-trailer-b"); len(got) != 1 || got[0] != "2" {
+		t.Fatalf("got trailer %v", trailer)
+	}
+	if len(header.Get("other")) != 0 || len(trailer.Get("other")) != 0 {
+		t.Fatalf("unmarked metadata was echoed")
+	}
+}
+
+func TestUnaryError(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "node-1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := cli.Unary(ctx, &echo.EchoRequest{ErrorCode: int32(codes.NotFound), ErrorMessage: "missing"})
+	st := status.Convert(err)
+	if st.Code() != codes.NotFound || st.Message() != "missing" {
+		t.Fatalf("got %v, want NotFound: missing", err)
+	}
+}
+
+func TestUnaryDelay(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "node-1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{DelayMs: 100}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("call returned after %v, before the requested delay", d)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "node-1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "echo-header-a", "1", "echo-trailer-b", "2")
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{Message: "hi", ResponseCount: 5})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	for i := int32(0); i < 5; i++ {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if resp.Index != i {
+			t.Fatalf("got index %v, want %v", resp.Index, i)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	if header, _ := stream.Header(); len(header.Get("echo-header-a")) != 1 {
+		t.Fatalf("got header %v", header)
+	}
+	if trailer := stream.Trailer(); len(trailer.Get("echo-trailer-b")) != 1 {
+		t.Fatalf("got trailer %v", trailer)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "node-1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.ClientStream(ctx)
+	if err != nil {
+		t.Fatalf("ClientStream: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(&echo.EchoRequest{Message: "hi"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv: %v", err)
+	}
+	if resp.Index != 3 {
+		t.Fatalf("server received %v requests, want 3", resp.Index)
+	}
+}
+
+func TestBidiStream(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "node-1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	for i := int32(0); i < 3; i++ {
+		if err := stream.Send(&echo.EchoRequest{Message: "hi"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if resp.Index != i {
+			t.Fatalf("got index %v, want %v", resp.Index, i)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,28 @@
+// Package nrpctest provides helpers for testing services served over NATS.
+package nrpctest
+
+import (
+	"testing"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// RunNats starts an embedded nats-server on a random port and returns a
+// connection to it. Both are shut down when the test finishes.
+func RunNats(t testing.TB) *nats.Conn {
+	t.Helper()
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	ns := natsserver.RunServer(&opts)
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		ns.Shutdown()
+		t.Fatalf("nrpctest: connect: %v", err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+		ns.Shutdown()
+	})
+	return nc
+}
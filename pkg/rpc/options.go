@@ -0,0 +1,294 @@
+package rpc
+
+import (
+	"time"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// defaultRecvBuffer is the number of received messages a stream buffers
+// before the delivery of further frames blocks.
+const defaultRecvBuffer = 1
+
+// ServerOption configures how the Server handles calls.
+type ServerOption func(*Server)
+
+// ServiceOption configures a single service, see RegisterServiceWithOptions.
+type ServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	recvBuffer int
+	codec      encoding.Codec
+	aliases    []string
+	bare       map[string]bool // method names accepting bare NATS requests
+	bareAll    bool
+	timeouts   map[string]time.Duration // method name -> bound of its handlers
+	queueGroup *string                  // see WithServiceQueueGroup
+}
+
+// timeout returns the bound of the handlers of method, def when the
+// service does not set one.
+func (o serviceOptions) timeout(def time.Duration, method string) time.Duration {
+	if d, ok := o.timeouts[method]; ok {
+		return d
+	}
+	return def
+}
+
+// WithUnaryPush enables the hybrid unary mode for the given methods, named
+// as full gRPC methods like "/echo.Echo/SayHello".
+//
+// Handlers of those methods may call UnaryPusherFromContext to keep the call
+// open after their response has been sent, and push further messages on the
+// same stream until they Close it. Clients consume the pushes through
+// NewStream; calls made with Invoke behave like regular unary calls.
+func WithUnaryPush(methods ...string) ServerOption {
+	return func(s *Server) {
+		if s.pushMethods == nil {
+			s.pushMethods = make(map[string]bool)
+		}
+		for _, m := range methods {
+			s.pushMethods[m] = true
+		}
+	}
+}
+
+// WithStreamRecvBuffer sets how many received messages each stream buffers
+// until its handler reads them, 1 by default. Use WithServiceRecvBuffer to
+// override it for a single service, and SetMethodRecvBuffer for a single
+// method.
+//
+// Once a stream's buffer is full, the requests it receives wait in a queue
+// of the stream until the handler catches up, the other streams of the
+// service going on meanwhile, unless WithRecvOverflowPolicy fails the
+// stream instead. The queue is bounded by WithMemoryBudget only. Deeper
+// buffers decouple bursty client-streaming calls from their handler at the
+// cost of up to n messages of memory per stream, so keep unary services at
+// 1. This is a stopgap until window based flow control is available.
+func WithStreamRecvBuffer(n int) ServerOption {
+	return func(s *Server) {
+		if n > 0 {
+			s.recvBuffer = n
+		}
+	}
+}
+
+// WithLogger makes the server log to l instead of its own logrus logger at
+// debug level, see LogrusLogger.
+func WithLogger(l Logger) ServerOption {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+// WithSubjectPrefix serves the services under prefix, one or more subject
+// tokens, instead of "nrpc", to keep several deployments apart on a shared
+// NATS cluster. Clients reach them with WithClientSubjectPrefix. It panics
+// on an invalid prefix.
+func WithSubjectPrefix(prefix string) ServerOption {
+	mustValidatePrefix(prefix)
+	return func(s *Server) {
+		s.prefix = prefix
+	}
+}
+
+// WithQueueGroup sets the NATS queue group each service is subscribed
+// with, fn(token) where token is the service name or one of its subject
+// aliases, instead of the token itself, so that servers of different
+// deployments do not share calls. An empty group subscribes without a
+// queue group: every server of the service then receives and answers
+// every call.
+func WithQueueGroup(fn func(serviceName string) string) ServerOption {
+	return func(s *Server) {
+		s.queueGroup = fn
+	}
+}
+
+// RecvOverflowPolicy decides what a request arriving on a stream whose
+// receive buffer is full does, see WithStreamRecvBuffer.
+type RecvOverflowPolicy int
+
+const (
+	// RecvOverflowBlock queues the request until the handler reads, see
+	// WithStreamRecvBuffer.
+	RecvOverflowBlock RecvOverflowPolicy = iota
+	// RecvOverflowFail ends the stream with codes.ResourceExhausted, so
+	// that a client outpacing its handler cannot grow its queue.
+	RecvOverflowFail
+)
+
+// WithRecvOverflowPolicy sets what a request arriving on a stream whose
+// receive buffer is full does, RecvOverflowBlock by default.
+func WithRecvOverflowPolicy(p RecvOverflowPolicy) ServerOption {
+	return func(s *Server) {
+		s.recvOverflow = p
+	}
+}
+
+// WithReplyTTL bounds the lifetime of every stream: a stream that has not
+// ended d after its call arrived is closed with codes.DeadlineExceeded and
+// forgotten. Unlike an idle timeout, activity on the stream does not extend
+// it, so d must exceed the longest call the server serves. It cleans up the
+// streams of clients that crashed without ending their calls. Zero, the
+// default, disables the TTL.
+func WithReplyTTL(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.replyTTL = d
+	}
+}
+
+// WithDefaultTimeout bounds the handler of every call to d, so that none
+// runs unbounded: once d has passed, the context of the handler is done
+// and the call ends with codes.DeadlineExceeded. WithMethodTimeout
+// overrides d for the methods of a service. The deadline of the handler is
+// the earliest of:
+//
+//   - the timeout of the method, or d for the methods without one,
+//   - the deadline of the client, sent along with the call.
+//
+// Zero, the default, leaves the calls bound by the client deadline only.
+func WithDefaultTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.defaultTimeout = d
+	}
+}
+
+// WithEvictionCooldown makes the server refuse the calls of a client it
+// evicted with EvictPeer for d, with the status of the eviction.
+func WithEvictionCooldown(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.cooldown = d
+	}
+}
+
+// WithMaxServices bounds the number of services the server hosts, aliases
+// excluded, to catch runaway registrations. Registering more fails.
+func WithMaxServices(n int) ServerOption {
+	return func(s *Server) {
+		s.maxServices = n
+	}
+}
+
+// WithMaxConcurrentStreams bounds the number of streams the server serves
+// at once, so that clients opening streams without end cannot exhaust its
+// memory. The calls beyond it are refused with codes.ResourceExhausted, the
+// streams in progress are unaffected.
+func WithMaxConcurrentStreams(n int) ServerOption {
+	return func(s *Server) {
+		s.maxStreams = n
+	}
+}
+
+// WithDeterministicMarshal makes the server marshal the messages it sends
+// deterministically, map entries sorted by key, so that recorded traffic
+// and golden files are stable. It has a small cost, so it is off by
+// default. Only the default proto codec of a service honors it.
+func WithDeterministicMarshal() ServerOption {
+	return func(s *Server) {
+		s.marshal.Deterministic = true
+	}
+}
+
+// HeaderWritePolicy decides what setting the header of a call does once it
+// has been sent.
+type HeaderWritePolicy int
+
+const (
+	// HeaderStrict fails with ErrIllegalHeaderWrite, as gRPC does.
+	HeaderStrict HeaderWritePolicy = iota
+	// HeaderLenient logs and drops the header. It eases the migration of
+	// handlers that do not check the error, but hides the bug of a header
+	// that never reaches the client.
+	HeaderLenient
+)
+
+// WithHeaderWritePolicy sets what SetHeader and SendHeader do after the
+// header was sent, HeaderStrict by default.
+func WithHeaderWritePolicy(p HeaderWritePolicy) ServerOption {
+	return func(s *Server) {
+		s.headerPolicy = p
+	}
+}
+
+// WithServiceRecvBuffer overrides WithStreamRecvBuffer for one service.
+func WithServiceRecvBuffer(n int) ServiceOption {
+	return func(o *serviceOptions) {
+		if n > 0 {
+			o.recvBuffer = n
+		}
+	}
+}
+
+// WithServiceCodec sets the codec used for the request and response
+// messages of one service, protobuf by default. Clients have to use the same
+// codec for the service, see WithClientCodec.
+func WithServiceCodec(c encoding.Codec) ServiceOption {
+	return func(o *serviceOptions) {
+		if c != nil {
+			o.codec = c
+		}
+	}
+}
+
+// WithServiceQueueGroup overrides WithQueueGroup for one service, its
+// subject aliases included: it is subscribed with the queue group group,
+// so that e.g. canary instances in their own group only receive the calls
+// targeting them. An empty group subscribes without a queue group, every
+// server of the service then receives and answers every call.
+func WithServiceQueueGroup(group string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.queueGroup = &group
+	}
+}
+
+// WithSubjectAlias serves the service under additional service tokens, so
+// clients using WithServiceNameOverride reach it through the same generated
+// stubs. When the service name is already registered on the server, e.g. by
+// the implementation of a previous version, only the aliases are
+// subscribed, which lets two versions run side by side.
+func WithSubjectAlias(aliases ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.aliases = append(o.aliases, aliases...)
+	}
+}
+
+// WithBareNATSCompat lets the given unary methods, named without the service
+// like "SayHello", or all unary methods of the service when none are given,
+// also accept bare NATS requests such as those sent by `nats request`.
+//
+// The payload of a bare request is the serialized request message and its
+// NATS headers become the incoming metadata. The response is published to
+// the reply subject as the bare response message, with the header and
+// trailer metadata as NATS headers and the status code and message in
+// BareStatusHeader and BareMessageHeader. Requests from nrpc clients are
+// served as usual. Bare requests need a NATS server with header support.
+func WithBareNATSCompat(methods ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		if len(methods) == 0 {
+			o.bareAll = true
+			return
+		}
+		if o.bare == nil {
+			o.bare = make(map[string]bool)
+		}
+		for _, m := range methods {
+			o.bare[m] = true
+		}
+	}
+}
+
+// WithMethodTimeout bounds the handlers of the given methods, named without
+// the service like "SayHello", to d instead of the timeout set by
+// WithDefaultTimeout, be it longer or shorter. Zero leaves them bound by
+// the client deadline only. The deadline of the client still applies when
+// it is earlier.
+func WithMethodTimeout(d time.Duration, methods ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		if o.timeouts == nil {
+			o.timeouts = make(map[string]time.Duration)
+		}
+		for _, m := range methods {
+			o.timeouts[m] = d
+		}
+	}
+}
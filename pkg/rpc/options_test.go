@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// depthService reports the receive buffer depth of every stream it serves.
+func depthService(name string, depth chan<- int) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: name,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Depth",
+			ClientStreams: true,
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				depth <- cap(stream.(*serverStream).recvRead)
+				return nil
+			},
+		}},
+	}
+}
+
+func TestStreamRecvBuffer(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := NewServer(nc, "srv", WithStreamRecvBuffer(8))
+	defer s.Stop()
+	depth := make(chan int, 1)
+	s.RegisterService(depthService("test.Global", depth), struct{}{})
+	s.RegisterServiceWithOptions(depthService("test.Override", depth), struct{}{}, WithServiceRecvBuffer(64))
+
+	cli := NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	cases := []struct {
+		method string
+		depth  int
+	}{
+		{"/test.Global/Depth", 8},
+		{"/test.Override/Depth", 64},
+	}
+	for _, tc := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		stream, err := cli.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, tc.method)
+		if err != nil {
+			t.Fatalf("NewStream: %v", err)
+		}
+		if err := stream.SendMsg(wrapperspb.String("hi")); err != nil {
+			t.Fatalf("SendMsg: %v", err)
+		}
+		select {
+		case got := <-depth:
+			if got != tc.depth {
+				t.Fatalf("%v: got depth %v, want %v", tc.method, got, tc.depth)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%v: handler not called", tc.method)
+		}
+		cancel()
+	}
+}
+
+func TestStreamRecvBufferDefault(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := NewServer(nc, "srv")
+	defer s.Stop()
+	depth := make(chan int, 1)
+	s.RegisterService(depthService("test.Default", depth), struct{}{})
+
+	cli := NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := cli.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, "/test.Default/Depth")
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+	if err := stream.SendMsg(wrapperspb.String("hi")); err != nil {
+		t.Fatalf("SendMsg: %v", err)
+	}
+	if got := <-depth; got != defaultRecvBuffer {
+		t.Fatalf("got depth %v, want %v", got, defaultRecvBuffer)
+	}
+}
+
+func TestMaxServices(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := NewServer(nc, "srv", WithMaxServices(2))
+	defer s.Stop()
+	for _, name := range []string{"test.A", "test.B"} {
+		if err := s.RegisterServiceWithOptions(depthService(name, nil), nil); err != nil {
+			t.Fatalf("register %v: %v", name, err)
+		}
+	}
+	if err := s.RegisterServiceWithOptions(depthService("test.C", nil), nil); err == nil {
+		t.Fatal("registered a service beyond the maximum")
+	}
+	// aliases of a hosted service do not count
+	if err := s.RegisterServiceWithOptions(depthService("test.A", nil), nil, WithSubjectAlias("test.v2.A")); err != nil {
+		t.Fatalf("register alias: %v", err)
+	}
+	if got := len(s.GetServiceInfo()); got != 2 {
+		t.Fatalf("got %d services, want 2", got)
+	}
+}
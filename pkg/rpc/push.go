@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+)
+
+type unaryPusherKey struct{}
+
+// UnaryPusher sends follow-up messages on a unary call whose method has been
+// registered with WithUnaryPush.
+type UnaryPusher interface {
+	// Push sends m to the client. It blocks until the unary response has been
+	// sent, so pushes always arrive after it.
+	Push(m interface{}) error
+	// Close ends the call with err, which may be nil.
+	Close(err error)
+	// Done is closed when the call ends, e.g. cancelled by the client.
+	Done() <-chan struct{}
+}
+
+// UnaryPusherFromContext returns the UnaryPusher of the unary call in ctx.
+//
+// Calling it hands the stream over to the handler: once the response is sent
+// the call stays open until the pusher is closed or the client cancels. ok
+// is false if the method has not been registered with WithUnaryPush or the
+// client called it through Invoke, which reads a single response.
+func UnaryPusherFromContext(ctx context.Context) (UnaryPusher, bool) {
+	p, ok := ctx.Value(unaryPusherKey{}).(*unaryPusher)
+	if !ok {
+		return nil, false
+	}
+	p.mu.Lock()
+	p.used = true
+	p.mu.Unlock()
+	return p, true
+}
+
+type unaryPusher struct {
+	stream *serverStream
+	sent   chan struct{} // closed once the unary response has been sent
+	mu     sync.Mutex
+	used   bool
+}
+
+func (p *unaryPusher) isUsed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.used
+}
+
+func (p *unaryPusher) wait() error {
+	select {
+	case <-p.sent:
+		return nil
+	case <-p.stream.ctx.Done():
+		return p.stream.ctx.Err()
+	}
+}
+
+func (p *unaryPusher) Push(m interface{}) error {
+	if err := p.wait(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.stream.ctx.Err(); err != nil {
+		return err
+	}
+	return p.stream.SendMsg(m)
+}
+
+func (p *unaryPusher) Close(err error) {
+	if p.wait() != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stream.ctx.Err() == nil {
+		p.stream.close(err)
+	}
+}
+
+func (p *unaryPusher) Done() <-chan struct{} {
+	return p.stream.ctx.Done()
+}
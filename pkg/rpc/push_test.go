@@ -0,0 +1,79 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+)
+
+type pushServer struct {
+	echo.Server
+	pushes int
+}
+
+func (p *pushServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	pusher, ok := rpc.UnaryPusherFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("no pusher in context")
+	}
+	go func() {
+		for i := 0; i < p.pushes; i++ {
+			if err := pusher.Push(&echo.EchoResponse{Message: fmt.Sprintf("push-%v", i)}); err != nil {
+				return
+			}
+		}
+		pusher.Close(nil)
+	}()
+	return &echo.EchoResponse{Message: req.Message}, nil
+}
+
+func TestUnaryPush(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartServer(t, nc, "srv", &pushServer{pushes: 3}, rpc.WithUnaryPush("/nrpctest.echo.Echo/Unary"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli := rpc.NewClient(nc, "srv", "cli")
+	stream, err := cli.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/nrpctest.echo.Echo/Unary")
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+	if err := stream.SendMsg(&echo.EchoRequest{Message: "hello"}); err != nil {
+		t.Fatalf("SendMsg: %v", err)
+	}
+	want := []string{"hello", "push-0", "push-1", "push-2"}
+	for _, w := range want {
+		reply := &echo.EchoResponse{}
+		if err := stream.RecvMsg(reply); err != nil {
+			t.Fatalf("RecvMsg: %v", err)
+		}
+		if reply.Message != w {
+			t.Fatalf("got %q, want %q", reply.Message, w)
+		}
+	}
+	if err := stream.RecvMsg(&echo.EchoResponse{}); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestUnaryPushInvoke(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartServer(t, nc, "srv", &pushServer{pushes: 3}, rpc.WithUnaryPush("/nrpctest.echo.Echo/Unary"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Invoke reads a single response, the handler gets no pusher and the
+	// call completes like a regular unary call.
+	_, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"})
+	if err == nil || !strings.Contains(err.Error(), "no pusher in context") {
+		t.Fatalf("got %v, want the handler error", err)
+	}
+}
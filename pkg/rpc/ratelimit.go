@@ -0,0 +1,59 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// WithServiceRateLimit caps the calls the server accepts for service,
+// named like "echo.Echo", to perSecond on average with bursts of up to
+// burst calls, whichever client makes them, to protect what the service
+// depends on. Calls beyond it are refused with codes.ResourceExhausted.
+// The limit holds for the implementation registered under that name,
+// including the subject aliases it is served under.
+func WithServiceRateLimit(service string, perSecond float64, burst int) ServerOption {
+	return func(s *Server) {
+		if s.rateLimits == nil {
+			s.rateLimits = make(map[string]*rateLimiter)
+		}
+		s.rateLimits[service] = newRateLimiter(perSecond, burst)
+	}
+}
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // capacity of the bucket
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket, if there is one.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,48 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServiceRateLimit(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv", rpc.WithServiceRateLimit(echo.Echo_ServiceDesc.ServiceName, 2, 3))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var clients []echo.EchoClient
+	for _, nid := range []string{"a", "b"} {
+		cli := rpc.NewClient(nc, "srv", nid)
+		defer cli.Close()
+		clients = append(clients, echo.NewEchoClient(cli))
+	}
+
+	// the burst is shared by every client
+	var ok, limited int
+	for i := 0; i < 6; i++ {
+		_, err := clients[i%2].Unary(ctx, &echo.EchoRequest{})
+		switch status.Code(err) {
+		case codes.OK:
+			ok++
+		case codes.ResourceExhausted:
+			limited++
+		default:
+			t.Fatalf("Unary: %v", err)
+		}
+	}
+	// a call may have earned a token back meanwhile
+	if ok < 3 || ok > 4 || ok+limited != 6 {
+		t.Fatalf("got %d calls served and %d refused, want 3 served", ok, limited)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if _, err := clients[0].Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary after a refill: %v", err)
+	}
+}
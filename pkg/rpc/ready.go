@@ -0,0 +1,53 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+)
+
+const (
+	// statusHeader and noRespondersStatus mark the empty message the NATS
+	// server replies with when nothing subscribes to the subject of a
+	// request.
+	statusHeader       = "Status"
+	noRespondersStatus = "503"
+
+	// readyBackoff bounds the delay between the attempts of a unary call
+	// waiting for a server, see waitForReady.
+	readyBackoff = time.Second
+)
+
+// noResponders reports whether msg tells that no server received a request.
+func noResponders(msg *nats.Msg) bool {
+	return len(msg.Data) == 0 && msg.Header != nil && msg.Header.Get(statusHeader) == noRespondersStatus
+}
+
+// waitForReady reports whether the call options include
+// grpc.WaitForReady(true). A unary call with it that finds no server
+// listening is attempted again, after a delay doubling up to a second,
+// until one answers or the context of the call ends. Without it, and for
+// streams, the call fails at once with codes.Unavailable.
+func waitForReady(opts []grpc.CallOption) bool {
+	ready := false
+	for _, o := range opts {
+		if o, ok := o.(grpc.FailFastCallOption); ok {
+			ready = !o.FailFast
+		}
+	}
+	return ready
+}
+
+// sleep waits for d, and reports false when ctx ends first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
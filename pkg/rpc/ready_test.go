@@ -0,0 +1,92 @@
+package rpc_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNoResponders(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	conn := rpc.NewClient(nc, "nobody", "cli")
+	defer conn.Close()
+	cli := echo.NewEchoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("failed after %v, want at once", d)
+	}
+
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	conn := rpc.NewClient(nc, "late", "cli")
+	defer conn.Close()
+	cli := echo.NewEchoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := cli.Unary(short, &echo.EchoRequest{}, grpc.WaitForReady(true)); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded without a server", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hi"}, grpc.WaitForReady(true))
+		errc <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	echo.StartEchoServer(t, nc, "late")
+	if err := <-errc; err != nil {
+		t.Fatalf("got %v, want the call answered once the server started", err)
+	}
+}
+
+func TestNoRespondersAfterAnswer(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv", rpc.WithKeepalive(50*time.Millisecond, 2*time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: 8, DelayMs: 50})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	// the pongs sent once the server unsubscribed find no server
+	go s.GracefulStop(ctx)
+	n := 1
+	for ; ; n++ {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	if err != io.EOF || n != 8 {
+		t.Fatalf("got %d responses and %v, want 8 and %v", n, err, io.EOF)
+	}
+}
@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Record is a message the server received or published, see WithRecorder.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Inbound bool      `json:"inbound"`         // received by the server
+	Subject string    `json:"subject"`         // subject the message was published to
+	Reply   string    `json:"reply,omitempty"` // reply subject of an inbound message
+	Data    []byte    `json:"data"`            // marshaled nrpc.Request or nrpc.Response
+}
+
+// Recorder receives the messages of a server as they are received and
+// published. Record is called concurrently, from the NATS subscription
+// callbacks and handlers, and must not block.
+type Recorder interface {
+	Record(r Record)
+}
+
+// WithRecorder makes the server pass every message it receives or
+// publishes to r, so that a problem seen in production can be reproduced
+// with Replay.
+func WithRecorder(r Recorder) ServerOption {
+	return func(s *Server) {
+		s.recorder = r
+	}
+}
+
+// record passes a message to the recorder, if any.
+func (s *Server) record(inbound bool, subject, reply string, data []byte) {
+	if s.recorder == nil {
+		return
+	}
+	s.recorder.Record(Record{
+		Time:    time.Now(),
+		Inbound: inbound,
+		Subject: subject,
+		Reply:   reply,
+		Data:    data,
+	})
+}
+
+// MemoryRecorder is a Recorder keeping the records in memory.
+type MemoryRecorder struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+func (m *MemoryRecorder) Record(r Record) {
+	m.mu.Lock()
+	m.records = append(m.records, r)
+	m.mu.Unlock()
+}
+
+// Records returns the records so far, in the order they were made.
+func (m *MemoryRecorder) Records() []Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Record(nil), m.records...)
+}
+
+// WriterRecorder is a Recorder writing the records to w as JSON, one per
+// line, for ReadRecords.
+type WriterRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewWriterRecorder returns a Recorder writing to w, typically a file.
+func NewWriterRecorder(w io.Writer) *WriterRecorder {
+	return &WriterRecorder{enc: json.NewEncoder(w)}
+}
+
+func (w *WriterRecorder) Record(r Record) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(r); err != nil {
+		logger.Errorf("WriterRecorder: %v", err)
+	}
+}
+
+// ReadRecords reads the records written by a WriterRecorder.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// Replay publishes the inbound records to nc again, in order and with the
+// delays they were originally received with, to run them against a test
+// server registered with the nid of the recorded one. The responses are
+// published to the recorded reply subjects.
+func Replay(ctx context.Context, nc NatsConn, records []Record) error {
+	var last time.Time
+	for _, r := range records {
+		if !r.Inbound {
+			continue
+		}
+		if !last.IsZero() && r.Time.After(last) {
+			t := time.NewTimer(r.Time.Sub(last))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+		last = r.Time
+		if err := nc.PublishRequest(r.Subject, r.Reply, r.Data); err != nil {
+			return err
+		}
+	}
+	return nc.Flush()
+}
@@ -0,0 +1,130 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecordReplay(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	rec := &rpc.MemoryRecorder{}
+	var file bytes.Buffer
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithRecorder(rec))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "recorded"}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+
+	records := rec.Records()
+	var inbound, outbound int
+	for _, r := range records {
+		if r.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	// Call and Data in, Begin, Data and End out
+	if inbound != 2 || outbound != 3 {
+		t.Fatalf("got %d inbound and %d outbound records, want 2 and 3", inbound, outbound)
+	}
+	w := rpc.NewWriterRecorder(&file)
+	for _, r := range records {
+		w.Record(r)
+	}
+	records, err := rpc.ReadRecords(&file)
+	if err != nil {
+		t.Fatalf("ReadRecords: %v", err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("read %d records, want 5", len(records))
+	}
+
+	// replay against a fresh server with the same nid
+	nc2 := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc2, "srv")
+	replies := make(chan *nats.Msg, 8)
+	sub, err := nc2.ChanSubscribe(records[0].Reply, replies)
+	if err != nil {
+		t.Fatalf("ChanSubscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+	if err := rpc.Replay(ctx, nc2, records); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	select {
+	case msg := <-replies:
+		resp := &nrpc.Response{}
+		if err := proto.Unmarshal(msg.Data, resp); err != nil || resp.GetBegin() == nil {
+			t.Fatalf("got %v, %v, want the Begin first", resp, err)
+		}
+		msg = <-replies
+		if err := proto.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		reply := &echo.EchoResponse{}
+		if err := proto.Unmarshal(resp.GetData().GetData(), reply); err != nil || reply.Message != "recorded" {
+			t.Fatalf("got %v, %v, want the recorded reply", reply, err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("no reply to the replayed call")
+	}
+}
+
+func TestDeterministicMarshal(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	rec := &rpc.MemoryRecorder{}
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithRecorder(rec), rpc.WithDeterministicMarshal())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var kv []string
+	for i := 0; i < 32; i++ {
+		kv = append(kv, fmt.Sprintf("echo-trailer-%02d", i), "v")
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, kv...)
+	for i := 0; i < 2; i++ {
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "stable"}); err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+	}
+
+	var ends [][]byte
+	for _, r := range rec.Records() {
+		var resp nrpc.Response
+		if r.Inbound {
+			continue
+		}
+		if err := proto.Unmarshal(r.Data, &resp); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if resp.GetEnd() == nil {
+			continue
+		}
+		want, err := proto.MarshalOptions{Deterministic: true}.Marshal(&resp)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		if !bytes.Equal(r.Data, want) {
+			t.Fatalf("End is not marshaled deterministically")
+		}
+		ends = append(ends, r.Data)
+	}
+	if len(ends) != 2 {
+		t.Fatalf("got %d End records, want 2", len(ends))
+	}
+	if !bytes.Equal(ends[0], ends[1]) {
+		t.Fatalf("End records of identical calls differ")
+	}
+}
@@ -0,0 +1,110 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type panicServer struct {
+	echo.Server
+}
+
+func (p *panicServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	panic("boom")
+}
+
+type panicReport struct {
+	method, pnid string
+	md           metadata.MD
+	recovered    interface{}
+	stack        []byte
+}
+
+func TestHandlerPanic(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &panicServer{})
+	reports := make(chan panicReport, 1)
+	s.OnPanic(func(method, pnid string, md metadata.MD, recovered interface{}, stack []byte) {
+		reports <- panicReport{method, pnid, md, recovered, stack}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "request-id", "42")
+	_, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"})
+	if got, want := status.Code(err), codes.Internal; got != want {
+		t.Fatalf("got %v (%v), want %v", got, err, want)
+	}
+	if !strings.Contains(status.Convert(err).Message(), "boom") {
+		t.Fatalf("status message %q does not carry the panic value", status.Convert(err).Message())
+	}
+
+	r := <-reports
+	if r.method != "/nrpctest.echo.Echo/Unary" {
+		t.Fatalf("got method %q", r.method)
+	}
+	if r.pnid != echo.ClientNid {
+		t.Fatalf("got pnid %q", r.pnid)
+	}
+	if got := r.md.Get("request-id"); len(got) != 1 || got[0] != "42" {
+		t.Fatalf("got metadata %v", r.md)
+	}
+	if r.recovered != "boom" {
+		t.Fatalf("got recovered %v", r.recovered)
+	}
+	if !strings.Contains(string(r.stack), "Unary") {
+		t.Fatalf("stack does not include the handler:\n%s", r.stack)
+	}
+}
+
+func TestRecoveryHandler(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	recovered := make(chan interface{}, 2)
+	cli, _ := echo.StartServer(t, nc, "srv", &panicServer{}, rpc.WithRecoveryHandler(func(ctx context.Context, p interface{}) error {
+		recovered <- p
+		md, _ := metadata.FromIncomingContext(ctx)
+		if len(md.Get("keep-default")) > 0 {
+			return nil
+		}
+		return status.Errorf(codes.Unavailable, "recovered from %v", p)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := cli.Unary(ctx, &echo.EchoRequest{})
+	if st := status.Convert(err); st.Code() != codes.Unavailable || st.Message() != "recovered from boom" {
+		t.Fatalf("got %v, want the error of the recovery handler", err)
+	}
+	_, err = cli.Unary(metadata.AppendToOutgoingContext(ctx, "keep-default", "1"), &echo.EchoRequest{})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+	for i := 0; i < 2; i++ {
+		if p := <-recovered; p != "boom" {
+			t.Fatalf("got %v, want the panic value", p)
+		}
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartServer(t, nc, "srv", &panicServer{}, rpc.WithPanicHandler(func(p interface{}) error {
+		return status.Errorf(codes.Aborted, "recovered from %v", p)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := cli.Unary(ctx, &echo.EchoRequest{})
+	if st := status.Convert(err); st.Code() != codes.Aborted || st.Message() != "recovered from boom" {
+		t.Fatalf("got %v, want the error of the panic handler", err)
+	}
+}
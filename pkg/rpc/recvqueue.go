@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recvQueue holds the requests of a stream its receive buffer has no room
+// for yet. The subscription callback hands the requests over without
+// waiting, and a goroutine of the stream delivers those queued in arrival
+// order, so that a handler slow to read holds up its own stream only.
+type recvQueue struct {
+	mu      sync.Mutex
+	pending []recvItem
+	running bool // a goroutine delivers pending
+}
+
+// recvItem is a request to deliver, or the half-close of the client.
+type recvItem struct {
+	data []byte
+	end  bool
+}
+
+// len returns the number of requests queued.
+func (q *recvQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// deliver hands item over to the receive buffer, or queues it behind the
+// items not delivered yet. It returns the status to end the stream with
+// when item cannot wait, see RecvOverflowPolicy and WithMemoryBudget.
+func (s *serverStream) deliver(item recvItem) *status.Status {
+	q := &s.recvQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.running && s.tryDeliver(item) {
+		return nil
+	}
+	switch {
+	case item.end:
+		// takes no room
+	case s.server.recvOverflow == RecvOverflowFail:
+		s.log.Warnf("receive buffer of %d messages full", cap(s.recvWrite))
+		return status.Newf(codes.ResourceExhausted, "nrpc: receive buffer of %d messages full", cap(s.recvWrite))
+	case s.server.overBudget():
+		s.log.Warnf("memory budget of %d bytes exhausted", s.server.memoryBudget)
+		return status.Newf(codes.ResourceExhausted, "nrpc: memory budget of %d bytes exhausted", s.server.memoryBudget)
+	}
+	q.pending = append(q.pending, item)
+	if !q.running {
+		q.running = true
+		go s.drainRecvQueue()
+	}
+	return nil
+}
+
+// tryDeliver hands item over to the receive buffer if it has room.
+func (s *serverStream) tryDeliver(item recvItem) bool {
+	if item.end {
+		close(s.recvWrite)
+		return true
+	}
+	select {
+	case s.recvWrite <- item.data:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainRecvQueue delivers the queued requests until none is left or the
+// stream ends.
+func (s *serverStream) drainRecvQueue() {
+	q := &s.recvQueue
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 || s.ctx.Err() != nil {
+			// the data dropped is released with the stream
+			q.pending = nil
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		// left in the queue until delivered, see ActiveStreams
+		item := q.pending[0]
+		q.mu.Unlock()
+		if item.end {
+			close(s.recvWrite)
+		} else {
+			select {
+			case s.recvWrite <- item.data:
+			case <-s.ctx.Done():
+				s.release(len(item.data))
+			}
+		}
+		q.mu.Lock()
+		q.pending[0] = recvItem{}
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+	}
+}
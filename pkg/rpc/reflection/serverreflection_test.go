@@ -0,0 +1,74 @@
+package reflection_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestServerReflection(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	reflection.Register(s)
+	conn := rpc.NewClient(nc, "srv", "cli")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatalf("ServerReflectionInfo: %v", err)
+	}
+	ask := func(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+		t.Helper()
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		return res
+	}
+
+	res := ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	services := map[string]bool{}
+	for _, svc := range res.GetListServicesResponse().GetService() {
+		services[svc.Name] = true
+	}
+	if !services["nrpctest.echo.Echo"] || !services["grpc.reflection.v1alpha.ServerReflection"] {
+		t.Fatalf("got services %v, want the echo and reflection services", services)
+	}
+
+	res = ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "nrpctest.echo.Echo"},
+	})
+	files := res.GetFileDescriptorResponse().GetFileDescriptorProto()
+	if len(files) == 0 {
+		t.Fatalf("got %v, want the file of the echo service", res)
+	}
+	fd := &descriptorpb.FileDescriptorProto{}
+	if err := proto.Unmarshal(files[0], fd); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if fd.GetPackage() != "nrpctest.echo" || len(fd.GetService()) != 1 || fd.GetService()[0].GetName() != "Echo" {
+		t.Fatalf("got file %v of package %v, want the one declaring nrpctest.echo.Echo", fd.GetName(), fd.GetPackage())
+	}
+
+	res = ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "no.such.Symbol"},
+	})
+	if res.GetErrorResponse() == nil {
+		t.Fatalf("got %v, want an error for an unknown symbol", res)
+	}
+}
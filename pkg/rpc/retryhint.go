@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPushbackKey is the trailer key of the retry hint of a failed call,
+// as in gRPC: the delay in milliseconds after which the client may retry
+// the call, negative when it must not.
+const RetryPushbackKey = "grpc-retry-pushback-ms"
+
+// SetRetryHint tells the client of the call served by the handler whose
+// context is ctx whether and when to retry the call if it fails, in its
+// trailer. Clients calling with WithHintedRetries honor it, others read it
+// with RetryHint.
+func SetRetryHint(ctx context.Context, delay time.Duration, retriable bool) error {
+	md := retryHint(delay, retriable)
+	if s, ok := ctx.Value(serverStreamKey{}).(*serverStream); ok {
+		s.SetTrailer(md)
+		return nil
+	}
+	return grpc.SetTrailer(ctx, md)
+}
+
+// retryHint returns the trailer of a retry hint, see SetRetryHint.
+func retryHint(delay time.Duration, retriable bool) metadata.MD {
+	v := "-1"
+	if retriable {
+		if delay < 0 {
+			delay = 0
+		}
+		v = strconv.FormatInt(int64(delay/time.Millisecond), 10)
+	}
+	return metadata.Pairs(RetryPushbackKey, v)
+}
+
+// RetryHint returns the retry hint in the trailer of a call, ok unset when
+// the server gave none, see SetRetryHint.
+func RetryHint(trailer metadata.MD) (delay time.Duration, retriable, ok bool) {
+	vs := trailer.Get(RetryPushbackKey)
+	if len(vs) == 0 {
+		return 0, false, false
+	}
+	ms, err := strconv.ParseInt(vs[len(vs)-1], 10, 64)
+	if err != nil || ms < 0 {
+		// as in gRPC, a malformed hint forbids retries
+		return 0, false, true
+	}
+	return time.Duration(ms) * time.Millisecond, true, true
+}
+
+// HintedRetriesOption is a grpc.CallOption retrying a failed unary call
+// as its server hints, see WithHintedRetries.
+type HintedRetriesOption struct {
+	grpc.EmptyCallOption
+	MaxAttempts int
+}
+
+// WithHintedRetries makes a unary call of up to maxAttempts attempts:
+// a failed attempt whose server set a retry hint allowing it, see
+// SetRetryHint, is retried after the delay of the hint. Failures without
+// a hint are not retried. The timeout of the call, see WithCallTimeout,
+// applies to each attempt, the deadline of its context to all of them.
+func WithHintedRetries(maxAttempts int) grpc.CallOption {
+	return HintedRetriesOption{MaxAttempts: maxAttempts}
+}
+
+// retryDelay returns how long to wait before the next attempt of a call
+// that failed with err and trailer, false when it must not be retried. A
+// status without a retry hint may carry an errdetails.RetryInfo instead.
+func retryDelay(ctx context.Context, err error, trailer metadata.MD) (time.Duration, bool) {
+	delay, retriable, ok := RetryHint(trailer)
+	if !ok {
+		delay, retriable, ok = retryInfo(err)
+	}
+	if !ok || !retriable {
+		return 0, false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return 0, false
+	}
+	return delay, true
+}
+
+// retryInfo returns the delay of the errdetails.RetryInfo of err, if any.
+func retryInfo(err error) (delay time.Duration, retriable, ok bool) {
+	for _, d := range status.Convert(err).Details() {
+		if info, isInfo := d.(*errdetails.RetryInfo); isInfo {
+			delay = info.GetRetryDelay().AsDuration()
+			return delay, delay >= 0, true
+		}
+	}
+	return 0, false, false
+}
@@ -0,0 +1,88 @@
+package rpc_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// hintingServer fails its first failures calls with codes.Unavailable and
+// a hint to retry after 50ms, or not to retry when ErrorCode is set.
+type hintingServer struct {
+	echo.Server
+	calls    int32
+	failures int32
+}
+
+func (s *hintingServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	if atomic.AddInt32(&s.calls, 1) > s.failures {
+		return &echo.EchoResponse{Message: req.Message}, nil
+	}
+	if err := rpc.SetRetryHint(ctx, 50*time.Millisecond, req.ErrorCode == 0); err != nil {
+		return nil, err
+	}
+	return nil, status.Error(codes.Unavailable, "busy")
+}
+
+func TestHintedRetries(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &hintingServer{failures: 2}
+	cli, _ := echo.StartServer(t, nc, "srv", impl)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// without retries the hint shows in the trailer
+	var trailer metadata.MD
+	_, err := cli.Unary(ctx, &echo.EchoRequest{}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want %v", err, codes.Unavailable)
+	}
+	if delay, retriable, ok := rpc.RetryHint(trailer); !ok || !retriable || delay != 50*time.Millisecond {
+		t.Fatalf("got hint %v, %v, %v, want a retry after 50ms", delay, retriable, ok)
+	}
+
+	atomic.StoreInt32(&impl.calls, 0)
+	start := time.Now()
+	reply, err := cli.Unary(ctx, &echo.EchoRequest{Message: "third"}, rpc.WithHintedRetries(3), grpc.Trailer(&trailer))
+	if err != nil || reply.Message != "third" {
+		t.Fatalf("got %v, %v, want third", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("succeeded after %v, want the hinted delays", elapsed)
+	}
+	if len(trailer.Get(rpc.RetryPushbackKey)) != 0 {
+		t.Fatalf("got trailer %v, want the one of the last attempt", trailer)
+	}
+
+	// too few attempts, or a hint forbidding retries
+	for _, tc := range []struct {
+		attempts int
+		noRetry  bool
+		calls    int32
+	}{
+		{2, false, 2},
+		{3, true, 1},
+	} {
+		atomic.StoreInt32(&impl.calls, 0)
+		req := &echo.EchoRequest{}
+		if tc.noRetry {
+			req.ErrorCode = 1
+		}
+		_, err := cli.Unary(ctx, req, rpc.WithHintedRetries(tc.attempts))
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("got %v, want %v", err, codes.Unavailable)
+		}
+		if calls := atomic.LoadInt32(&impl.calls); calls != tc.calls {
+			t.Fatalf("got %d attempts, want %d", calls, tc.calls)
+		}
+	}
+}
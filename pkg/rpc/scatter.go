@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Policy decides when ScatterGather stops collecting responses.
+type Policy struct {
+	// MinResponses is the number of successful responses after which the
+	// gather ends, every instance when 0.
+	MinResponses int
+	// MaxWait bounds the gather on top of the deadline of its context, no
+	// bound when 0.
+	MaxWait time.Duration
+	// FailFast ends the gather at the first error response.
+	FailFast bool
+}
+
+// Outcome is the result of the call to one instance in ScatterGather.
+type Outcome struct {
+	NID      string
+	Answered bool        // false when the gather ended before the instance answered
+	Reply    interface{} // the response, when the call succeeded
+	Err      error       // the error of the call, when it failed
+}
+
+// ScatterGather calls method with req on every server in nids at once and
+// collects the responses, each one allocated by newReply, as they arrive.
+// It returns as soon as p is satisfied and cancels the calls still in
+// flight. The outcomes are in the order of nids, those of the instances
+// that never answered have Answered unset.
+//
+// The error is nil when p was satisfied. Otherwise it is the first error
+// response with FailFast, codes.DeadlineExceeded or codes.Canceled when
+// the gather ran out of time, or codes.Unavailable when every instance
+// answered but too few succeeded.
+func ScatterGather(ctx context.Context, c *Client, nids []string, method string, req interface{}, newReply func() interface{}, p Policy, opts ...grpc.CallOption) ([]Outcome, error) {
+	var cancel context.CancelFunc
+	if p.MaxWait > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.MaxWait)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	min := p.MinResponses
+	if min <= 0 || min > len(nids) {
+		min = len(nids)
+	}
+	type result struct {
+		i     int
+		reply interface{}
+		err   error
+	}
+	results := make(chan result, len(nids))
+	outcomes := make([]Outcome, len(nids))
+	for i, nid := range nids {
+		outcomes[i].NID = nid
+		go func(i int, nid string) {
+			reply := newReply()
+			err := c.invoke(ctx, nid, method, req, reply, opts...)
+			results <- result{i, reply, err}
+		}(i, nid)
+	}
+
+	succeeded := 0
+	for answered := 0; answered < len(nids); {
+		select {
+		case r := <-results:
+			if r.err != nil && ctx.Err() != nil {
+				// cut short by the gather, not an answer
+				continue
+			}
+			answered++
+			o := &outcomes[r.i]
+			o.Answered = true
+			if r.err != nil {
+				o.Err = r.err
+				if p.FailFast {
+					return outcomes, r.err
+				}
+				continue
+			}
+			o.Reply = r.reply
+			if succeeded++; succeeded >= min {
+				return outcomes, nil
+			}
+		case <-ctx.Done():
+			return outcomes, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	return outcomes, status.Errorf(codes.Unavailable, "nrpc: %d of %d instances succeeded, %d required", succeeded, len(nids), min)
+}
@@ -0,0 +1,93 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type failingServer struct {
+	echo.Server
+}
+
+func (f *failingServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return nil, status.Error(codes.NotFound, "not here")
+}
+
+const unaryMethod = "/nrpctest.echo.Echo/Unary"
+
+func TestScatterGather(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartServer(t, nc, "ok", &echo.Server{})
+	echo.StartServer(t, nc, "failing", &failingServer{})
+	echo.StartServer(t, nc, "slow", &echo.Server{Delay: 2 * time.Second})
+	cli := rpc.NewClient(nc, "", "cli")
+	defer cli.Close()
+	nids := []string{"ok", "failing", "slow"}
+	newReply := func() interface{} { return &echo.EchoResponse{} }
+	req := &echo.EchoRequest{Message: "hello"}
+
+	for _, tc := range []struct {
+		name     string
+		policy   rpc.Policy
+		timeout  time.Duration
+		code     codes.Code
+		answered []bool
+		either   string // instance that may answer before the gather ends
+	}{
+		{"min responses", rpc.Policy{MinResponses: 1}, 5 * time.Second, codes.OK, []bool{true, false, false}, "failing"},
+		{"max wait", rpc.Policy{MinResponses: 2, MaxWait: 300 * time.Millisecond}, 5 * time.Second, codes.DeadlineExceeded, []bool{true, true, false}, ""},
+		{"context deadline", rpc.Policy{MinResponses: 2, MaxWait: 5 * time.Second}, 300 * time.Millisecond, codes.DeadlineExceeded, []bool{true, true, false}, ""},
+		{"fail fast", rpc.Policy{FailFast: true}, 5 * time.Second, codes.NotFound, []bool{false, true, false}, "ok"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+		start := time.Now()
+		outcomes, err := rpc.ScatterGather(ctx, cli, nids, unaryMethod, req, newReply, tc.policy)
+		cancel()
+		if status.Code(err) != tc.code {
+			t.Fatalf("%v: got %v, want %v", tc.name, err, tc.code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("%v: returned after %v, the slow instance was waited for", tc.name, elapsed)
+		}
+		for i, o := range outcomes {
+			if o.NID != nids[i] {
+				t.Fatalf("%v: got outcome of %v at %d, want %v", tc.name, o.NID, i, nids[i])
+			}
+			if o.Answered != tc.answered[i] && o.NID != tc.either {
+				t.Fatalf("%v: got %v answered %v, want %v", tc.name, o.NID, o.Answered, tc.answered[i])
+			}
+		}
+		if o := outcomes[0]; o.Answered && (o.Err != nil || o.Reply.(*echo.EchoResponse).Message != "hello") {
+			t.Fatalf("%v: got %+v, want the echoed message", tc.name, o)
+		}
+		if o := outcomes[1]; o.Answered && status.Code(o.Err) != codes.NotFound {
+			t.Fatalf("%v: got %+v, want %v", tc.name, o, codes.NotFound)
+		}
+	}
+}
+
+func TestScatterGatherTooFew(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartServer(t, nc, "ok", &echo.Server{})
+	echo.StartServer(t, nc, "failing", &failingServer{})
+	cli := rpc.NewClient(nc, "", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	outcomes, err := rpc.ScatterGather(ctx, cli, []string{"ok", "failing"}, unaryMethod, &echo.EchoRequest{},
+		func() interface{} { return &echo.EchoResponse{} }, rpc.Policy{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want %v", err, codes.Unavailable)
+	}
+	if !outcomes[0].Answered || !outcomes[1].Answered {
+		t.Fatalf("got %+v, want every instance answered", outcomes)
+	}
+}
@@ -0,0 +1,44 @@
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type serverStreamKey struct{}
+
+// SendMsgWithDeadline sends m on the stream served by the handler whose
+// context is ctx, like SendMsg, unless deadline has passed by the time m
+// is marshaled and ready to publish. A late message is dropped, logged and
+// counted in Server.DroppedMessages, and the stream goes on: the error is
+// nil, as for a message sent. It is meant for real-time streams whose
+// stale messages are useless. NATS publishes without blocking, so a
+// message handed over in time is sent.
+func SendMsgWithDeadline(ctx context.Context, m interface{}, deadline time.Time) error {
+	s, ok := ctx.Value(serverStreamKey{}).(*serverStream)
+	if !ok {
+		return status.Error(codes.Internal, "nrpc: SendMsgWithDeadline needs the context of a handler")
+	}
+	return s.sendMsg(m, deadline)
+}
+
+// DroppedMessages returns how many messages SendMsgWithDeadline dropped
+// since the server started.
+func (s *Server) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// stale reports whether deadline, if set, has passed, and counts the
+// message dropped if so.
+func (s *serverStream) stale(deadline time.Time) bool {
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return false
+	}
+	atomic.AddUint64(&s.server.dropped, 1)
+	s.log.Infof("message dropped, its deadline passed %v ago", time.Since(deadline))
+	return true
+}
@@ -5,18 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
 	"github.com/cloudwebrtc/nats-grpc/pkg/utils"
 	"github.com/nats-io/nats.go"
-	log "github.com/pion/ion-log"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 // redefine grpc.serverMethodHandler as it is not exposed
@@ -27,7 +35,7 @@ type serverTransportStream struct {
 }
 
 func (s *serverTransportStream) Method() string {
-	return s.stream.method
+	return s.stream.fullMethod
 }
 func (s *serverTransportStream) SetHeader(md metadata.MD) error {
 	return s.stream.SetHeader(md)
@@ -42,80 +50,346 @@ func (s *serverTransportStream) SetTrailer(md metadata.MD) error {
 	return nil
 }
 
-func serverUnaryHandler(srv interface{}, handler serverMethodHandler) handlerFunc {
-	return func(s *serverStream) {
-		var interceptor grpc.UnaryServerInterceptor = nil
-		ctx := grpc.NewContextWithServerTransportStream(s.Context(), &serverTransportStream{stream: s})
-		if s.md != nil {
-			ctx = metadata.NewIncomingContext(ctx, s.md)
+func serverUnaryHandler(handler serverMethodHandler, push bool) handlerFunc {
+	return func(s *serverStream, srv interface{}) {
+		ctx := s.Context()
+		var p *unaryPusher
+		if push && !s.unary {
+			p = &unaryPusher{stream: s, sent: make(chan struct{})}
+			ctx = context.WithValue(ctx, unaryPusherKey{}, p)
 		}
-		response, err := handler(srv, ctx, s.RecvMsg, interceptor)
+		response, err := handler(srv, ctx, s.RecvMsg, s.unaryInt)
 		if s.ctx.Err() == nil {
 			if err != nil {
 				s.close(err)
 				return
 			}
 			if s.SendMsg(response) == nil {
+				if p != nil && p.isUsed() {
+					// the handler took over the stream, it ends with Close
+					close(p.sent)
+					return
+				}
 				s.close(err)
 			}
 		}
 	}
 }
 
-func serverStreamHandler(srv interface{}, handler grpc.StreamHandler) handlerFunc {
-	return func(s *serverStream) {
-		err := handler(srv, s)
+func serverStreamHandler(handler grpc.StreamHandler, info *grpc.StreamServerInfo) handlerFunc {
+	return func(s *serverStream, srv interface{}) {
+		var err error
+		if s.streamInt != nil {
+			err = s.streamInt(srv, s, info, handler)
+		} else {
+			err = handler(srv, s)
+		}
 		if s.ctx.Err() == nil {
+			// a nil err ends the stream with OK, which the client tells
+			// apart from an abort as io.EOF
 			s.close(err)
 		}
 	}
 }
 
-type handlerFunc func(s *serverStream)
+// handlerFunc serves a call on s with the service implementation srv.
+type handlerFunc func(s *serverStream, srv interface{})
+
+// methodHandler is a registered method, keyed by its subject.
+type methodHandler struct {
+	fullMethod string // gRPC method name, /service/method
+	fn         handlerFunc
+	info       *serviceInfo
+	bare       bool          // also accepts bare NATS requests, see WithBareNATSCompat
+	timeout    time.Duration // bound of the handler, see WithDefaultTimeout
+	recvBuffer int           // overrides the one of the service, see SetMethodRecvBuffer
+}
+
+// PanicFunc receives the report of a handler panic: the gRPC method, the
+// client nid, the incoming metadata, the recovered value and the stack.
+type PanicFunc func(method, pnid string, md metadata.MD, recovered interface{}, stack []byte)
+
+// MsgInfo describes a NATS message received by the server, before its
+// envelope is decoded.
+type MsgInfo struct {
+	Subject string
+	Reply   string
+	Size    int         // length of the payload in bytes
+	Header  nats.Header // a copy, nil when the message has no headers
+}
+
+// MsgObserver is called with every message received by the server, see
+// WithMsgObserver.
+type MsgObserver func(info MsgInfo)
 
 // serviceInfo wraps information about a service. It is very similar to
 // ServiceDesc and is constructed from it for internal purposes.
 type serviceInfo struct {
-	// Contains the implementation for the methods in this service.
+	name string // canonical service name from the ServiceDesc
+	// Contains the implementation for the methods in this service, guarded
+	// by Server.mu as SwapImplementation replaces it.
 	serviceImpl interface{}
+	handlerType reflect.Type // interface serviceImpl must implement
 	methods     map[string]*grpc.MethodDesc
 	streams     map[string]*grpc.StreamDesc
 	mdata       interface{}
+	recvBuffer  int // depth of the receive channel of its streams
+	codec       encoding.Codec
+	limiter     *rateLimiter // see WithServiceRateLimit
+	queueGroup  *string      // see WithServiceQueueGroup
+}
+
+// isAlias tells whether token, a key of Server.services, is a subject
+// alias of the service rather than its name, see WithSubjectAlias.
+func (info *serviceInfo) isAlias(token string) bool {
+	return token != info.name
 }
 
 // Server is the interface to gRPC over NATS
 type Server struct {
+	dropped  uint64 // messages dropped by SendMsgWithDeadline, first for atomic alignment
+	buffered int64  // bytes of stream data buffered, see WithMemoryBudget
 	nc       NatsConn
 	ctx      context.Context
 	cancel   context.CancelFunc
-	log      *logrus.Logger
-	handlers map[string]handlerFunc
+	log      Logger
+	handlers map[string]*methodHandler
 	streams  map[string]*serverStream
-	mu       sync.Mutex
+	mu       sync.RWMutex
 	subs     map[string]*nats.Subscription
 	nid      string
+	nids     []string                // every nid served, nid first, see AddNid, guarded by mu
 	services map[string]*serviceInfo // service name -> service info
+
+	// interceptors are guarded by mu and snapshotted when a call begins
+	unaryInt  grpc.UnaryServerInterceptor
+	streamInt grpc.StreamServerInterceptor
+
+	pushMethods      map[string]bool // full method name -> unary push enabled
+	onPanic          PanicFunc
+	recovery         func(ctx context.Context, p interface{}) error // see WithRecoveryHandler
+	unknown          grpc.StreamHandler                             // see WithUnknownStreamHandler
+	beginHook        func(method, reply, nid string)                // see WithStreamBeginHook
+	endHook          func(method, reply, nid string, st *status.Status)
+	metrics          Collector                       // see WithMetrics
+	prefix           string                          // first subject token(s), see WithSubjectPrefix
+	queueGroup       func(serviceName string) string // see WithQueueGroup
+	recvBuffer       int
+	recvOverflow     RecvOverflowPolicy
+	replyTTL         time.Duration
+	idleTimeout      time.Duration // see WithStreamIdleTimeout
+	defaultTimeout   time.Duration
+	statusHeader     bool
+	contentCodecs    map[string]encoding.Codec // content-subtype -> codec, see WithContentCodecs
+	rateLimits       map[string]*rateLimiter   // service name -> limiter, see WithServiceRateLimit
+	streamRateWindow time.Duration
+	streamRate       *rateCounter // streams started, see StreamRate
+	store            StreamStore
+	storeQueue       storeQueue // writes to store, see WithStreamStore
+	recorder         Recorder
+	cooldown         time.Duration // see WithEvictionCooldown
+	headerPolicy     HeaderWritePolicy
+	observer         MsgObserver
+	maxTrailerSize   int                   // see WithMaxTrailerSize
+	newID            IDGenerator           // mints missing call IDs, see WithIDGenerator
+	denied           map[string]deniedPeer // evicted peer nid -> refusal
+	recent           *recentReplies        // see WithDuplicateCallWindow
+	maxServices      int                   // see WithMaxServices
+	maxStreams       int                   // see WithMaxConcurrentStreams
+	memoryBudget     int64                 // see WithMemoryBudget
+	poolSize         int                   // see WithHandlerPool
+	poolQueue        int                   // see WithHandlerQueue
+	pool             *handlerPool
+
+	keepalive        time.Duration // ping interval, see WithKeepalive
+	keepaliveTimeout time.Duration
+	ackWindow        int // see WithAckWindow
+	chunkSize        int // see WithMaxChunkSize
+	maxRecvMsgSize   int // see WithMaxRecvMsgSize
+	maxSendMsgSize   int // see WithMaxSendMsgSize
+	ackResend        time.Duration
+	decorators       []ContextDecorator // see WithContextDecorator
+	marshal          proto.MarshalOptions
+
+	unimplemented func(method, pnid string)   // see OnUnimplemented, guarded by mu
+	hooks         []func(ctx context.Context) // see OnShutdown, guarded by mu
+	shutdownCtx   context.Context             // set once the hooks run, guarded by mu
+	shutdownOnce  sync.Once
+	stopOnce      sync.Once
+	stopping      int32         // 1 once Stop has begun, read atomically
+	draining      int32         // 1 once Drain has been called, read atomically
+	drained       chan struct{} // closed once the streams have ended, see GracefulStop, guarded by mu
 }
 
+// shutdownHookTimeout bounds the shutdown hooks run by Stop.
+const shutdownHookTimeout = 5 * time.Second
+
+// drainRetryDelay is the retry hint of the calls a draining server
+// refuses, short as another instance may serve them at once.
+const drainRetryDelay = 100 * time.Millisecond
+
+// draining is the status of the calls a draining server refuses, with
+// drainRetryDelay as an errdetails.RetryInfo for the clients that read the
+// details rather than the trailer.
+var draining = func() *status.Status {
+	st := status.New(codes.Unavailable, "nrpc: server draining")
+	withInfo, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(drainRetryDelay)})
+	if err != nil {
+		return st
+	}
+	return withInfo
+}()
+
 // NewServer creates a new Proxy
-func NewServer(nc NatsConn, nid string) *Server {
+func NewServer(nc NatsConn, nid string, opts ...ServerOption) *Server {
+	return NewServerWithContext(context.Background(), nc, nid, opts...)
+}
+
+// NewServerWithContext creates a server whose lifetime is bound to ctx:
+// once ctx ends, the server stops as with Stop, the contexts of its
+// handlers ending with it.
+func NewServerWithContext(ctx context.Context, nc NatsConn, nid string, opts ...ServerOption) *Server {
 	s := &Server{
 		nc:       nc,
-		handlers: make(map[string]handlerFunc),
+		handlers: make(map[string]*methodHandler),
 		streams:  make(map[string]*serverStream),
 		subs:     make(map[string]*nats.Subscription),
 		services: make(map[string]*serviceInfo),
-		log:      log.NewLoggerWithFields(log.DebugLevel, "nats-grpc.Server", log.Fields{"self-nid": nid}),
+		log:      newLogger(logrus.DebugLevel, Fields{"self-nid": nid}),
 		nid:      nid,
+		nids:     []string{nid},
+
+		prefix:           defaultPrefix,
+		recvBuffer:       defaultRecvBuffer,
+		maxRecvMsgSize:   defaultMaxRecvMsgSize,
+		newID:            NewID,
+		streamRateWindow: defaultStreamRateWindow,
+		ackResend:        defaultAckResend,
+		poolQueue:        defaultHandlerQueue,
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	for _, o := range opts {
+		o(s)
+	}
+	s.streamRate = newRateCounter(s.streamRateWindow)
+	if s.poolSize > 0 {
+		s.pool = newHandlerPool(s.poolSize, s.poolQueue)
+		go func() {
+			<-s.ctx.Done()
+			s.pool.close()
+		}()
+	}
+	if s.unknown != nil {
+		s.mu.Lock()
+		s.subscribeUnknown(nid)
+		s.mu.Unlock()
+	}
+	if ctx.Done() != nil {
+		go func() {
+			<-s.ctx.Done()
+			if ctx.Err() != nil {
+				s.Stop()
+			}
+		}()
 	}
-	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s
 }
 
-// Stop gracefully stops a Proxy
+// Stop stops the server: it removes its subscriptions, ends the streams
+// in progress with codes.Unavailable, their clients told so, and cancels
+// the contexts of their handlers. The sends the handlers start afterwards
+// fail. Stop may be called several times, and concurrently, the later
+// calls returning once the first one has.
 func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownHookTimeout)
+		defer cancel()
+		s.runShutdownHooks(ctx)
+		atomic.StoreInt32(&s.stopping, 1)
+		s.unsubscribe()
+		s.abortStreams(stopped)
+		s.cancel()
+	})
+}
+
+// abortStreams ends the streams in progress with st.
+func (s *Server) abortStreams(st *status.Status) int {
+	s.mu.RLock()
+	streams := make([]*serverStream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.mu.RUnlock()
+	for _, stream := range streams {
+		stream.abort(st, nil)
+	}
+	return len(streams)
+}
+
+// Drain makes the server refuse the calls that arrive from now on with
+// codes.Unavailable, "nrpc: server draining", and a retry delay of
+// drainRetryDelay, both as a retry hint, see WithHintedRetries, and as an
+// errdetails.RetryInfo, while the streams in progress go on. Calls keep
+// arriving until the subscriptions are removed, drain the server before
+// stopping it to spare them a handler that would be cancelled at once.
+// GracefulStop drains the server first.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// GracefulStop stops the server once its calls have ended: it drains and
+// unsubscribes so that no new call starts, waits for the streams in flight
+// to end, their handlers writing their responses and End as usual, and
+// then cancels what is left. It gives up waiting when ctx ends, and ends
+// the streams left with codes.Unavailable.
+//
+// Once unsubscribed, the server receives no more frames of its clients.
+// Unary and server-streaming calls have received them all and finish, but
+// client-streaming and bidirectional calls get nothing more, not even the
+// half-close of their client, and hang until ctx expires. Stop them first,
+// or give ctx a deadline.
+func (s *Server) GracefulStop(ctx context.Context) {
+	s.Drain()
+	hooksCtx, cancel := context.WithTimeout(ctx, shutdownHookTimeout)
+	defer cancel()
+	s.runShutdownHooks(hooksCtx)
+	s.unsubscribe()
+
+	s.mu.Lock()
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+	}
+	drained := s.drained
+	if len(s.streams) == 0 {
+		s.closeDrained()
+	}
+	s.mu.Unlock()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		n := s.abortStreams(stopped)
+		s.log.Warnf("GracefulStop: %v, aborted %v streams", ctx.Err(), n)
+	}
 	s.cancel()
-	for name, sub := range s.subs {
+}
+
+// closeDrained tells GracefulStop that the last stream has ended. It is
+// called with s.mu held.
+func (s *Server) closeDrained() {
+	select {
+	case <-s.drained:
+	default:
+		close(s.drained)
+	}
+}
+
+// unsubscribe removes the subscriptions of the services.
+func (s *Server) unsubscribe() {
+	s.mu.Lock()
+	subs := s.subs
+	s.subs = make(map[string]*nats.Subscription)
+	s.mu.Unlock()
+	for name, sub := range subs {
 		err := sub.Unsubscribe()
 		if err != nil {
 			s.log.Errorf("Unsubscribe [%v] failed %v", name, err)
@@ -123,57 +397,593 @@ func (s *Server) Stop() {
 	}
 }
 
+// OnShutdown registers fn to run once when the server stops, before its
+// subscriptions are removed so that fn can still publish. Hooks run in
+// reverse registration order, with a context bounded by the shutdown
+// deadline. A hook registered once the shutdown has begun runs immediately,
+// with the context of the shutdown, which may have ended.
+func (s *Server) OnShutdown(fn func(ctx context.Context)) {
+	s.mu.Lock()
+	if ctx := s.shutdownCtx; ctx != nil {
+		s.mu.Unlock()
+		fn(ctx)
+		return
+	}
+	s.hooks = append(s.hooks, fn)
+	s.mu.Unlock()
+}
+
+// OnUnimplemented sets fn to be called with the subject and the client nid
+// of every call of a method the server does not serve, before the call is
+// refused with codes.Unimplemented, replacing any previous one. Such calls
+// hint at clients and servers of different versions. fn is called on the
+// path of the call and must not block.
+func (s *Server) OnUnimplemented(fn func(method, pnid string)) {
+	s.mu.Lock()
+	s.unimplemented = fn
+	s.mu.Unlock()
+}
+
+// runShutdownHooks runs the hooks registered with OnShutdown, only the
+// first time it is called. Concurrent callers wait for the hooks to finish.
+func (s *Server) runShutdownHooks(ctx context.Context) {
+	s.shutdownOnce.Do(func() {
+		s.mu.Lock()
+		s.shutdownCtx = ctx
+		hooks := s.hooks
+		s.hooks = nil
+		s.mu.Unlock()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i](ctx)
+		}
+	})
+}
+
+// SetUnaryInterceptor replaces the interceptor applied to unary calls.
+//
+// It is safe to call while the server is handling traffic. Only calls that
+// begin after SetUnaryInterceptor returns use the new interceptor; calls
+// already in flight keep the one they started with. Pass nil to remove it.
+func (s *Server) SetUnaryInterceptor(i grpc.UnaryServerInterceptor) {
+	s.mu.Lock()
+	s.unaryInt = i
+	s.mu.Unlock()
+}
+
+// WithUnaryInterceptor installs interceptors on the unary calls, the first
+// one outermost. Given several times, the option chains the interceptors
+// after those already installed.
+func WithUnaryInterceptor(interceptors ...grpc.UnaryServerInterceptor) ServerOption {
+	return func(s *Server) {
+		for _, i := range interceptors {
+			s.unaryInt = chainUnaryInterceptors(s.unaryInt, i)
+		}
+	}
+}
+
+// chainUnaryInterceptors returns the interceptor calling inner within
+// outer.
+func chainUnaryInterceptors(outer, inner grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	if outer == nil {
+		return inner
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return outer(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return inner(ctx, req, info, handler)
+		})
+	}
+}
+
+// SetStreamInterceptor replaces the interceptor applied to streaming calls.
+//
+// The same rules as SetUnaryInterceptor apply: it is safe for concurrent
+// use and only affects streams that begin after it returns.
+func (s *Server) SetStreamInterceptor(i grpc.StreamServerInterceptor) {
+	s.mu.Lock()
+	s.streamInt = i
+	s.mu.Unlock()
+}
+
+// WithStreamInterceptor installs interceptors on the streaming calls, the
+// first one outermost. Given several times, the option chains the
+// interceptors after those already installed.
+func WithStreamInterceptor(interceptors ...grpc.StreamServerInterceptor) ServerOption {
+	return func(s *Server) {
+		for _, i := range interceptors {
+			s.streamInt = chainStreamInterceptors(s.streamInt, i)
+		}
+	}
+}
+
+// chainStreamInterceptors returns the interceptor calling inner within
+// outer.
+func chainStreamInterceptors(outer, inner grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	if outer == nil {
+		return inner
+	}
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return outer(srv, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+			return inner(srv, ss, info, handler)
+		})
+	}
+}
+
+// WithMsgObserver makes the server call fn with the subject, reply, size and
+// headers of every message it receives, before the envelope is decoded. It
+// is meant for transport level monitoring and sees the messages that are
+// later dropped as well. fn is called from the NATS subscription callback
+// and must not block.
+func WithMsgObserver(fn MsgObserver) ServerOption {
+	return func(s *Server) {
+		s.observer = fn
+	}
+}
+
+// observe passes the description of msg to the observer, if any.
+func (s *Server) observe(msg *nats.Msg) {
+	if s.observer == nil {
+		return
+	}
+	var header nats.Header
+	if msg.Header != nil {
+		header = make(nats.Header, len(msg.Header))
+		for k, v := range msg.Header {
+			header[k] = append([]string(nil), v...)
+		}
+	}
+	s.observer(MsgInfo{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Size:    len(msg.Data),
+		Header:  header,
+	})
+}
+
+// OnPanic installs fn to be called when a handler panics, after the panic
+// has been logged and before the call is ended with codes.Internal.
+func (s *Server) OnPanic(fn PanicFunc) {
+	s.mu.Lock()
+	s.onPanic = fn
+	s.mu.Unlock()
+}
+
+// WithRecoveryHandler sets fn to turn the value recovered from a handler
+// panic into the error the call ends with, after OnPanic has been called.
+// fn receives the context of the handler, a nil error keeps the default
+// codes.Internal one.
+func WithRecoveryHandler(fn func(ctx context.Context, p interface{}) error) ServerOption {
+	return func(s *Server) {
+		s.recovery = fn
+	}
+}
+
+// WithPanicHandler is WithRecoveryHandler for a fn that needs no context.
+func WithPanicHandler(fn func(p interface{}) error) ServerOption {
+	return WithRecoveryHandler(func(ctx context.Context, p interface{}) error {
+		return fn(p)
+	})
+}
+
+// evictedTrailer marks the trailer of the streams ended by EvictPeer.
+var evictedTrailer = metadata.Pairs("server-evicted", "true")
+
+type deniedPeer struct {
+	until  time.Time
+	status *status.Status
+}
+
+// EvictPeer closes every stream of the client nid with st and the trailer
+// "server-evicted: true", so the client learns why, and returns how many
+// there were. With WithEvictionCooldown, new calls from nid are refused
+// with the same status until the cooldown has passed.
+func (s *Server) EvictPeer(nid string, st *status.Status) int {
+	s.mu.Lock()
+	var streams []*serverStream
+	for _, stream := range s.streams {
+		if stream.pnid == nid {
+			streams = append(streams, stream)
+		}
+	}
+	if s.cooldown > 0 {
+		if s.denied == nil {
+			s.denied = make(map[string]deniedPeer)
+		}
+		s.denied[nid] = deniedPeer{until: time.Now().Add(s.cooldown), status: st}
+	}
+	s.mu.Unlock()
+	s.log.Infof("EvictPeer nid = %v, streams = %v, status = %v", nid, len(streams), st.Message())
+	for _, stream := range streams {
+		stream.abort(st, evictedTrailer)
+	}
+	return len(streams)
+}
+
+// ActiveClients returns the nids of the clients with open streams on the
+// server, each once, sorted.
+func (s *Server) ActiveClients() []string {
+	s.mu.Lock()
+	seen := make(map[string]bool)
+	for _, stream := range s.streams {
+		if len(stream.pnid) > 0 {
+			seen[stream.pnid] = true
+		}
+	}
+	s.mu.Unlock()
+	nids := make([]string, 0, len(seen))
+	for nid := range seen {
+		nids = append(nids, nid)
+	}
+	sort.Strings(nids)
+	return nids
+}
+
+// deniedStatus returns the status calls of nid are refused with, if it was
+// evicted during the cooldown. It is called with s.mu held.
+func (s *Server) deniedStatus(nid string) *status.Status {
+	d, ok := s.denied[nid]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(d.until) {
+		delete(s.denied, nid)
+		return nil
+	}
+	return d.status
+}
+
+// refuse ends a call before it has a stream.
+func (s *Server) refuse(reply string, st *status.Status, trailer metadata.MD) {
+	data, err := s.marshal.Marshal(&nrpc.Response{
+		Type: &nrpc.Response_End{
+			End: &nrpc.End{
+				Status:  st.Proto(),
+				Trailer: utils.MakeMetadata(trailer),
+			},
+		},
+	})
+	if err == nil {
+		err = s.publishEnd(reply, data, st.Code())
+	}
+	if err != nil {
+		s.log.Errorf("refuse call: %v", err)
+	}
+}
+
+// CloseStream cancels every stream of the client nid, without telling the
+// client, see EvictPeer.
 func (s *Server) CloseStream(nid string) error {
-	for name, st := range s.streams {
+	s.mu.Lock()
+	var streams []*serverStream
+	for _, st := range s.streams {
 		if st.pnid == nid {
-			st.done()
-			s.log.Infof("CloseStream nid = %v, name = %v", nid, name)
+			streams = append(streams, st)
 		}
 	}
+	s.mu.Unlock()
+	// done removes the stream, which takes s.mu
+	for _, st := range streams {
+		st.done()
+		s.log.Infof("CloseStream nid = %v, name = %v", nid, st.reply)
+	}
 	return nil
 }
 
-// RegisterService is used to register gRPC services
+// RegisterService is used to register gRPC services. It cannot report
+// errors, a service it fails to register is only logged, see
+// RegisterServiceWithOptions.
 func (s *Server) RegisterService(sd *grpc.ServiceDesc, ss interface{}) {
+	if err := s.RegisterServiceWithOptions(sd, ss); err != nil {
+		s.log.Errorf("RegisterService(%q) failed: %v", sd.ServiceName, err)
+	}
+}
+
+// RegisterServices registers impl as the implementation of every service
+// in sds, for types implementing several service interfaces. It checks
+// first that impl implements all of them and that none is registered yet,
+// and registers none otherwise, nor when one of them fails to subscribe.
+func (s *Server) RegisterServices(impl interface{}, sds ...*grpc.ServiceDesc) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	prefix := fmt.Sprintf("nrpc.%v", sd.ServiceName)
-	if len(s.nid) > 0 {
-		prefix = fmt.Sprintf("nrpc.%v.%v", s.nid, sd.ServiceName)
+	seen := make(map[string]bool)
+	for _, sd := range sds {
+		ht, err := handlerType(sd)
+		if err != nil {
+			return err
+		}
+		if impl == nil || !reflect.TypeOf(impl).Implements(ht) {
+			return fmt.Errorf("nrpc: %T does not implement %v", impl, ht)
+		}
+		if _, ok := s.services[sd.ServiceName]; ok || seen[sd.ServiceName] {
+			return fmt.Errorf("nrpc: service %q is already registered", sd.ServiceName)
+		}
+		seen[sd.ServiceName] = true
 	}
-	subject := prefix + ".>"
-	s.log.Infof("QueueSubscribe: subject => %v, queue => %v", subject, sd.ServiceName)
-	sub, _ := s.nc.QueueSubscribe(subject, sd.ServiceName, s.onMessage)
+	if n := s.serviceCount(); s.maxServices > 0 && n+len(sds) > s.maxServices {
+		return fmt.Errorf("nrpc: cannot register %d services, the server already hosts %d", len(sds), n)
+	}
+	infos := make([]*serviceInfo, 0, len(sds))
+	for _, sd := range sds {
+		info, err := s.registerLocked(sd, impl, s.serviceOptions())
+		if err != nil {
+			for i, info := range infos {
+				s.unregister(info, []string{sds[i].ServiceName})
+			}
+			return err
+		}
+		infos = append(infos, info)
+	}
+	if err := s.nc.Flush(); err != nil {
+		return fmt.Errorf("nrpc: the services are registered but their subscriptions may not be in place yet: flush: %v", err)
+	}
+	return nil
+}
+
+// handlerType returns the interface the implementation of sd must satisfy.
+func handlerType(sd *grpc.ServiceDesc) (reflect.Type, error) {
+	if sd == nil || sd.HandlerType == nil {
+		return nil, errors.New("nrpc: service description without a handler type")
+	}
+	t := reflect.TypeOf(sd.HandlerType)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Interface {
+		return nil, fmt.Errorf("nrpc: handler type of %q is %v, want a pointer to an interface", sd.ServiceName, t)
+	}
+	return t.Elem(), nil
+}
+
+// serviceOptions returns the settings of a service registered without
+// ServiceOption.
+func (s *Server) serviceOptions() serviceOptions {
+	return serviceOptions{
+		recvBuffer: s.recvBuffer,
+		codec:      protoCodec{opts: s.marshal},
+	}
+}
 
-	s.subs[sd.ServiceName] = sub
+// RegisterServiceWithOptions registers a gRPC service with settings that
+// apply to this service only, overriding the server wide ones. It fails,
+// registering nothing, when the service or one of its aliases is already
+// registered, when the server already hosts the maximum number of
+// services, see WithMaxServices, or when a subscription fails. It also
+// returns the error of the flush confirming the
+// subscriptions of the service, which stays registered: the connection
+// sends them again once it recovers.
+func (s *Server) RegisterServiceWithOptions(sd *grpc.ServiceDesc, ss interface{}, opts ...ServiceOption) error {
+	so := s.serviceOptions()
+	for _, o := range opts {
+		o(&so)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.registerLocked(sd, ss, so); err != nil {
+		return err
+	}
+	if err := s.nc.Flush(); err != nil {
+		return fmt.Errorf("nrpc: %q is registered but its subscriptions may not be in place yet: flush: %v", sd.ServiceName, err)
+	}
+	return nil
+}
+
+// registerLocked registers and subscribes sd, or nothing when it fails.
+// The caller holds s.mu.
+func (s *Server) registerLocked(sd *grpc.ServiceDesc, ss interface{}, so serviceOptions) (*serviceInfo, error) {
+	ht, err := handlerType(sd)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	if _, ok := s.services[sd.ServiceName]; !ok || len(so.aliases) == 0 {
+		tokens = append(tokens, sd.ServiceName)
+		if n := s.serviceCount(); s.maxServices > 0 && n >= s.maxServices {
+			return nil, fmt.Errorf("nrpc: cannot register %q, the server already hosts %d services", sd.ServiceName, n)
+		}
+	}
+	tokens = append(tokens, so.aliases...)
+	info, err := s.register(sd, ht, ss, so, tokens)
+	if err != nil {
+		return nil, err
+	}
+	for i, token := range tokens {
+		if err := s.subscribe(sd, so, info, token); err != nil {
+			s.unregister(info, tokens[:i+1])
+			return nil, fmt.Errorf("nrpc: cannot register %q: subscribe: %v", sd.ServiceName, err)
+		}
+	}
+	return info, nil
+}
+
+// serviceCount returns the number of services registered, not counting
+// their aliases. The caller holds s.mu.
+func (s *Server) serviceCount() int {
+	n := 0
+	for token, info := range s.services {
+		if !info.isAlias(token) {
+			n++
+		}
+	}
+	return n
+}
+
+// subscribe serves the methods of sd under the service token of the
+// subjects of every nid.
+func (s *Server) subscribe(sd *grpc.ServiceDesc, so serviceOptions, info *serviceInfo, token string) error {
+	handlers := make(map[string]*methodHandler) // method name -> handler
 	for _, it := range sd.Methods {
 		desc := it
-		path := fmt.Sprintf("%v.%v", prefix, desc.MethodName)
-		s.handlers[path] = serverUnaryHandler(ss, serverMethodHandler(desc.Handler))
-		s.log.Infof("RegisterService: method path => %v", path)
+		fullMethod := fmt.Sprintf("/%v/%v", sd.ServiceName, desc.MethodName)
+		handlers[desc.MethodName] = &methodHandler{
+			fullMethod: fullMethod,
+			fn:         serverUnaryHandler(serverMethodHandler(desc.Handler), s.pushMethods[fullMethod]),
+			info:       info,
+			bare:       so.bareAll || so.bare[desc.MethodName],
+			timeout:    so.timeout(s.defaultTimeout, desc.MethodName),
+		}
 	}
 	for _, it := range sd.Streams {
 		desc := it
-		path := fmt.Sprintf("%v.%v", prefix, desc.StreamName)
-		s.handlers[path] = serverStreamHandler(ss, desc.Handler)
-		s.log.Infof("RegisterService: stream path => %v", path)
+		fullMethod := fmt.Sprintf("/%v/%v", sd.ServiceName, desc.StreamName)
+		handlers[desc.StreamName] = &methodHandler{
+			fullMethod: fullMethod,
+			fn: serverStreamHandler(desc.Handler, &grpc.StreamServerInfo{
+				FullMethod:     fullMethod,
+				IsClientStream: desc.ClientStreams,
+				IsServerStream: desc.ServerStreams,
+			}),
+			info:    info,
+			timeout: so.timeout(s.defaultTimeout, desc.StreamName),
+		}
+	}
+	for _, nid := range s.nids {
+		if err := s.subscribeNid(nid, token, info, handlers); err != nil {
+			return err
+		}
 	}
-	s.nc.Flush()
+	return nil
+}
 
-	s.register(sd, ss)
+// subscribeNid serves handlers of info, keyed by method name, under the
+// service token of the subjects of nid. The caller holds s.mu.
+func (s *Server) subscribeNid(nid, token string, info *serviceInfo, handlers map[string]*methodHandler) error {
+	prefix := s.subjectPrefix(nid, token)
+	subject := prefix + ".>"
+	queue := token
+	if info.queueGroup != nil {
+		queue = *info.queueGroup
+	} else if s.queueGroup != nil {
+		queue = s.queueGroup(token)
+	}
+	s.log.Infof("QueueSubscribe: subject => %v, queue => %v", subject, queue)
+	sub, err := s.nc.QueueSubscribe(subject, queue, s.onMessage)
+	if err != nil {
+		return err
+	}
+
+	s.subs[prefix] = sub
+	for name, h := range handlers {
+		path := fmt.Sprintf("%v.%v", prefix, name)
+		s.handlers[path] = h
+		s.log.Infof("RegisterService: method path => %v", path)
+	}
+	return nil
 }
 
-func (s *Server) register(sd *grpc.ServiceDesc, ss interface{}) {
+// UnregisterService takes down the service registered as serviceName along
+// with its subject aliases: new calls no longer reach it, and its streams in
+// progress end with codes.Unavailable. The service can be registered again.
+func (s *Server) UnregisterService(serviceName string) error {
+	s.mu.Lock()
+	info, ok := s.services[serviceName]
+	if !ok || info.name != serviceName {
+		s.mu.Unlock()
+		return fmt.Errorf("nrpc: service %q is not registered", serviceName)
+	}
+	var tokens []string
+	for token, i := range s.services {
+		if i == info {
+			tokens = append(tokens, token)
+		}
+	}
+	var streams []*serverStream
+	for _, stream := range s.streams {
+		if h, ok := s.handlers[stream.method]; ok && h.info == info {
+			streams = append(streams, stream)
+		}
+	}
+	s.unregister(info, tokens)
+	s.mu.Unlock()
+	s.log.Infof("UnregisterService(%q), streams = %v", serviceName, len(streams))
+	for _, stream := range streams {
+		stream.abort(status.Newf(codes.Unavailable, "nrpc: service %q was unregistered", serviceName), nil)
+	}
+	return nil
+}
+
+// unregister removes info, subscribed under tokens, when it fails midway
+// or is unregistered. The caller holds s.mu.
+func (s *Server) unregister(info *serviceInfo, tokens []string) {
+	for _, nid := range s.nids {
+		for _, token := range tokens {
+			prefix := s.subjectPrefix(nid, token)
+			if sub, ok := s.subs[prefix]; ok {
+				sub.Unsubscribe()
+				delete(s.subs, prefix)
+			}
+		}
+	}
+	for path, h := range s.handlers {
+		if h.info == info {
+			delete(s.handlers, path)
+		}
+	}
+	for token, i := range s.services {
+		if i == info {
+			delete(s.services, token)
+		}
+	}
+}
+
+// SetMethodRecvBuffer sets how many received messages each new stream of
+// fullMethod, named like "/echo.Echo/SayHello", buffers until its handler
+// reads them, overriding WithStreamRecvBuffer and WithServiceRecvBuffer.
+func (s *Server) SetMethodRecvBuffer(fullMethod string, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("nrpc: invalid receive buffer of %d messages", n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for _, h := range s.handlers {
+		if h.fullMethod == fullMethod {
+			h.recvBuffer = n
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("nrpc: method %q is not registered", fullMethod)
+	}
+	return nil
+}
+
+// SwapImplementation replaces the implementation of the service registered
+// under serviceName, its name or one of its subject aliases, for new calls.
+// Calls in flight complete with the implementation they started with.
+func (s *Server) SwapImplementation(serviceName string, newImpl interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.services[serviceName]
+	if !ok {
+		return fmt.Errorf("nrpc: service %q is not registered", serviceName)
+	}
+	if newImpl == nil || !reflect.TypeOf(newImpl).Implements(info.handlerType) {
+		return fmt.Errorf("nrpc: %T does not implement %v", newImpl, info.handlerType)
+	}
+	info.serviceImpl = newImpl
+	return nil
+}
+
+// subjectPrefix returns the subject prefix of the methods of a service.
+func (s *Server) subjectPrefix(nid, token string) string {
+	return buildSubject(s.prefix, nid, token)
+}
+
+func (s *Server) register(sd *grpc.ServiceDesc, ht reflect.Type, ss interface{}, so serviceOptions, tokens []string) (*serviceInfo, error) {
 	s.log.Infof("RegisterService(%q)", sd.ServiceName)
 
-	if _, ok := s.services[sd.ServiceName]; ok {
-		s.log.Fatalf("grpc: Server.RegisterService found duplicate service registration for %q", sd.ServiceName)
+	for _, token := range tokens {
+		if _, ok := s.services[token]; ok {
+			return nil, fmt.Errorf("nrpc: duplicate service registration for %q", token)
+		}
 	}
 	info := &serviceInfo{
+		name:        sd.ServiceName,
 		serviceImpl: ss,
+		handlerType: ht,
 		methods:     make(map[string]*grpc.MethodDesc),
 		streams:     make(map[string]*grpc.StreamDesc),
 		mdata:       sd.Metadata,
+		recvBuffer:  so.recvBuffer,
+		codec:       so.codec,
+		limiter:     s.rateLimits[sd.ServiceName],
+		queueGroup:  so.queueGroup,
 	}
 	for i := range sd.Methods {
 		d := &sd.Methods[i]
@@ -183,12 +993,23 @@ func (s *Server) register(sd *grpc.ServiceDesc, ss interface{}) {
 		d := &sd.Streams[i]
 		info.streams[d.StreamName] = d
 	}
-	s.services[sd.ServiceName] = info
+	for _, token := range tokens {
+		s.services[token] = info
+	}
+	return info, nil
 }
 
+// GetServiceInfo returns the services registered, keyed by their proto
+// name, as grpc.Server does for reflection. A service is listed once, the
+// subject aliases of WithSubjectAlias are left out: Routes lists them.
 func (s *Server) GetServiceInfo() map[string]grpc.ServiceInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	ret := make(map[string]grpc.ServiceInfo)
 	for n, srv := range s.services {
+		if srv.isAlias(n) {
+			continue
+		}
 		methods := make([]grpc.MethodInfo, 0, len(srv.methods)+len(srv.streams))
 		for m := range srv.methods {
 			methods = append(methods, grpc.MethodInfo{
@@ -213,25 +1034,134 @@ func (s *Server) GetServiceInfo() map[string]grpc.ServiceInfo {
 	return ret
 }
 
+// Route is a subject the server answers on.
+type Route struct {
+	Subject    string // NATS subject of the method
+	Service    string // service token in the subject, canonical name or alias
+	FullMethod string // canonical gRPC method name, /service/method
+	Alias      bool   // Service is a subject alias, see WithSubjectAlias
+}
+
+// Routes lists the subjects of all registered methods, sorted by subject.
+// Unlike GetServiceInfo, it lists those served under a subject alias too.
+func (s *Server) Routes() []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := make([]Route, 0, len(s.handlers))
+	for _, nid := range s.nids {
+		for token, info := range s.services {
+			prefix := s.subjectPrefix(nid, token)
+			for subject, h := range s.handlers {
+				if strings.HasPrefix(subject, prefix+".") && !strings.Contains(subject[len(prefix)+1:], ".") {
+					routes = append(routes, Route{
+						Subject:    subject,
+						Service:    token,
+						FullMethod: h.fullMethod,
+						Alias:      info.isAlias(token),
+					})
+				}
+			}
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Subject < routes[j].Subject })
+	return routes
+}
+
 func (s *Server) onMessage(msg *nats.Msg) {
 	//p.log.Infof("Proxy.onMessage: subject %v, replay %v, data %v", msg.Subject, msg.Reply, string(msg.Data))
 	method := msg.Subject
-	log := s.log.WithField("method", method)
+	log := s.log.WithFields(Fields{"method": method})
+	s.record(true, msg.Subject, msg.Reply, msg.Data)
+	s.observe(msg)
+
+	request := &nrpc.Request{}
+	err := proto.Unmarshal(msg.Data, request)
 
 	s.mu.Lock()
+	h := s.handlers[method]
+	if h != nil && h.bare && s.isBare(msg, request, err) {
+		s.mu.Unlock()
+		s.serveBare(msg, h, log)
+		return
+	}
+	if err != nil {
+		s.mu.Unlock()
+		log.WithFields(Fields{"data": string(msg.Data)}).Errorf("unknown message")
+		return
+	}
 	stream, ok := s.streams[msg.Reply]
 	if !ok {
-		stream = newServerStream(s, method, msg.Reply, log)
+		call := request.GetCall()
+		if call == nil {
+			// late frame of a stream that has already ended
+			s.mu.Unlock()
+			log.Debugf("drop frame for unknown stream %v", msg.Reply)
+			return
+		}
+		if st := s.deniedStatus(call.Nid); st != nil {
+			s.mu.Unlock()
+			log.Infof("refuse call of evicted peer %v", call.Nid)
+			s.refuse(msg.Reply, st, evictedTrailer)
+			return
+		}
+		if s.recent != nil && s.recent.endedWithin(msg.Reply, time.Now()) {
+			s.mu.Unlock()
+			log.Infof("refuse duplicate call on %v", msg.Reply)
+			s.refuse(msg.Reply, status.Newf(codes.AlreadyExists, "nrpc: a call on %v has just ended, likely a duplicate", msg.Reply), nil)
+			return
+		}
+		if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+			s.mu.Unlock()
+			log.Warnf("refuse call, %d streams in progress", s.maxStreams)
+			s.refuse(msg.Reply, status.Newf(codes.ResourceExhausted, "nrpc: the server serves its maximum of %d concurrent streams", s.maxStreams), nil)
+			return
+		}
+		recvBuffer := s.recvBuffer
+		if h != nil {
+			recvBuffer = h.info.recvBuffer
+			if h.recvBuffer > 0 {
+				recvBuffer = h.recvBuffer
+			}
+		}
+		stream = newServerStream(s, method, msg.Reply, log, recvBuffer)
+		// looked up under the lock, UnregisterService and AddNid write the
+		// handlers meanwhile
+		stream.handler = h
+		stream.pnid = call.Nid
+		stream.nid, _ = s.splitSubject(method)
 		s.streams[msg.Reply] = stream
+		if s.metrics != nil {
+			s.metrics.StreamsInFlight(len(s.streams))
+		}
+		s.mu.Unlock()
+		s.storeStream(stream)
+	} else {
+		s.mu.Unlock()
 	}
-	s.mu.Unlock()
-	go stream.onMessage(msg)
+	// frames are handled in arrival order on the subscription callback, a
+	// half-close must not overtake the data sent before it. The requests
+	// are queued by stream, a handler slow to read does not hold up the
+	// callback, see recvQueue.
+	stream.onMessage(msg, request)
 }
 
 func (s *Server) remove(reply string) {
 	s.mu.Lock()
+	_, ok := s.streams[reply]
+	if ok && s.recent != nil {
+		s.recent.add(reply, time.Now())
+	}
 	delete(s.streams, reply)
+	if ok && s.metrics != nil {
+		s.metrics.StreamsInFlight(len(s.streams))
+	}
+	if s.drained != nil && len(s.streams) == 0 {
+		s.closeDrained()
+	}
 	s.mu.Unlock()
+	if ok {
+		s.unstoreStream(reply)
+	}
 }
 
 var (
@@ -243,23 +1173,46 @@ var (
 )
 
 type serverStream struct {
-	ctx       context.Context
-	cancel    context.CancelFunc
-	server    *Server
-	log       *logrus.Entry
-	recvRead  <-chan []byte
-	recvWrite chan<- []byte
-	muWrite   sync.Mutex
-	hasBegun  bool
-	md        metadata.MD // recevied metadata from client
-	header    metadata.MD // send header to client
-	trailer   metadata.MD // send trialer to client
-	method    string
-	reply     string
-	pnid      string
-}
-
-func newServerStream(server *Server, method, reply string, log *logrus.Entry) *serverStream {
+	lastSeen   int64 // unix nanoseconds of the last frame received, first for atomic alignment
+	buffered   int64 // bytes of data buffered, see WithMemoryBudget
+	bytesSent  int64 // response payload bytes sent, see ActiveStreams
+	bytesRecv  int64 // request payload bytes read by the handler
+	started    time.Time
+	hooked     int32 // 1 once the begin hook ran, see WithStreamBeginHook
+	endOnce    sync.Once
+	reasonMu   sync.Mutex
+	reason     *status.Status // see StreamDoneReason, guarded by reasonMu
+	ctx        context.Context
+	cancel     context.CancelFunc
+	server     *Server
+	log        Logger
+	recvRead   <-chan []byte
+	recvWrite  chan<- []byte
+	recvQueue  recvQueue // the requests recvWrite has no room for yet
+	closedSend bool      // the client half-closed, read on the subscription callback only
+	hasBegun   bool
+	md         metadata.MD    // recevied metadata from client
+	header     metadata.MD    // send header to client
+	trailer    metadata.MD    // send trialer to client
+	method     string         // subject the call arrived on
+	handler    *methodHandler // of method when the call arrived, nil if none
+	fullMethod string
+	reply      string
+	pnid       string
+	nid        string // nid of the server the call arrived on, see AddNid
+	codec      encoding.Codec
+	unary      bool // the client reads a single response
+	unaryInt   grpc.UnaryServerInterceptor
+	streamInt  grpc.StreamServerInterceptor
+	bare       bool   // answers a bare NATS request, see writeBare
+	bareData   []byte // response payload of a bare request
+	ttl        *time.Timer
+	idle       *time.Timer // see WithStreamIdleTimeout
+	acks       *ackState   // the client acknowledges the responses, see WithStreamAcks
+	chunks     reassembly  // the request being received in chunks
+}
+
+func newServerStream(server *Server, method, reply string, log Logger, recvBuffer int) *serverStream {
 	s := &serverStream{
 		server: server,
 		log:    log,
@@ -267,14 +1220,50 @@ func newServerStream(server *Server, method, reply string, log *logrus.Entry) *s
 		reply:  reply,
 	}
 	s.ctx, s.cancel = context.WithCancel(server.ctx)
-	recv := make(chan []byte, 1)
+	s.started = time.Now()
+	server.streamRate.add(s.started)
+	recv := make(chan []byte, recvBuffer)
 	s.recvRead = recv
 	s.recvWrite = recv
 	return s
 }
 
+// expire ends a stream that outlived the reply TTL, see WithReplyTTL. The
+// handler may still be writing, so the End carries no trailer.
+func (s *serverStream) expire() {
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.log.Warnf("reply TTL of %v expired", s.server.replyTTL)
+	s.abort(status.Newf(codes.DeadlineExceeded, "nrpc: reply TTL of %v expired", s.server.replyTTL), nil)
+}
+
+// abort ends the stream from outside of its handler, which may still be
+// writing, so the End carries trailer instead of the one of the handler.
+func (s *serverStream) abort(st *status.Status, trailer metadata.MD) {
+	if !s.bare {
+		err := s.writeEnd(&nrpc.End{
+			Status:  st.Proto(),
+			Trailer: utils.MakeMetadata(trailer),
+		})
+		if err != nil {
+			s.log.Errorf("End not delivered: %v", err)
+		}
+	}
+	s.ended(st)
+	s.done()
+}
+
 func (s *serverStream) done() {
+	s.ended(canceled)
+	if s.ttl != nil {
+		s.ttl.Stop()
+	}
 	s.cancel()
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	s.releaseAll()
 	s.server.remove(s.reply)
 }
 
@@ -289,99 +1278,258 @@ func (s *serverStream) onRequest(msg *nats.Msg, request *nrpc.Request) {
 	case *nrpc.Request_End:
 		//s.log.WithField("end", r.End).Info("recv end")
 		s.processEnd(r.End)
+	case *nrpc.Request_Ping:
+		if !r.Ping.Pong {
+			s.writePing(true)
+		}
+	case *nrpc.Request_Ack:
+		if s.acks != nil {
+			s.release(s.acks.ack(r.Ack.Seq))
+		}
 	}
 }
 
 func (s *serverStream) processCall(call *nrpc.Call) {
-	s.log = s.log.WithField("method", s.method)
-	handlerFunc, ok := s.server.handlers[s.method]
+	s.log = s.log.WithFields(Fields{"method": s.method})
+	if atomic.LoadInt32(&s.server.draining) == 1 {
+		s.log.Infof("refuse call, the server is draining")
+		// another instance may serve it
+		s.SetTrailer(retryHint(drainRetryDelay, true))
+		s.close(draining.Err())
+		return
+	}
+	handler, ok := s.handler, s.handler != nil
+	if !ok && s.server.unknown != nil {
+		handler, ok = s.server.unknownHandler(s.nid, s.method), true
+	}
 	if !ok {
+		s.server.mu.Lock()
+		fn := s.server.unimplemented
+		s.server.mu.Unlock()
+		if fn != nil {
+			fn(s.method, s.pnid)
+		}
 		s.close(status.Error(codes.Unimplemented, codes.Unimplemented.String()))
 		return
 	}
+	if s.server.overBudget() {
+		s.log.Warnf("memory budget of %d bytes exhausted", s.server.memoryBudget)
+		s.close(status.Errorf(codes.ResourceExhausted, "nrpc: memory budget of %d bytes exhausted", s.server.memoryBudget))
+		return
+	}
+	if l := handler.info.limiter; l != nil && !l.allow() {
+		s.log.Warnf("rate limit of %v exceeded", handler.info.name)
+		s.close(status.Errorf(codes.ResourceExhausted, "nrpc: rate limit of service %v exceeded", handler.info.name))
+		return
+	}
 	// save metadata to context
 	if call.Metadata != nil {
-		md := make(metadata.MD)
-		for hdr, data := range call.Metadata.Md {
-			md[hdr] = data.Values
-		}
+		md := incomingMetadata(call.Metadata, s.log)
 		if s.md == nil {
 			s.md = md
 		} else if md != nil {
 			s.md = metadata.Join(s.md, md)
 		}
 	}
-	s.pnid = call.Nid
-	go handlerFunc(s)
+	var id string
+	if ids := s.md.Get(CallIDKey); len(ids) > 0 {
+		id = ids[0]
+	} else {
+		id = s.server.newID()
+		if s.md == nil {
+			s.md = metadata.MD{}
+		}
+		s.md.Set(CallIDKey, id)
+	}
+	s.codec = handler.info.codec
+	if ct := s.md.Get(contentTypeKey); len(ct) > 0 && !s.bare {
+		codec, err := s.server.contentCodec(s.codec, ct[0])
+		if err != nil {
+			s.close(err)
+			return
+		}
+		s.codec = codec
+	}
+	s.log = s.log.WithFields(Fields{"call-id": id})
+	s.unary = call.Unary
+	s.fullMethod = handler.fullMethod
+	// abort may end the stream at any time, s.cancel stays the one of the
+	// stream and ends the context of the handler, which derives from s.ctx
+	ctx := context.WithValue(context.WithValue(s.ctx, callIDKey{}, id), serverStreamKey{}, s)
+	ctx = metadata.NewIncomingContext(ctx, s.md)
+	ctx = grpc.NewContextWithServerTransportStream(ctx, &serverTransportStream{stream: s})
+	var watchDeadline func()
+	if deadline, ok := s.handlerDeadline(handler.timeout); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		deadlineCtx := ctx
+		watchDeadline = func() { s.watchDeadline(deadlineCtx, cancel) }
+	}
+	if len(s.server.decorators) > 0 {
+		ctx = s.decorate(ctx, s.server.decorators)
+	}
+	s.ctx = ctx
+	s.server.mu.Lock()
+	s.unaryInt, s.streamInt = s.server.unaryInt, s.server.streamInt
+	impl := handler.info.serviceImpl
+	if len(s.md.Get(StreamAcksKey)) > 0 && !s.unary && !s.bare {
+		// under the lock of the server, read by ActiveStreams
+		s.acks = newAckState(s.server.ackWindow)
+	}
+	s.server.mu.Unlock()
+	s.began()
+	if s.server.replyTTL > 0 {
+		s.ttl = time.AfterFunc(s.server.replyTTL, s.expire)
+	}
+	if s.server.idleTimeout > 0 {
+		s.idle = time.AfterFunc(s.server.idleTimeout, s.expireIdle)
+	}
+	if watchDeadline != nil {
+		// started once the stream is set up, it may abort it at once
+		go watchDeadline()
+	}
+	if s.server.keepalive > 0 {
+		go s.keepalive(s.server.keepalive, s.server.keepaliveTimeout)
+	}
+	if s.acks != nil {
+		go s.resendUnacked(s.server.ackResend)
+	}
+	s.server.runHandler(s, handler.fn, impl)
+}
+
+// runHandler invokes the handler and turns a panic into codes.Internal so a
+// faulty handler neither crashes the process nor leaves the client waiting.
+func (s *serverStream) runHandler(fn handlerFunc, srv interface{}) {
+	// the handler returns without ending the stream once its context is done
+	defer s.ended(canceled)
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		stack := debug.Stack()
+		s.log.WithFields(Fields{
+			"grpc-method": s.fullMethod,
+			"pnid":        s.pnid,
+			"md":          s.md,
+		}).Errorf("handler panic: %v\n%s", r, stack)
+		s.server.mu.Lock()
+		onPanic := s.server.onPanic
+		s.server.mu.Unlock()
+		if onPanic != nil {
+			onPanic(s.fullMethod, s.pnid, s.md.Copy(), r, stack)
+		}
+		err := status.Errorf(codes.Internal, "panic in handler: %v", r)
+		if s.server.recovery != nil {
+			if rerr := s.server.recovery(s.ctx, r); rerr != nil {
+				err = rerr
+			}
+		}
+		if s.ctx.Err() == nil {
+			s.close(err)
+		}
+	}()
+	fn(s, srv)
 }
 
 func (s *serverStream) processData(data *nrpc.Data) {
-	if s.recvWrite == nil {
-		s.log.Error("data received after client closeSend")
+	if s.closedSend {
+		s.log.Errorf("data received after client closeSend")
+		return
+	}
+	s.touch()
+	if !s.checkRecvSize(int(data.Offset) + len(data.Data)) {
+		return
+	}
+	if data.More && s.server.overBudget() {
+		s.log.Warnf("memory budget of %d bytes exhausted", s.server.memoryBudget)
+		s.abort(status.Newf(codes.ResourceExhausted, "nrpc: memory budget of %d bytes exhausted", s.server.memoryBudget), nil)
+		return
+	}
+	// counted before it is handed over, RecvMsg may release it at once
+	data, ok := s.addChunk(data)
+	if !ok {
 		return
 	}
-	s.recvWrite <- data.Data
+	if st := s.deliver(recvItem{data: data.Data}); st != nil {
+		s.abort(st, nil)
+		return
+	}
+	if s.ctx.Err() != nil {
+		// ended meanwhile, nobody reads it
+		s.releaseAll()
+	}
 }
 
 func (s *serverStream) processEnd(end *nrpc.End) {
+	s.touch()
 	if end.Status != nil {
-		s.log.WithField("status", end.Status).Info("cancel")
+		s.log.WithFields(Fields{"status": end.Status}).Infof("cancel")
+		s.ended(status.FromProto(end.Status))
 		s.done()
-	} else {
-		s.muWrite.Lock()
-		defer  s.muWrite.Unlock()
-		s.log.Info("closeSend")
-		if s.recvWrite !=nil {
-			s.recvWrite <- nil
-			close(s.recvWrite)
-			s.recvWrite = nil
-		}
+	} else if !s.closedSend {
+		s.log.Infof("closeSend")
+		s.closedSend = true
+		// queued behind the requests not delivered yet
+		s.deliver(recvItem{end: true})
 	}
 }
 
 func (s *serverStream) beginMaybe() error {
 	if !s.hasBegun {
 		s.hasBegun = true
-		if s.header != nil {
-			return s.writeBegin(&nrpc.Begin{
-				Header: utils.MakeMetadata(s.header),
-				Nid:    s.server.nid,
-			})
-		}
+		// sent even without a header, it tells the client the nid of the
+		// server that answers
+		return s.writeBegin(&nrpc.Begin{
+			Header: utils.MakeMetadata(s.header),
+			Nid:    s.nid,
+		})
 	}
 	return nil
 }
 
-func (s *serverStream) onMessage(msg *nats.Msg) {
-	request := &nrpc.Request{}
-	err := proto.Unmarshal(msg.Data, request)
-	if err != nil {
-		s.log.WithField("data", string(msg.Data)).Error("unknown message")
-	}
-
-	go s.onRequest(msg, request)
+func (s *serverStream) onMessage(msg *nats.Msg, request *nrpc.Request) {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+	s.onRequest(msg, request)
 }
 
 func (s *serverStream) close(err error) {
 	s.beginMaybe()
-	s.writeEnd(&nrpc.End{
-		Status:  status.Convert(err).Proto(),
-		Trailer: utils.MakeMetadata(s.trailer),
+	if s.acks != nil {
+		// the End must not overtake a response still to be resent
+		s.acks.wait(s.ctx)
+	}
+	st := status.Convert(err)
+	// the stream ends even when the End cannot be delivered, the client
+	// times out on its own
+	err = s.writeEnd(&nrpc.End{
+		Status:  st.Proto(),
+		Trailer: utils.MakeMetadata(s.truncateTrailer()),
 	})
+	if err != nil {
+		s.log.Errorf("End not delivered: %v", err)
+	}
+	s.ended(st)
 	s.done()
 }
 
-//
 // Server Stream interface
-//
+// Method returns the gRPC method of the call, /service/method.
 func (s *serverStream) Method() string {
-	return s.method
+	return s.fullMethod
 }
 
 func (s *serverStream) SetHeader(header metadata.MD) error {
 	if s.hasBegun {
+		if s.server.headerPolicy == HeaderLenient {
+			s.log.Warnf("header set after it was sent, dropped: %v", header)
+			return nil
+		}
 		return ErrIllegalHeaderWrite
 	}
+	if err := s.checkHeader(header); err != nil {
+		return err
+	}
 	if s.header == nil {
 		s.header = header
 	} else if header != nil {
@@ -404,49 +1552,88 @@ func (s *serverStream) SetTrailer(trailer metadata.MD) {
 	} else if trailer != nil {
 		s.trailer = metadata.Join(s.trailer, trailer)
 	}
+	if max := s.server.maxTrailerSize; max > 0 && metadataSize(s.trailer) > max {
+		s.log.Warnf("trailer of %d bytes exceeds the limit of %d and will be truncated", metadataSize(s.trailer), max)
+	}
 }
 
 func (s *serverStream) Context() context.Context {
 	return s.ctx
 }
 
-func (s *serverStream) SendMsg(m interface{}) (err error) {
+func (s *serverStream) SendMsg(m interface{}) error {
+	return s.sendMsg(m, time.Time{})
+}
+
+// sendMsg sends m, unless deadline is set and has passed by the time m is
+// ready to publish, see SendMsgWithDeadline.
+func (s *serverStream) sendMsg(m interface{}, deadline time.Time) (err error) {
+	if atomic.LoadInt32(&s.server.stopping) == 1 {
+		return stopped.Err()
+	}
+	select {
+	case <-s.ctx.Done():
+		// cancelled while the handler computed m, the stream has ended
+		return s.ctx.Err()
+	default:
+	}
+	if s.stale(deadline) {
+		return nil
+	}
 	defer func() {
-		if err != nil {
+		if err != nil && s.ctx.Err() == nil {
 			s.close(err)
 		}
 	}()
 
 	err = s.beginMaybe()
 	if err == nil {
-		data, err := proto.Marshal(m.(proto.Message))
-		if err == nil {
-			s.writeData(&nrpc.Data{
-				Data: data,
-			})
+		var data []byte
+		data, err = s.codec.Marshal(m)
+		if err != nil {
+			err = status.Errorf(codes.Internal, "nrpc: error while marshaling: %v", err)
+		} else if err = s.checkSendSize(len(data)); err != nil {
+			s.log.Warnf("%v", err)
+		} else if !s.stale(deadline) {
+			err = s.sendData(data)
+			if err == nil {
+				atomic.AddInt64(&s.bytesSent, int64(len(data)))
+			}
 		}
 	}
 	return
 }
 
+// Flush blocks until the NATS server has processed the messages sent so
+// far on the connection, which bounds how far a sender can get ahead.
+func (s *serverStream) Flush() error {
+	return s.server.nc.Flush()
+}
+
 func (s *serverStream) RecvMsg(m interface{}) error {
 	select {
 	case <-s.ctx.Done():
 		return s.ctx.Err()
 	case bytes, ok := <-s.recvRead:
-		if ok && bytes != nil {
-			return proto.Unmarshal(bytes, m.(proto.Message))
+		if ok {
+			s.release(len(bytes))
+			atomic.AddInt64(&s.bytesRecv, int64(len(bytes)))
+			return s.codec.Unmarshal(bytes, m)
 		}
 		return io.EOF
 	}
 }
 
 func (s *serverStream) writeResponse(response *nrpc.Response) error {
+	if s.bare {
+		return s.writeBare(response)
+	}
 	//s.log.WithField("response", response).Info("send")
-	data, err := proto.Marshal(response)
+	data, err := s.server.marshal.Marshal(response)
 	if err != nil {
 		return err
 	}
+	s.server.record(false, s.reply, "", data)
 	return s.server.nc.Publish(s.reply, data)
 }
 
@@ -459,17 +1646,32 @@ func (s *serverStream) writeBegin(begin *nrpc.Begin) error {
 }
 
 func (s *serverStream) writeData(data *nrpc.Data) error {
-	return s.writeResponse(&nrpc.Response{
-		Type: &nrpc.Response_Data{
-			Data: data,
-		},
+	s.touch()
+	size := 0
+	if !s.bare {
+		size = chunkSize(s.server.nc, s.server.chunkSize)
+	}
+	return writeChunks(data, size, func(data *nrpc.Data) error {
+		return s.writeResponse(&nrpc.Response{
+			Type: &nrpc.Response_Data{
+				Data: data,
+			},
+		})
 	})
 }
 
 func (s *serverStream) writeEnd(end *nrpc.End) error {
-	return s.writeResponse(&nrpc.Response{
+	response := &nrpc.Response{
 		Type: &nrpc.Response_End{
 			End: end,
 		},
-	})
+	}
+	if s.bare {
+		return s.writeResponse(response)
+	}
+	data, err := s.server.marshal.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return s.server.publishEnd(s.reply, data, codes.Code(end.Status.GetCode()))
 }
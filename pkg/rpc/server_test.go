@@ -0,0 +1,1872 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSetUnaryInterceptor(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var count int32
+	var method atomic.Value
+	s.SetUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt32(&count, 1)
+		method.Store(info.FullMethod)
+		return handler(ctx, req)
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+	}
+	if got, want := atomic.LoadInt32(&count), int32(3); got != want {
+		t.Fatalf("got %d intercepted calls, want %d", got, want)
+	}
+	if got, want := method.Load(), "/nrpctest.echo.Echo/Unary"; got != want {
+		t.Fatalf("got method %v, want %v", got, want)
+	}
+
+	s.SetUnaryInterceptor(nil)
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if got, want := atomic.LoadInt32(&count), int32(3); got != want {
+		t.Fatalf("got %d intercepted calls after removal, want %d", got, want)
+	}
+}
+
+func TestWithUnaryInterceptor(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	var mu sync.Mutex
+	var trace []string
+	intercept := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			mu.Lock()
+			trace = append(trace, name+" "+info.FullMethod)
+			mu.Unlock()
+			return handler(ctx, req)
+		}
+	}
+	cli, _ := echo.StartEchoServer(t, nc, "srv",
+		rpc.WithUnaryInterceptor(intercept("a"), intercept("b")),
+		rpc.WithUnaryInterceptor(intercept("c")))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := "[a /nrpctest.echo.Echo/Unary b /nrpctest.echo.Echo/Unary c /nrpctest.echo.Echo/Unary]"
+	if got := fmt.Sprint(trace); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestSetUnaryInterceptorInFlight(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var second int32
+	s.SetUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		close(entered)
+		<-release
+		return handler(ctx, req)
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"})
+		errc <- err
+	}()
+	<-entered
+	s.SetUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt32(&second, 1)
+		return handler(ctx, req)
+	})
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if got := atomic.LoadInt32(&second); got != 0 {
+		t.Fatalf("in-flight call observed the replacement interceptor %d times", got)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if got, want := atomic.LoadInt32(&second), int32(1); got != want {
+		t.Fatalf("got %d calls through replacement interceptor, want %d", got, want)
+	}
+}
+
+func TestSetStreamInterceptor(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+
+	var info *grpc.StreamServerInfo
+	called := make(chan struct{}, 1)
+	s.SetStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, i *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		info = i
+		called <- struct{}{}
+		return handler(srv, ss)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{Message: "ping"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	reply, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if reply.Message != "ping" {
+		t.Fatalf("got %q, want %q", reply.Message, "ping")
+	}
+	<-called
+	if info.FullMethod != "/nrpctest.echo.Echo/BidiStream" || !info.IsClientStream || !info.IsServerStream {
+		t.Fatalf("unexpected stream info %+v", info)
+	}
+}
+
+func TestSwapImplementation(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &versionedServer{version: "v1"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 4)
+	swapped := make(chan struct{})
+	for i := 0; i < cap(errc); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seenV2 := false
+			for n := 0; n < 50; n++ {
+				reply, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"})
+				if err != nil {
+					errc <- err
+					return
+				}
+				switch reply.Message {
+				case "v1:hello":
+					if seenV2 {
+						errc <- fmt.Errorf("got v1 after v2")
+						return
+					}
+				case "v2:hello":
+					seenV2 = true
+				default:
+					errc <- fmt.Errorf("unexpected reply %q", reply.Message)
+					return
+				}
+				if n == 10 {
+					<-swapped
+				}
+			}
+		}()
+	}
+	if err := s.SwapImplementation("nrpctest.echo.Echo", &versionedServer{version: "v2"}); err != nil {
+		t.Fatalf("SwapImplementation: %v", err)
+	}
+	close(swapped)
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Fatal(err)
+	}
+	reply, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"})
+	if err != nil || reply.Message != "v2:hello" {
+		t.Fatalf("got %v, %v, want v2:hello", reply, err)
+	}
+}
+
+func TestSwapImplementationInvalid(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	if err := s.SwapImplementation("nrpctest.echo.Echo", struct{}{}); err == nil {
+		t.Fatal("swapped in an implementation of the wrong type")
+	}
+	if err := s.SwapImplementation("nrpctest.echo.Echo", nil); err == nil {
+		t.Fatal("swapped in a nil implementation")
+	}
+	if err := s.SwapImplementation("unknown.Service", &echo.Server{}); err == nil {
+		t.Fatal("swapped the implementation of an unknown service")
+	}
+}
+
+func TestReplyTTL(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithReplyTTL(200*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// calls ending within the TTL are unaffected
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+
+	// activity does not extend the TTL
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	start := time.Now()
+	for {
+		if err := stream.Send(&echo.EchoRequest{Message: "ping"}); err != nil {
+			break
+		}
+		if _, err = stream.Recv(); err != nil {
+			if status.Code(err) != codes.DeadlineExceeded {
+				t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+			}
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("stream expired after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestEvictPeer(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv", rpc.WithEvictionCooldown(300*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	victim := rpc.NewClient(nc, "srv", "victim")
+	defer victim.Close()
+	cli := echo.NewEchoClient(victim)
+
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if n := s.EvictPeer("victim", status.New(codes.ResourceExhausted, "too many calls")); n != 1 {
+		t.Fatalf("evicted %d streams, want 1", n)
+	}
+	_, err = stream.Recv()
+	if st := status.Convert(err); st.Code() != codes.ResourceExhausted || st.Message() != "too many calls" {
+		t.Fatalf("got %v, want the eviction status", err)
+	}
+	if got := stream.Trailer().Get("server-evicted"); len(got) != 1 || got[0] != "true" {
+		t.Fatalf("got trailer %v, want server-evicted: true", stream.Trailer())
+	}
+
+	// refused during the cooldown, other peers are served
+	var trailer metadata.MD
+	_, err = cli.Unary(ctx, &echo.EchoRequest{}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.ResourceExhausted || len(trailer.Get("server-evicted")) != 1 {
+		t.Fatalf("got %v with trailer %v, want the eviction status", err, trailer)
+	}
+	other := rpc.NewClient(nc, "srv", "other")
+	defer other.Close()
+	if _, err := echo.NewEchoClient(other).Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary of another peer: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary after the cooldown: %v", err)
+	}
+}
+
+type lateHeaderServer struct {
+	echo.Server
+}
+
+func (l *lateHeaderServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	if err := grpc.SendHeader(ctx, metadata.Pairs("early", "1")); err != nil {
+		return nil, err
+	}
+	err := grpc.SetHeader(ctx, metadata.Pairs("late", "1"))
+	return &echo.EchoResponse{Message: fmt.Sprint(err)}, nil
+}
+
+func TestHeaderWritePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy rpc.HeaderWritePolicy
+		want   error
+	}{
+		{rpc.HeaderStrict, rpc.ErrIllegalHeaderWrite},
+		{rpc.HeaderLenient, nil},
+	} {
+		nc := nrpctest.RunNats(t)
+		cli, _ := echo.StartServer(t, nc, "srv", &lateHeaderServer{}, rpc.WithHeaderWritePolicy(tc.policy))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var header metadata.MD
+		reply, err := cli.Unary(ctx, &echo.EchoRequest{}, grpc.Header(&header))
+		if err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+		if reply.Message != fmt.Sprint(tc.want) {
+			t.Fatalf("got %v with policy %v, want %v", reply.Message, tc.policy, tc.want)
+		}
+		if len(header.Get("early")) != 1 || len(header.Get("late")) != 0 {
+			t.Fatalf("got header %v, want only the early one", header)
+		}
+	}
+}
+
+func TestMsgObserver(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	infos := make(chan rpc.MsgInfo, 16)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithMsgObserver(func(info rpc.MsgInfo) {
+		infos <- info
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	info := <-infos
+	if info.Subject != "nrpc.srv.nrpctest.echo.Echo.Unary" || info.Reply == "" || info.Size == 0 {
+		t.Fatalf("unexpected message %+v", info)
+	}
+
+	// messages that cannot be decoded are observed too
+	msg := nats.NewMsg("nrpc.srv.nrpctest.echo.Echo.Unary")
+	msg.Data = []byte("garbage")
+	msg.Header.Set("Trace-Id", "42")
+	if err := nc.PublishMsg(msg); err != nil {
+		t.Fatalf("PublishMsg: %v", err)
+	}
+	for info = range infos {
+		if info.Header != nil {
+			break
+		}
+	}
+	if info.Size != len("garbage") || info.Header.Get("Trace-Id") != "42" {
+		t.Fatalf("unexpected message %+v", info)
+	}
+}
+
+func TestOnShutdown(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+
+	var mu sync.Mutex
+	var order []int
+	for i := 1; i <= 3; i++ {
+		i := i
+		s.OnShutdown(func(ctx context.Context) {
+			if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) <= 0 {
+				t.Errorf("hook %d got deadline %v, %v", i, deadline, ok)
+			}
+			// the server is still subscribed
+			if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+				t.Errorf("Unary in hook %d: %v", i, err)
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+	if got, want := fmt.Sprint(order), "[3 2 1]"; got != want {
+		t.Fatalf("hooks ran in order %v, want %v", got, want)
+	}
+
+	late := false
+	s.OnShutdown(func(ctx context.Context) {
+		late = true
+	})
+	if !late {
+		t.Fatal("hook registered after the shutdown did not run")
+	}
+}
+
+// failingCodec fails every marshal.
+type failingCodec struct{}
+
+func (failingCodec) Marshal(v interface{}) ([]byte, error)      { return nil, errors.New("no marshal") }
+func (failingCodec) Unmarshal(data []byte, v interface{}) error { return nil }
+func (failingCodec) Name() string                               { return "failing" }
+
+func TestWarmup(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	if err := s.Warmup(); err != nil {
+		t.Fatalf("Warmup: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if reply, err := cli.Unary(ctx, &echo.EchoRequest{Message: "warm"}); err != nil || reply.Message != "warm" {
+		t.Fatalf("got %v, %v, want warm", reply, err)
+	}
+
+	// the codec of the service is warmed up
+	failing := rpc.NewServer(nc, "failing")
+	defer failing.Stop()
+	failing.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}, rpc.WithServiceCodec(failingCodec{}))
+	if err := failing.Warmup(); err == nil || !strings.Contains(err.Error(), "no marshal") {
+		t.Fatalf("got %v, want the error of the codec", err)
+	}
+}
+
+// sendLoopServer streams responses until Send fails, and reports its error.
+type sendLoopServer struct {
+	echo.Server
+	errs chan error
+}
+
+func (s *sendLoopServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	for i := int32(0); ; i++ {
+		if err := stream.Send(&echo.EchoResponse{Index: i}); err != nil {
+			s.errs <- err
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSendMsgCancelled(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &sendLoopServer{errs: make(chan error, 1)}
+	cli, _ := echo.StartServer(t, nc, "srv", impl)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	cancel()
+	select {
+	case err := <-impl.errs:
+		if err != context.Canceled {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("SendMsg kept sending after the cancellation")
+	}
+}
+
+func TestActiveClients(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var streams []echo.Echo_BidiStreamClient
+	for _, nid := range []string{"b", "a", "a"} {
+		cli := rpc.NewClient(nc, "srv", nid)
+		defer cli.Close()
+		stream, err := echo.NewEchoClient(cli).BidiStream(ctx)
+		if err != nil {
+			t.Fatalf("BidiStream: %v", err)
+		}
+		if err := stream.Send(&echo.EchoRequest{}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		streams = append(streams, stream)
+	}
+	if got := fmt.Sprint(s.ActiveClients()); got != "[a b]" {
+		t.Fatalf("got %v, want [a b]", got)
+	}
+
+	for _, stream := range streams {
+		stream.CloseSend()
+		stream.Recv()
+	}
+	for len(s.ActiveClients()) > 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %v after the streams ended, want none", s.ActiveClients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stalledServer never reads the requests of its bidirectional streams.
+type stalledServer struct {
+	echo.Server
+}
+
+func (*stalledServer) BidiStream(stream echo.Echo_BidiStreamServer) error {
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestActiveStreams(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &stalledServer{}, rpc.WithAckWindow(4, time.Minute))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bidi, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	// one request fills the receive buffer
+	if err := bidi.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	// never read, so the client acknowledges the first response only
+	if _, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: 10}, rpc.WithStreamAcks()); err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+
+	for {
+		stats := s.ActiveStreams()
+		var queued, unacked int
+		for _, st := range stats {
+			if strings.HasSuffix(st.Method, ".BidiStream") && st.RecvBuffer == 1 {
+				queued = st.Queued
+			}
+			unacked += st.Unacked
+		}
+		if len(stats) == 2 && queued == 1 && unacked == 4 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("got %+v, want a full recv buffer and 4 unacked responses", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &stalledServer{}, rpc.WithMemoryBudget(16))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bidiCtx, bidiCancel := context.WithCancel(ctx)
+	bidi, err := cli.BidiStream(bidiCtx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := bidi.Send(&echo.EchoRequest{Message: "more than sixteen bytes"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for s.BufferedBytes() < 16 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d bytes buffered, want the unread request", s.BufferedBytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+
+	// the data of the ended stream is released
+	bidiCancel()
+	for s.BufferedBytes() != 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d bytes buffered, want 0", s.BufferedBytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+func TestMemoryBudgetReleasedOnRead(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv", rpc.WithMemoryBudget(1<<20))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bidi, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := bidi.Send(&echo.EchoRequest{Message: "a request to count"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, err := bidi.Recv(); err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+	}
+	// every request was read, while the stream is open nothing is held
+	if n := s.BufferedBytes(); n != 0 {
+		t.Fatalf("got %d bytes buffered, want 0", n)
+	}
+}
+
+// pinger is a second service interface, implemented along with echo by
+// multiServer.
+type pinger interface {
+	Ping(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error)
+}
+
+var pingerDesc = grpc.ServiceDesc{
+	ServiceName: "test.Pinger",
+	HandlerType: (*pinger)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Ping",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := &echo.EchoRequest{}
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			return srv.(pinger).Ping(ctx, in)
+		},
+	}},
+}
+
+type multiServer struct {
+	echo.Server
+}
+
+func (*multiServer) Ping(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{Message: "pong"}, nil
+}
+
+func TestRegisterServices(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv")
+	defer s.Stop()
+
+	// echo.Server is no pinger, nothing is registered
+	if err := s.RegisterServices(&echo.Server{}, &echo.Echo_ServiceDesc, &pingerDesc); err == nil {
+		t.Fatal("registered an implementation missing a service")
+	}
+	if got := len(s.GetServiceInfo()); got != 0 {
+		t.Fatalf("got %d services, want none", got)
+	}
+	if err := s.RegisterServices(&multiServer{}, &echo.Echo_ServiceDesc, &grpc.ServiceDesc{ServiceName: "test.Untyped"}); err == nil {
+		t.Fatal("registered a service without handler type")
+	}
+	// the second service cannot subscribe, the first one is rolled back
+	bad := pingerDesc
+	bad.ServiceName = "test.Bad Pinger"
+	if err := s.RegisterServices(&multiServer{}, &echo.Echo_ServiceDesc, &bad); err == nil {
+		t.Fatal("registered a service whose subscription failed")
+	}
+	if got := len(s.GetServiceInfo()); got != 0 {
+		t.Fatalf("got %d services, want none", got)
+	}
+
+	if err := s.RegisterServices(&multiServer{}, &echo.Echo_ServiceDesc, &pingerDesc); err != nil {
+		t.Fatalf("RegisterServices: %v", err)
+	}
+	if err := s.RegisterServices(&multiServer{}, &pingerDesc); err == nil {
+		t.Fatal("registered a service twice")
+	}
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if reply, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{Message: "hi"}); err != nil || reply.Message != "hi" {
+		t.Fatalf("Unary: got %v, %v, want hi", reply, err)
+	}
+	reply := &echo.EchoResponse{}
+	if err := cli.Invoke(ctx, "/test.Pinger/Ping", &echo.EchoRequest{}, reply); err != nil || reply.Message != "pong" {
+		t.Fatalf("Ping: got %v, %v, want pong", reply, err)
+	}
+}
+
+func TestStreamRate(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	start := time.Now()
+	s := rpc.NewServer(nc, "srv", rpc.WithStreamRateWindow(time.Minute))
+	defer s.Stop()
+	s.RegisterService(&echo.Echo_ServiceDesc, &echo.Server{})
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		if _, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{}); err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+	}
+	// the server is younger than the window
+	if got, min := s.StreamRate(), 5/time.Since(start).Seconds(); got < min {
+		t.Fatalf("got %v streams per second, want at least %v", got, min)
+	}
+}
+
+// flushFailingConn fails every Flush.
+type flushFailingConn struct {
+	*nats.Conn
+}
+
+func (flushFailingConn) Flush() error {
+	return nats.ErrConnectionClosed
+}
+
+func TestRegisterFlushError(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(flushFailingConn{nc}, "srv")
+	defer s.Stop()
+	err := s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{})
+	if err == nil || !strings.Contains(err.Error(), nats.ErrConnectionClosed.Error()) {
+		t.Fatalf("got %v, want the flush error", err)
+	}
+	if got := len(s.GetServiceInfo()); got != 1 {
+		t.Fatalf("got %d services, want the service registered", got)
+	}
+}
+
+func TestOnUnimplemented(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	_, s := echo.StartEchoServer(t, nc, "srv")
+	type call struct{ method, pnid string }
+	calls := make(chan call, 1)
+	s.OnUnimplemented(func(method, pnid string) {
+		calls <- call{method, pnid}
+	})
+	cli := rpc.NewClient(nc, "srv", "old-client")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := cli.Invoke(ctx, "/nrpctest.echo.Echo/Removed", &echo.EchoRequest{}, &echo.EchoResponse{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("got %v, want Unimplemented", err)
+	}
+	select {
+	case c := <-calls:
+		if c.method != "nrpc.srv.nrpctest.echo.Echo.Removed" || c.pnid != "old-client" {
+			t.Fatalf("got %+v, want the subject and nid of the call", c)
+		}
+	default:
+		t.Fatal("hook not called before the refusal")
+	}
+}
+
+func TestSubjectPrefixAndLogger(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	echo.StartEchoServer(t, nc, "srv", rpc.WithSubjectPrefix("acme.rpc"), rpc.WithLogger(rpc.LogrusLogger(logger)))
+	if want := "subject => acme.rpc.srv.nrpctest.echo.Echo.>"; !strings.Contains(logs.String(), want) {
+		t.Fatalf("got logs %q, want %q", logs.String(), want)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cli := rpc.NewClient(nc, "srv", "cli", rpc.WithClientSubjectPrefix("acme.rpc"))
+	defer cli.Close()
+	if _, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+
+	other := rpc.NewClient(nc, "srv", "cli")
+	defer other.Close()
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := echo.NewEchoClient(other).Unary(short, &echo.EchoRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable from a client of the default prefix", err)
+	}
+}
+
+// countingServer counts its unary calls.
+type countingServer struct {
+	echo.Server
+	calls int32
+}
+
+func (s *countingServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return &echo.EchoResponse{}, nil
+}
+
+// queueConn records the queue groups subscribed with.
+type queueConn struct {
+	*nats.Conn
+	queues []string
+}
+
+func (c *queueConn) QueueSubscribe(subj, queue string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	c.queues = append(c.queues, queue)
+	return c.Conn.QueueSubscribe(subj, queue, cb)
+}
+
+func TestQueueGroup(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	conn := &queueConn{Conn: nc}
+	echo.StartEchoServer(t, conn, "srv", rpc.WithQueueGroup(func(service string) string {
+		return "staging." + service
+	}))
+	if got := fmt.Sprint(conn.queues); got != "[staging.nrpctest.echo.Echo]" {
+		t.Fatalf("got %v, want the group of the option", got)
+	}
+
+	// without a queue group every server answers every call
+	fanout := func(string) string { return "" }
+	a, b := &countingServer{}, &countingServer{}
+	cli, _ := echo.StartServer(t, nc, "fanout", a, rpc.WithQueueGroup(fanout))
+	echo.StartServer(t, nc, "fanout", b, rpc.WithQueueGroup(fanout))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	for atomic.LoadInt32(&a.calls) != 1 || atomic.LoadInt32(&b.calls) != 1 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d and %d calls, want 1 each", atomic.LoadInt32(&a.calls), atomic.LoadInt32(&b.calls))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cli.Unary(ctx, &echo.EchoRequest{DelayMs: 300})
+		errs <- err
+	}()
+	for len(s.ActiveStreams()) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the call never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	s.GracefulStop(ctx)
+	if err := <-errs; err != nil {
+		t.Fatalf("got %v, want the call in flight to complete", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("stopped after %v, want after the call ended", d)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := cli.Unary(short, &echo.EchoRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want no server for new calls", err)
+	}
+}
+
+// subscribeFailingConn fails the subscriptions of the subjects containing
+// fail.
+type subscribeFailingConn struct {
+	*nats.Conn
+	fail string
+}
+
+func (c subscribeFailingConn) QueueSubscribe(subj, queue string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	if strings.Contains(subj, c.fail) {
+		return nil, nats.ErrBadSubject
+	}
+	return c.Conn.QueueSubscribe(subj, queue, cb)
+}
+
+func TestRegisterServiceErrors(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	err := s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{})
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("got %v, want a duplicate registration error", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("got %v, want the first registration to serve", err)
+	}
+
+	failing := rpc.NewServer(subscribeFailingConn{nc, "broken"}, "srv2")
+	defer failing.Stop()
+	err = failing.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}, rpc.WithSubjectAlias("broken"))
+	if err == nil || !strings.Contains(err.Error(), nats.ErrBadSubject.Error()) {
+		t.Fatalf("got %v, want the subscribe error", err)
+	}
+	if got := len(failing.GetServiceInfo()); got != 0 {
+		t.Fatalf("got %d services, want none registered", got)
+	}
+	if err := failing.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}); err != nil {
+		t.Fatalf("got %v, want the service registrable again", err)
+	}
+}
+
+// unmarshalableServer answers with a string field of invalid UTF-8, which
+// proto refuses to marshal.
+type unmarshalableServer struct {
+	echo.Server
+	sendErr chan error
+}
+
+func (*unmarshalableServer) Unary(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{Message: "\xff"}, nil
+}
+
+func (s *unmarshalableServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	err := stream.Send(&echo.EchoResponse{Message: "\xff"})
+	s.sendErr <- err
+	return err
+}
+
+func TestSendMsgMarshalError(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &unmarshalableServer{sendErr: make(chan error, 1)}
+	cli, _ := echo.StartServer(t, nc, "srv", impl)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+	if err := <-impl.sendErr; status.Code(err) != codes.Internal {
+		t.Fatalf("Send returned %v, want Internal", err)
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	const limit = 20
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &stalledServer{}, rpc.WithMaxConcurrentStreams(limit))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	results := make(chan error, limit+10)
+	for i := 0; i < limit+10; i++ {
+		stream, err := cli.BidiStream(ctx)
+		if err != nil {
+			t.Fatalf("BidiStream: %v", err)
+		}
+		if err := stream.Send(&echo.EchoRequest{}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		go func() {
+			// only the refused streams end before the test does
+			_, err := stream.Recv()
+			results <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case err := <-results:
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Fatalf("got %v, want ResourceExhausted", err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("got %d refused streams, want 10", i)
+		}
+	}
+	select {
+	case err := <-results:
+		t.Fatalf("got %v, want the other streams to continue", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if got := len(s.ActiveStreams()); got != limit {
+		t.Fatalf("got %d streams, want %d", got, limit)
+	}
+}
+
+func TestRecvBurst(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	for _, tc := range []struct {
+		name   string
+		opts   []rpc.ServerOption
+		buffer int
+		want   codes.Code // status of the bursting stream, OK when it goes on
+	}{
+		{"deep-buffer", nil, 128, codes.OK},
+		{"queue", nil, 0, codes.OK},
+		{"fail", []rpc.ServerOption{rpc.WithRecvOverflowPolicy(rpc.RecvOverflowFail)}, 0, codes.ResourceExhausted},
+		{"budget", []rpc.ServerOption{rpc.WithMemoryBudget(64)}, 0, codes.ResourceExhausted},
+	} {
+		cli, s := echo.StartServer(t, nc, tc.name, &stalledServer{}, tc.opts...)
+		if tc.buffer > 0 {
+			if err := s.SetMethodRecvBuffer("/nrpctest.echo.Echo/BidiStream", tc.buffer); err != nil {
+				t.Fatalf("%v: SetMethodRecvBuffer: %v", tc.name, err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		burst, err := cli.BidiStream(ctx)
+		if err != nil {
+			t.Fatalf("%v: BidiStream: %v", tc.name, err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := burst.Send(&echo.EchoRequest{Message: "burst"}); err != nil {
+				t.Fatalf("%v: Send: %v", tc.name, err)
+			}
+		}
+		// the burst does not hold up the other calls of the service
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+			t.Fatalf("%v: Unary: %v", tc.name, err)
+		}
+		if tc.want != codes.OK {
+			if _, err := burst.Recv(); status.Code(err) != tc.want {
+				t.Fatalf("%v: got %v, want %v", tc.name, err, tc.want)
+			}
+			continue
+		}
+		for {
+			stats := s.ActiveStreams()
+			if len(stats) == 1 && stats[0].Queued == 100 {
+				break
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("%v: got %+v, want the burst queued", tc.name, stats)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestBeginWithoutHeader(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	cli := rpc.NewClient(nc, "srv", "cli")
+	defer cli.Close()
+	// a second subscription of the inboxes sees the responses of the call
+	sub, err := nc.SubscribeSync(nats.InboxPrefix + ">")
+	if err != nil {
+		t.Fatalf("SubscribeSync: %v", err)
+	}
+	defer sub.Unsubscribe()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	header := metadata.MD{}
+	if _, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{}, grpc.Header(&header)); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if len(header) != 0 {
+		t.Fatalf("got header %v, want none", header)
+	}
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("NextMsg: %v", err)
+	}
+	resp := &nrpc.Response{}
+	if err := proto.Unmarshal(msg.Data, resp); err != nil || resp.GetBegin().GetNid() != "srv" {
+		t.Fatalf("got %v, %v, want a Begin with the nid of the server", resp, err)
+	}
+}
+
+func TestUnregisterService(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &stalledServer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bidi, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := bidi.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for len(s.ActiveStreams()) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the stream never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.UnregisterService("nrpctest.echo.Missing"); err == nil {
+		t.Fatal("unregistered a service that is not registered")
+	}
+	if err := s.UnregisterService("nrpctest.echo.Echo"); err != nil {
+		t.Fatalf("UnregisterService: %v", err)
+	}
+	if _, err := bidi.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+	if got := len(s.GetServiceInfo()); got != 0 {
+		t.Fatalf("got %d services, want none", got)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := cli.Unary(short, &echo.EchoRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want no server for new calls", err)
+	}
+
+	if err := s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}); err != nil {
+		t.Fatalf("RegisterServiceWithOptions: %v", err)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+func TestUnregisterServiceDuringCalls(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// the calls between an unregistration and the next one fail
+				short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+				cli.Unary(short, &echo.EchoRequest{})
+				cancelShort()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.UnregisterService("nrpctest.echo.Echo"); err != nil {
+			t.Fatalf("UnregisterService: %v", err)
+		}
+		if err := s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{}); err != nil {
+			t.Fatalf("RegisterServiceWithOptions: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+func TestSubjectPrefixIsolation(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, prefix := range []string{"a.rpc", "b.rpc"} {
+		echo.StartServer(t, nc, "srv", &nidServer{nid: prefix}, rpc.WithSubjectPrefix(prefix))
+	}
+	for _, prefix := range []string{"a.rpc", "b.rpc"} {
+		cli := rpc.NewClient(nc, "srv", "cli", rpc.WithClientSubjectPrefix(prefix))
+		defer cli.Close()
+		for i := 0; i < 5; i++ {
+			resp, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{})
+			if err != nil || resp.Message != prefix {
+				t.Fatalf("got %v, %v, want the server of %v", resp, err, prefix)
+			}
+		}
+	}
+
+	// an invalid prefix is a programming error
+	for _, prefix := range []string{"", "my org.*", "a..b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("WithSubjectPrefix(%q) did not panic", prefix)
+				}
+			}()
+			rpc.WithSubjectPrefix(prefix)
+		}()
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("WithClientSubjectPrefix(%q) did not panic", prefix)
+				}
+			}()
+			rpc.WithClientSubjectPrefix(prefix)
+		}()
+	}
+}
+
+// tenantStream overrides the context of a stream.
+type tenantStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tenantStream) Context() context.Context {
+	return s.ctx
+}
+
+// tenantServer answers every request of a bidi stream with the tenant in
+// the context of the stream.
+type tenantServer struct {
+	echo.Server
+}
+
+func (*tenantServer) BidiStream(stream echo.Echo_BidiStreamServer) error {
+	for {
+		if _, err := stream.Recv(); err != nil {
+			return nil
+		}
+		tenant, _ := stream.Context().Value(tenantKey{}).(string)
+		if err := stream.Send(&echo.EchoResponse{Message: tenant}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestWithStreamInterceptor(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	infos := make(chan grpc.StreamServerInfo, 1)
+	cli, _ := echo.StartServer(t, nc, "srv", &tenantServer{}, rpc.WithStreamInterceptor(
+		func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			infos <- *info
+			return handler(srv, &tenantStream{ss, context.WithValue(ss.Context(), tenantKey{}, "acme")})
+		},
+		func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			// runs within the first one, on the stream it wrapped
+			tenant, _ := ss.Context().Value(tenantKey{}).(string)
+			return handler(srv, &tenantStream{ss, context.WithValue(ss.Context(), tenantKey{}, tenant+"/eu")})
+		}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.Message != "acme/eu" {
+		t.Fatalf("got %v, %v, want the tenant of the interceptors", resp, err)
+	}
+	stream.CloseSend()
+	info := <-infos
+	if info.FullMethod != "/nrpctest.echo.Echo/BidiStream" || !info.IsClientStream || !info.IsServerStream {
+		t.Fatalf("got %+v, want the info of BidiStream", info)
+	}
+}
+
+// idleServer echoes the requests of its bidirectional streams and closes
+// done once the context of one ends.
+type idleServer struct {
+	echo.Server
+	done chan struct{}
+}
+
+func (s *idleServer) BidiStream(stream echo.Echo_BidiStreamServer) error {
+	defer close(s.done)
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			<-stream.Context().Done()
+			return nil
+		}
+		if err := stream.Send(&echo.EchoResponse{Message: req.Message}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &idleServer{done: make(chan struct{})}
+	cli, s := echo.StartServer(t, nc, "srv", impl, rpc.WithStreamIdleTimeout(200*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// activity extends the timeout
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	for start := time.Now(); time.Since(start) < 600*time.Millisecond; {
+		if err := stream.Send(&echo.EchoRequest{Message: "ping"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := len(s.ActiveStreams()); n != 1 {
+		t.Fatalf("got %d active streams, want 1", n)
+	}
+
+	// a silent client loses its stream
+	start := time.Now()
+	select {
+	case <-impl.done:
+	case <-ctx.Done():
+		t.Fatal("the handler context did not end")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("stream expired after %v, want about 200ms", elapsed)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+	for len(s.ActiveStreams()) != 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d active streams, want 0", len(s.ActiveStreams()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGracefulStopServerStream(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	recvAll := func(stream echo.Echo_ServerStreamClient) (int, error) {
+		for n := 0; ; n++ {
+			if _, err := stream.Recv(); err != nil {
+				return n, err
+			}
+		}
+	}
+	startStream := func(cli echo.EchoClient, s *rpc.Server, count int32) echo.Echo_ServerStreamClient {
+		stream, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: count, DelayMs: 50})
+		if err != nil {
+			t.Fatalf("ServerStream: %v", err)
+		}
+		for len(s.ActiveStreams()) == 0 {
+			if ctx.Err() != nil {
+				t.Fatal("the call never arrived")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return stream
+	}
+
+	// the stream in flight completes, new calls find no server
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	stream := startStream(cli, s, 6)
+	s.GracefulStop(ctx)
+	if n, err := recvAll(stream); err != io.EOF || n != 6 {
+		t.Fatalf("got %d responses and %v, want 6 and %v", n, err, io.EOF)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := cli.Unary(short, &echo.EchoRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want no server for new calls", err)
+	}
+
+	// past the deadline of GracefulStop, the streams left are cancelled
+	cli, s = echo.StartEchoServer(t, nc, "srv2")
+	stream = startStream(cli, s, 100)
+	stopCtx, cancelStop := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelStop()
+	start := time.Now()
+	s.GracefulStop(stopCtx)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("stopped after %v, want after about 200ms", d)
+	}
+	if n, err := recvAll(stream); status.Code(err) != codes.Unavailable || n == 100 {
+		t.Fatalf("got %d responses and %v, want the stream cut short with %v", n, err, codes.Unavailable)
+	}
+}
+
+func TestCloseStreamConcurrent(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &stalledServer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// calls keep arriving and ending while CloseStream runs
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil {
+					t.Errorf("Unary: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := s.CloseStream("victim"); err != nil {
+			t.Fatalf("CloseStream: %v", err)
+		}
+	}
+	wg.Wait()
+
+	victim := rpc.NewClient(nc, "srv", "victim")
+	defer victim.Close()
+	stream, err := echo.NewEchoClient(victim).BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for len(s.ActiveClients()) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the call never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.CloseStream("victim")
+	if got := s.ActiveClients(); len(got) != 0 {
+		t.Fatalf("got active clients %v, want none", got)
+	}
+}
+
+func TestGetServiceInfoConcurrent(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	s := rpc.NewServer(nc, "srv")
+	defer s.Stop()
+
+	const services = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < services; i++ {
+			sd := echo.Echo_ServiceDesc
+			sd.ServiceName = fmt.Sprintf("svc%d.Echo", i)
+			if err := s.RegisterServiceWithOptions(&sd, &echo.Server{}); err != nil {
+				t.Errorf("RegisterServiceWithOptions: %v", err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for name, info := range s.GetServiceInfo() {
+			if len(info.Methods) != 4 {
+				t.Fatalf("%v: got %d methods, want 4", name, len(info.Methods))
+			}
+		}
+	}
+	if got := len(s.GetServiceInfo()); got != services {
+		t.Fatalf("got %d services, want %d", got, services)
+	}
+}
+
+// recvServer reports the error ending the reads of its client streams.
+type recvServer struct {
+	echo.Server
+	errs chan error
+}
+
+func (r *recvServer) ClientStream(stream echo.Echo_ClientStreamServer) error {
+	for {
+		if _, err := stream.Recv(); err != nil {
+			r.errs <- err
+			return err
+		}
+	}
+}
+
+func TestNewServerWithContext(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	parent, stop := context.WithCancel(context.Background())
+	defer stop()
+	s := rpc.NewServerWithContext(parent, nc, "srv")
+	defer s.Stop()
+	impl := &recvServer{errs: make(chan error, 1)}
+	echo.RegisterEchoServer(s, impl)
+	conn := rpc.NewClient(nc, "srv", "cli")
+	defer conn.Close()
+	cli := echo.NewEchoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.ClientStream(ctx)
+	if err != nil {
+		t.Fatalf("ClientStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for len(s.ActiveStreams()) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the call never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	select {
+	case err := <-impl.errs:
+		if err != context.Canceled {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+	case <-ctx.Done():
+		t.Fatal("RecvMsg did not return")
+	}
+
+	// the server no longer serves calls
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	if _, err := cli.Unary(short, &echo.EchoRequest{}); err == nil {
+		t.Fatal("a call succeeded once the server stopped")
+	}
+}
+
+func TestServiceQueueGroup(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	conn := &queueConn{Conn: nc}
+	s := rpc.NewServer(conn, "srv", rpc.WithQueueGroup(func(service string) string {
+		return "staging." + service
+	}))
+	defer s.Stop()
+	err := s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, &echo.Server{},
+		rpc.WithSubjectAlias("echo.Canary"), rpc.WithServiceQueueGroup("canary"))
+	if err != nil {
+		t.Fatalf("RegisterServiceWithOptions: %v", err)
+	}
+	if got := fmt.Sprint(conn.queues); got != "[canary canary]" {
+		t.Fatalf("got %v, want the group of the service option", got)
+	}
+
+	// with an empty group every server of the subject answers every call
+	a, b := &countingServer{}, &countingServer{}
+	for _, impl := range []*countingServer{a, b} {
+		s := rpc.NewServer(nc, "broadcast")
+		defer s.Stop()
+		if err := s.RegisterServiceWithOptions(&echo.Echo_ServiceDesc, impl, rpc.WithServiceQueueGroup("")); err != nil {
+			t.Fatalf("RegisterServiceWithOptions: %v", err)
+		}
+	}
+	cli := rpc.NewClient(nc, "broadcast", "cli")
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := echo.NewEchoClient(cli).Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	for atomic.LoadInt32(&a.calls) != 1 || atomic.LoadInt32(&b.calls) != 1 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d and %d calls, want 1 each", atomic.LoadInt32(&a.calls), atomic.LoadInt32(&b.calls))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestActiveStreamsTraffic(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	var sent, received int
+	for _, msg := range []string{"hello", "world!"} {
+		req := &echo.EchoRequest{Message: msg}
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		received += proto.Size(req)
+		sent += proto.Size(res)
+	}
+	if n := s.StreamCount(); n != 1 {
+		t.Fatalf("got %d streams, want 1", n)
+	}
+	for {
+		stats := s.ActiveStreams()
+		if len(stats) != 1 {
+			t.Fatalf("got %+v, want one stream", stats)
+		}
+		st := stats[0]
+		if st.Peer != echo.ClientNid || st.Started.Before(start) || time.Since(st.Started) > 5*time.Second {
+			t.Fatalf("got %+v, want the stream of %v started at %v", st, echo.ClientNid, start)
+		}
+		// the last response may reach the client before it is counted
+		if st.BytesSent == int64(sent) && st.BytesReceived == int64(received) {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("got %d bytes sent and %d received, want %d and %d", st.BytesSent, st.BytesReceived, sent, received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stream.CloseSend()
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	for s.StreamCount() != 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d streams, want 0", s.StreamCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failConn fails to publish the responses to the reply inboxes.
+type failConn struct {
+	*nats.Conn
+}
+
+var errPublish = errors.New("publish failed")
+
+func (c *failConn) Publish(subj string, data []byte) error {
+	if strings.HasPrefix(subj, nats.InboxPrefix) {
+		return errPublish
+	}
+	return c.Conn.Publish(subj, data)
+}
+
+func (c *failConn) PublishMsg(msg *nats.Msg) error {
+	return c.Publish(msg.Subject, msg.Data)
+}
+
+// sendErrServer reports the error of the first Send of its server streams.
+type sendErrServer struct {
+	echo.Server
+	errs chan error
+}
+
+func (s *sendErrServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	err := stream.Send(&echo.EchoResponse{})
+	s.errs <- err
+	return err
+}
+
+func TestSendMsgPublishError(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &sendErrServer{errs: make(chan error, 1)}
+	cli, s := echo.StartServer(t, &failConn{Conn: nc}, "srv", impl)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	stream, err := cli.ServerStream(short, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	select {
+	case err := <-impl.errs:
+		if err != errPublish {
+			t.Fatalf("got %v, want the publish error", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("handler not called")
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded without a response", err)
+	}
+	for s.StreamCount() > 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d streams, want the stream cleaned up", s.StreamCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamRecvBufferBacklog(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	const frames = 32
+	cli, _ := echo.StartServer(t, nc, "srv", &stalledServer{}, rpc.WithStreamRecvBuffer(frames))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bidi, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	for i := 0; i < frames; i++ {
+		if err := bidi.Send(&echo.EchoRequest{}); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+	// the frames the handler never reads fit in the buffer, so delivery
+	// goes on for the other calls of the service
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+}
+
+// lateSendServer sends once the context of its bidirectional streams is
+// done, and reports the error.
+type lateSendServer struct {
+	echo.Server
+	errs chan error
+}
+
+func (l *lateSendServer) BidiStream(stream echo.Echo_BidiStreamServer) error {
+	<-stream.Context().Done()
+	err := stream.Send(&echo.EchoResponse{})
+	l.errs <- err
+	return err
+}
+
+func TestStopConcurrent(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &lateSendServer{errs: make(chan error, 1)}
+	cli, s := echo.StartServer(t, nc, "srv", impl)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for s.StreamCount() == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the call never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+	select {
+	case err := <-impl.errs:
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("got %v from a send after Stop, want Unavailable", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("handler still running")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.BidiStream(ctx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{Message: "before"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	s.Drain()
+	var trailer metadata.MD
+	_, err = cli.Unary(ctx, &echo.EchoRequest{}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.Unavailable || status.Convert(err).Message() != "nrpc: server draining" {
+		t.Fatalf("got %v, want Unavailable from a draining server", err)
+	}
+	if delay, retriable, ok := rpc.RetryHint(trailer); !ok || !retriable || delay <= 0 {
+		t.Fatalf("got retry hint %v, %v, %v, want a delay to retry after", delay, retriable, ok)
+	}
+	details := status.Convert(err).Details()
+	if len(details) != 1 {
+		t.Fatalf("got details %v, want a RetryInfo", details)
+	}
+	if info, ok := details[0].(*errdetails.RetryInfo); !ok || info.GetRetryDelay().AsDuration() <= 0 {
+		t.Fatalf("got detail %v, want a RetryInfo with a delay", details[0])
+	}
+	// the stream in progress goes on
+	if err := stream.Send(&echo.EchoRequest{Message: "after"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.Message != "after" {
+		t.Fatalf("got %v, %v, want the response of the stream", resp, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want %v", err, io.EOF)
+	}
+	for s.StreamCount() > 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d streams, want the refused call forgotten", s.StreamCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrainRetriedElsewhere(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, old := echo.StartEchoServer(t, nc, "srv")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a rolling restart: the old instance drains, then leaves to a new one
+	old.Drain()
+	errc := make(chan error, 1)
+	go func() {
+		// refused by the old instance, retried until the new one serves it
+		_, err := cli.Unary(ctx, &echo.EchoRequest{}, rpc.WithHintedRetries(3), grpc.WaitForReady(true))
+		errc <- err
+	}()
+	// the new instance subscribes once the call has been refused
+	time.Sleep(50 * time.Millisecond)
+	old.GracefulStop(ctx)
+	echo.StartEchoServer(t, nc, "srv")
+	if err := <-errc; err != nil {
+		t.Fatalf("Unary: %v, want it retried on the new instance", err)
+	}
+}
@@ -0,0 +1,33 @@
+package rpc
+
+import (
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+)
+
+// WithStatusHeader sets the BareStatusHeader NATS header of the End of
+// every call, refusals included, to its status code, so that monitoring
+// subscribed to reply subjects can count errors without decoding the
+// payloads. The End is published without it when the NATS connection or
+// server lacks header support.
+func WithStatusHeader() ServerOption {
+	return func(s *Server) {
+		s.statusHeader = true
+	}
+}
+
+// publishEnd publishes data, a marshaled End of status code, to reply.
+func (s *Server) publishEnd(reply string, data []byte, code codes.Code) error {
+	s.record(false, reply, "", data)
+	if nc, ok := s.nc.(interface{ PublishMsg(*nats.Msg) error }); ok && s.statusHeader {
+		msg := nats.NewMsg(reply)
+		msg.Data = data
+		msg.Header.Set(BareStatusHeader, strconv.Itoa(int(code)))
+		if err := nc.PublishMsg(msg); err != nats.ErrHeadersNotSupported {
+			return err
+		}
+	}
+	return s.nc.Publish(reply, data)
+}
@@ -0,0 +1,53 @@
+package rpc_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStatusHeader(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithStatusHeader())
+	replies := make(chan *nats.Msg, 16)
+	sub, err := nc.ChanSubscribe(nats.InboxPrefix+">", replies)
+	if err != nil {
+		t.Fatalf("ChanSubscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, code := range []codes.Code{codes.OK, codes.NotFound} {
+		cli.Unary(ctx, &echo.EchoRequest{ErrorCode: int32(code)})
+		for {
+			var msg *nats.Msg
+			select {
+			case msg = <-replies:
+			case <-ctx.Done():
+				t.Fatalf("no End for %v", code)
+			}
+			var resp nrpc.Response
+			if err := proto.Unmarshal(msg.Data, &resp); err != nil || resp.GetEnd() == nil {
+				if got := msg.Header.Get(rpc.BareStatusHeader); got != "" {
+					t.Fatalf("got status header %q on a message other than End", got)
+				}
+				continue
+			}
+			if got := msg.Header.Get(rpc.BareStatusHeader); got != strconv.Itoa(int(code)) {
+				t.Fatalf("got status header %q, want %d", got, code)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// completionServer streams ResponseCount responses, none included, then
+// returns the status of ErrorCode, nil when OK.
+type completionServer struct {
+	echo.Server
+}
+
+func (*completionServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	for i := int32(0); i < req.ResponseCount; i++ {
+		if err := stream.Send(&echo.EchoResponse{Index: i}); err != nil {
+			return err
+		}
+	}
+	if code := codes.Code(req.ErrorCode); code != codes.OK {
+		return status.Error(code, "aborted by the handler")
+	}
+	return nil
+}
+
+func TestServerStreamCompletion(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartServer(t, nc, "srv", &completionServer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		count int32
+		code  codes.Code
+	}{
+		{0, codes.OK},
+		{3, codes.OK},
+		{0, codes.Aborted},
+		{2, codes.Aborted},
+	} {
+		stream, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: tc.count, ErrorCode: int32(tc.code)})
+		if err != nil {
+			t.Fatalf("ServerStream: %v", err)
+		}
+		for i := int32(0); i < tc.count; i++ {
+			if resp, err := stream.Recv(); err != nil || resp.Index != i {
+				t.Fatalf("%d, %v: got %v, %v, want response %d", tc.count, tc.code, resp, err, i)
+			}
+		}
+		// the end is reported the same way on every further Recv
+		for i := 0; i < 2; i++ {
+			_, err := stream.Recv()
+			if tc.code == codes.OK && err != io.EOF {
+				t.Fatalf("%d, %v: got %v, want io.EOF", tc.count, tc.code, err)
+			}
+			if tc.code != codes.OK && (err == io.EOF || status.Code(err) != tc.code) {
+				t.Fatalf("%d, %v: got %v, want %v", tc.count, tc.code, err, tc.code)
+			}
+		}
+	}
+}
+
+// freshServer streams ResponseCount responses, the even ones with a
+// deadline a minute away and the odd ones with a deadline DelayMs
+// milliseconds away, negative for one already past.
+type freshServer struct {
+	echo.Server
+}
+
+func (*freshServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	for i := int32(0); i < req.ResponseCount; i++ {
+		deadline := time.Now().Add(time.Duration(req.DelayMs) * time.Millisecond)
+		if i%2 == 0 {
+			deadline = time.Now().Add(time.Minute)
+		}
+		if err := rpc.SendMsgWithDeadline(stream.Context(), &echo.EchoResponse{Index: i}, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSendMsgWithDeadline(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, s := echo.StartServer(t, nc, "srv", &freshServer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the odd responses are stale
+	stream, err := cli.ServerStream(ctx, &echo.EchoRequest{ResponseCount: 4, DelayMs: -1})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	for _, want := range []int32{0, 2} {
+		if resp, err := stream.Recv(); err != nil || resp.Index != want {
+			t.Fatalf("got %v, %v, want response %d", resp, err, want)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	if n := s.DroppedMessages(); n != 2 {
+		t.Fatalf("got %d dropped messages, want 2", n)
+	}
+
+	err = rpc.SendMsgWithDeadline(ctx, &echo.EchoResponse{}, time.Now().Add(time.Minute))
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("outside of a handler: got %v, want %v", err, codes.Internal)
+	}
+}
+
+// orderedServer fails a client stream whose requests do not carry the
+// messages 0, 1, 2 and so on. It reads once start is closed.
+type orderedServer struct {
+	echo.Server
+	start chan struct{}
+}
+
+func (o *orderedServer) ClientStream(stream echo.Echo_ClientStreamServer) error {
+	<-o.start
+	n := int32(0)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&echo.EchoResponse{Index: n})
+		}
+		if err != nil {
+			return err
+		}
+		if want := fmt.Sprint(n); req.Message != want {
+			return status.Errorf(codes.DataLoss, "got request %v, want %v", req.Message, want)
+		}
+		n++
+	}
+}
+
+func TestClientStreamOrder(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	impl := &orderedServer{start: make(chan struct{})}
+	cli, s := echo.StartServer(t, nc, "srv", impl)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.ClientStream(ctx)
+	if err != nil {
+		t.Fatalf("ClientStream: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := stream.Send(&echo.EchoRequest{Message: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	// queued by the stream while its handler does not read, the other
+	// calls of the service go on
+	for {
+		stats := s.ActiveStreams()
+		if len(stats) == 1 && stats[0].Queued == 1000 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("got %+v, want the 1000 requests queued", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	close(impl.start)
+	resp, err := stream.CloseAndRecv()
+	if err != nil || resp.Index != 1000 {
+		t.Fatalf("got %v, %v, want the 1000 requests in order", resp, err)
+	}
+}
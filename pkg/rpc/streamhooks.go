@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// WithStreamBeginHook sets fn to be called as the handler of a call
+// starts, with the gRPC method, the reply subject naming the stream and
+// the nid of the client. Calls refused before reaching a handler do not
+// begin.
+func WithStreamBeginHook(fn func(method, reply, nid string)) ServerOption {
+	return func(s *Server) {
+		s.beginHook = fn
+	}
+}
+
+// WithStreamEndHook sets fn to be called once as every stream that began,
+// see WithStreamBeginHook, ends, with the status it ended with: the one
+// sent to the client, the one of the client when it cancelled, or
+// codes.Canceled when the server dropped the stream without telling the
+// client, with CloseStream.
+func WithStreamEndHook(fn func(method, reply, nid string, st *status.Status)) ServerOption {
+	return func(s *Server) {
+		s.endHook = fn
+	}
+}
+
+// began runs the begin hook and records the start of the call, if any.
+func (s *serverStream) began() {
+	if s.server.beginHook == nil && s.server.metrics == nil {
+		return
+	}
+	atomic.StoreInt32(&s.hooked, 1)
+	if s.server.metrics != nil {
+		s.server.metrics.CallStarted(s.fullMethod)
+	}
+	if s.server.beginHook != nil {
+		s.server.beginHook(s.fullMethod, s.reply, s.pnid)
+	}
+}
+
+// ended runs the end hook and records the end of the call once, if began
+// did. The first status wins, the later ones of the same stream are
+// dropped.
+func (s *serverStream) ended(st *status.Status) {
+	s.setReason(st)
+	if atomic.LoadInt32(&s.hooked) == 0 {
+		return
+	}
+	s.endOnce.Do(func() {
+		if s.server.metrics != nil {
+			s.server.metrics.CallEnded(s.fullMethod, st.Code(), time.Since(s.started))
+		}
+		if s.server.endHook != nil {
+			s.server.endHook(s.fullMethod, s.reply, s.pnid, st)
+		}
+	})
+}
+
+// canceled is the status of the streams dropped without an End.
+var canceled = status.FromContextError(context.Canceled)
@@ -0,0 +1,102 @@
+package rpc_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// streamLog records the begin and end hooks of the streams by reply.
+type streamLog struct {
+	mu    sync.Mutex
+	begun map[string]string       // reply -> method
+	ended map[string][]codes.Code // reply -> end statuses
+}
+
+func (l *streamLog) begin(method, reply, nid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.begun[reply] = method + " " + nid
+}
+
+func (l *streamLog) end(method, reply, nid string, st *status.Status) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ended[reply] = append(l.ended[reply], st.Code())
+}
+
+// wait waits for n streams to end.
+func (l *streamLog) wait(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		ended := len(l.ended)
+		l.mu.Unlock()
+		if ended >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d ended streams, want %d", ended, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamHooks(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	l := &streamLog{begun: make(map[string]string), ended: make(map[string][]codes.Code)}
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithStreamBeginHook(l.begin), rpc.WithStreamEndHook(l.end))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if _, err := cli.Unary(ctx, &echo.EchoRequest{ErrorCode: int32(codes.NotFound)}); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want %v", err, codes.NotFound)
+	}
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	stream, err := cli.BidiStream(streamCtx)
+	if err != nil {
+		t.Fatalf("BidiStream: %v", err)
+	}
+	if err := stream.Send(&echo.EchoRequest{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	cancelStream()
+
+	l.wait(t, 3)
+	// late end hooks of the same streams would show up meanwhile
+	time.Sleep(100 * time.Millisecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	got := map[codes.Code]int{}
+	for reply, ends := range l.ended {
+		if len(ends) != 1 {
+			t.Fatalf("%v: got end statuses %v, want one", reply, ends)
+		}
+		if _, ok := l.begun[reply]; !ok {
+			t.Fatalf("%v: ended without beginning", reply)
+		}
+		got[ends[0]]++
+	}
+	if len(l.begun) != 3 || got[codes.OK] != 1 || got[codes.NotFound] != 1 || got[codes.Canceled] != 1 {
+		t.Fatalf("got %d streams begun ending with %v, want 3 ending with OK, NotFound and Canceled", len(l.begun), got)
+	}
+	for _, method := range l.begun {
+		if method != "/nrpctest.echo.Echo/Unary "+echo.ClientNid && method != "/nrpctest.echo.Echo/BidiStream "+echo.ClientNid {
+			t.Fatalf("got begin hook for %q", method)
+		}
+	}
+}
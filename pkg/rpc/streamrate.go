@@ -0,0 +1,99 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultStreamRateWindow is the window of StreamRate unless set with
+// WithStreamRateWindow.
+const defaultStreamRateWindow = 10 * time.Second
+
+// rateBuckets is the number of buckets the window of a rateCounter is
+// split into, the rate slides by one bucket at a time.
+const rateBuckets = 10
+
+// WithStreamRateWindow sets the window StreamRate averages over, 10s by
+// default. A short window follows bursts closely, a long one smooths them.
+func WithStreamRateWindow(d time.Duration) ServerOption {
+	return func(s *Server) {
+		if d > 0 {
+			s.streamRateWindow = d
+		}
+	}
+}
+
+// StreamRate returns how many streams the server started per second over
+// the last window, see WithStreamRateWindow. Autoscalers can poll it to
+// follow the demand.
+func (s *Server) StreamRate() float64 {
+	return s.streamRate.rate(time.Now())
+}
+
+// rateCounter counts events over a sliding window.
+type rateCounter struct {
+	mu      sync.Mutex
+	bucket  time.Duration // span of each bucket
+	counts  [rateBuckets]int
+	head    int       // index of the current bucket
+	start   time.Time // start of the current bucket
+	created time.Time
+}
+
+func newRateCounter(window time.Duration) *rateCounter {
+	now := time.Now()
+	bucket := window / rateBuckets
+	if bucket <= 0 {
+		bucket = 1
+	}
+	return &rateCounter{
+		bucket:  bucket,
+		start:   now,
+		created: now,
+	}
+}
+
+// advance moves the current bucket to the one now falls in, clearing the
+// buckets it passes. The caller holds c.mu.
+func (c *rateCounter) advance(now time.Time) {
+	n := int(now.Sub(c.start) / c.bucket)
+	if n <= 0 {
+		return
+	}
+	if n > rateBuckets {
+		n = rateBuckets
+	}
+	for i := 0; i < n; i++ {
+		c.head = (c.head + 1) % rateBuckets
+		c.counts[c.head] = 0
+	}
+	c.start = c.start.Add(now.Sub(c.start) / c.bucket * c.bucket)
+}
+
+// add counts an event at now.
+func (c *rateCounter) add(now time.Time) {
+	c.mu.Lock()
+	c.advance(now)
+	c.counts[c.head]++
+	c.mu.Unlock()
+}
+
+// rate returns the events per second over the window ending at now, or
+// since the counter was created if that is shorter.
+func (c *rateCounter) rate(now time.Time) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(now)
+	sum := 0
+	for _, n := range c.counts {
+		sum += n
+	}
+	span := (rateBuckets-1)*c.bucket + now.Sub(c.start)
+	if age := now.Sub(c.created); age < span {
+		span = age
+	}
+	if span <= 0 {
+		return 0
+	}
+	return float64(sum) / span.Seconds()
+}
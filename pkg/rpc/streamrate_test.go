@@ -0,0 +1,28 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateCounter(t *testing.T) {
+	c := newRateCounter(time.Second)
+	t0 := c.created
+	for i := 0; i < 10; i++ {
+		c.add(t0.Add(time.Duration(i) * 50 * time.Millisecond))
+	}
+	for _, tc := range []struct {
+		at   time.Duration
+		want float64
+	}{
+		{500 * time.Millisecond, 20},       // 10 events in the first 500ms
+		{time.Second, 8 / 0.9},             // the first bucket slid out
+		{1200 * time.Millisecond, 4 / 0.9}, // the first 300ms slid out
+		{3 * time.Second, 0},
+	} {
+		got := c.rate(t0.Add(tc.at))
+		if got < tc.want*0.95-0.01 || got > tc.want*1.05+0.01 {
+			t.Fatalf("at %v: got %v, want %v", tc.at, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// StreamStats is a snapshot of the queues of a stream served by a server,
+// see ActiveStreams.
+type StreamStats struct {
+	Reply   string    // reply subject of the call, naming the stream
+	Method  string    // subject of the method called
+	Peer    string    // nid of the client
+	Started time.Time // when the call arrived
+	// BytesSent and BytesReceived are the payload bytes of the responses
+	// sent and of the requests read by the handler so far.
+	BytesSent     int64
+	BytesReceived int64
+	// Queued is the number of requests received and not read by the
+	// handler yet, those beyond the buffer of RecvBuffer wait in the queue
+	// of the stream.
+	Queued     int
+	RecvBuffer int
+	// Unacked is the number of responses sent and not acknowledged by the
+	// client yet, always 0 for calls without WithStreamAcks.
+	Unacked int
+}
+
+// ActiveStreams returns the queues and traffic of the open streams of the
+// server, sorted by reply subject. A stream whose Queued reaches
+// RecvBuffer has a handler that does not keep up with its client, one
+// whose Unacked grows has a client that does not keep up with its handler.
+func (s *Server) ActiveStreams() []StreamStats {
+	s.mu.RLock()
+	stats := make([]StreamStats, 0, len(s.streams))
+	for _, stream := range s.streams {
+		st := StreamStats{
+			Reply:         stream.reply,
+			Method:        stream.method,
+			Peer:          stream.pnid,
+			Started:       stream.started,
+			BytesSent:     atomic.LoadInt64(&stream.bytesSent),
+			BytesReceived: atomic.LoadInt64(&stream.bytesRecv),
+			Queued:        len(stream.recvRead) + stream.recvQueue.len(),
+			RecvBuffer:    cap(stream.recvRead),
+		}
+		if stream.acks != nil {
+			st.Unacked = stream.acks.backlog()
+		}
+		stats = append(stats, st)
+	}
+	s.mu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Reply < stats[j].Reply
+	})
+	return stats
+}
+
+// StreamCount returns the number of open streams of the server, a cheap
+// ActiveStreams for polling.
+func (s *Server) StreamCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.streams)
+}
@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StreamInfo describes a stream served by a server, as kept in a
+// StreamStore.
+type StreamInfo struct {
+	Reply   string    // reply subject of the call, naming the stream
+	Subject string    // subject of the method called
+	Peer    string    // nid of the client
+	Server  string    // nid of the server serving the stream
+	Started time.Time // when the call arrived
+}
+
+// StreamStore mirrors the registry of the streams of one or more servers,
+// see WithStreamStore. A store shared by the instances of a service, such
+// as one backed by a NATS key-value bucket, tells which instance serves a
+// stream. The server only writes to it, off the path of the calls, so a
+// slow store delays the mirror, not the streams.
+type StreamStore interface {
+	Put(info StreamInfo) error
+	Get(reply string) (StreamInfo, bool, error)
+	Delete(reply string) error
+}
+
+// WithStreamStore makes the server record the streams it serves in store,
+// as they start and end. The store is a mirror the server never reads: it
+// serves from its own registry, and errors of the store are only logged.
+// The writes run on a goroutine of the server in the order the streams
+// started and ended, so the store may lag behind, but never records a
+// stream after its end.
+func WithStreamStore(store StreamStore) ServerOption {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// storeStream records a new stream in the store, if any.
+func (s *Server) storeStream(stream *serverStream) {
+	if s.store == nil {
+		return
+	}
+	info := StreamInfo{
+		Reply:   stream.reply,
+		Subject: stream.method,
+		Peer:    stream.pnid,
+		Server:  stream.nid,
+		Started: time.Now(),
+	}
+	s.storeQueue.submit(func() {
+		if err := s.store.Put(info); err != nil {
+			s.log.Errorf("StreamStore.Put(%v): %v", info.Reply, err)
+		}
+	})
+}
+
+// unstoreStream removes an ended stream from the store, if any.
+func (s *Server) unstoreStream(reply string) {
+	if s.store == nil {
+		return
+	}
+	s.storeQueue.submit(func() {
+		if err := s.store.Delete(reply); err != nil {
+			s.log.Errorf("StreamStore.Delete(%v): %v", reply, err)
+		}
+	})
+}
+
+// storeQueue runs the writes to the store of a server one at a time, in
+// the order they were submitted, on a goroutine running while any is
+// pending.
+type storeQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool // a goroutine runs pending
+}
+
+// submit queues write without blocking.
+func (q *storeQueue) submit(write func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, write)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *storeQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		write := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		write()
+	}
+}
+
+// MemoryStreamStore is a StreamStore keeping the streams in memory, shared
+// by the servers of a process.
+type MemoryStreamStore struct {
+	mu      sync.Mutex
+	streams map[string]StreamInfo
+}
+
+func (m *MemoryStreamStore) Put(info StreamInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.streams == nil {
+		m.streams = make(map[string]StreamInfo)
+	}
+	m.streams[info.Reply] = info
+	return nil
+}
+
+func (m *MemoryStreamStore) Get(reply string) (StreamInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.streams[reply]
+	return info, ok, nil
+}
+
+func (m *MemoryStreamStore) Delete(reply string) error {
+	m.mu.Lock()
+	delete(m.streams, reply)
+	m.mu.Unlock()
+	return nil
+}
+
+// Streams returns the streams in the store, sorted by reply subject.
+func (m *MemoryStreamStore) Streams() []StreamInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	streams := make([]StreamInfo, 0, len(m.streams))
+	for _, info := range m.streams {
+		streams = append(streams, info)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Reply < streams[j].Reply })
+	return streams
+}
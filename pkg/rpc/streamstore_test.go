@@ -0,0 +1,107 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+)
+
+func TestStreamStore(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	store := &rpc.MemoryStreamStore{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var streams []echo.Echo_BidiStreamClient
+	for _, nid := range []string{"a", "b"} {
+		echo.StartEchoServer(t, nc, nid, rpc.WithStreamStore(store))
+		cli := rpc.NewClient(nc, nid, "cli")
+		defer cli.Close()
+		stream, err := echo.NewEchoClient(cli).BidiStream(ctx)
+		if err != nil {
+			t.Fatalf("BidiStream: %v", err)
+		}
+		if err := stream.Send(&echo.EchoRequest{}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		streams = append(streams, stream)
+	}
+
+	// the store tells which server serves each stream, once written
+	infos := store.Streams()
+	for len(infos) != 2 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %d streams, want 2", len(infos))
+		}
+		time.Sleep(10 * time.Millisecond)
+		infos = store.Streams()
+	}
+	servers := map[string]bool{}
+	for _, info := range infos {
+		if info.Peer != "cli" || info.Started.IsZero() {
+			t.Fatalf("got %+v, want a stream of cli", info)
+		}
+		if got, ok, err := store.Get(info.Reply); !ok || err != nil || got != info {
+			t.Fatalf("Get(%v): got %+v, %v, %v", info.Reply, got, ok, err)
+		}
+		servers[info.Server] = true
+	}
+	if !servers["a"] || !servers["b"] {
+		t.Fatalf("got %+v, want a stream on a and b", infos)
+	}
+
+	for _, stream := range streams {
+		stream.CloseSend()
+		stream.Recv()
+	}
+	for len(store.Streams()) > 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("got %+v after the streams ended, want none", store.Streams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// blockingStore is a MemoryStreamStore whose writes wait for unblock.
+type blockingStore struct {
+	rpc.MemoryStreamStore
+	unblock chan struct{}
+}
+
+func (b *blockingStore) Put(info rpc.StreamInfo) error {
+	<-b.unblock
+	return b.MemoryStreamStore.Put(info)
+}
+
+func (b *blockingStore) Delete(reply string) error {
+	<-b.unblock
+	return b.MemoryStreamStore.Delete(reply)
+}
+
+func TestStreamStoreBlocked(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	store := &blockingStore{unblock: make(chan struct{})}
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithStreamStore(store))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the calls do not wait for the store
+	for i := 0; i < 3; i++ {
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{}); err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+	}
+
+	// the writes run in order once it unblocks, the deletes after the puts
+	close(store.unblock)
+	time.Sleep(100 * time.Millisecond)
+	if got := store.Streams(); len(got) != 0 {
+		t.Fatalf("got %+v after the calls ended, want none", got)
+	}
+}
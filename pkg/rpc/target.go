@@ -0,0 +1,184 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// defaultPrefix is the first token of the subjects calls are made on.
+const defaultPrefix = "nrpc"
+
+// buildSubject joins the non-empty parts of a subject,
+// <prefix>[.<tenant>][.<nid>].<service>[.<method>]. Servers and clients
+// build all their subjects with it so they agree on the layout.
+func buildSubject(parts ...string) string {
+	tokens := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if len(p) > 0 {
+			tokens = append(tokens, p)
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// validateSubject checks that v can be used as one or more dot separated
+// NATS subject tokens. An empty value is allowed.
+func validateSubject(name, v string) error {
+	if len(v) == 0 {
+		return nil
+	}
+	for _, token := range strings.Split(v, ".") {
+		if len(token) == 0 {
+			return fmt.Errorf("nrpc: invalid %v %q: must not contain empty tokens", name, v)
+		}
+		if err := validateToken(name, token); err != nil {
+			return fmt.Errorf("nrpc: invalid %v %q: must not contain '*', '>' or whitespace", name, v)
+		}
+	}
+	return nil
+}
+
+// validatePrefix checks a subject prefix, see WithSubjectPrefix.
+func validatePrefix(prefix string) error {
+	if len(prefix) == 0 {
+		return errors.New("nrpc: invalid prefix: must not be empty")
+	}
+	return validateSubject("prefix", prefix)
+}
+
+// mustValidatePrefix panics on an invalid subject prefix, a programming
+// error that must not leave a server on another prefix than intended.
+func mustValidatePrefix(prefix string) {
+	if err := validatePrefix(prefix); err != nil {
+		panic(err)
+	}
+}
+
+// Target addresses a service or method served over NATS, as written in an
+// nrpc URI:
+//
+//	nrpc://node-5/echo.Echo/SayHello?prefix=myapp&tenant=acme
+//
+// The host is the nid, empty for any server of the service, and the path
+// names the service and optionally the method.
+type Target struct {
+	NID     string
+	Service string
+	Method  string     // empty when the target is the whole service
+	Prefix  string     // first subject token(s), "nrpc" when empty
+	Tenant  string     // subject token following the prefix, if any
+	Params  url.Values // other query parameters
+}
+
+// ParseTarget parses an nrpc URI, see Target. The nid may contain any
+// character valid in a subject token, percent-encoded where the URI syntax
+// requires it.
+func ParseTarget(s string) (Target, error) {
+	const scheme = "nrpc://"
+	var t Target
+	if !strings.HasPrefix(s, scheme) {
+		return t, fmt.Errorf("nrpc: invalid target %q: must start with %v", s, scheme)
+	}
+	rest := s[len(scheme):]
+	i := strings.IndexAny(rest, "/?#")
+	if i < 0 {
+		return t, fmt.Errorf("nrpc: invalid target %q: missing service", s)
+	}
+	// the authority is parsed here, url.Parse restricts it to host names
+	nid, err := url.PathUnescape(rest[:i])
+	if err != nil {
+		return t, fmt.Errorf("nrpc: invalid target %q: nid: %v", s, err)
+	}
+	u, err := url.Parse(rest[i:])
+	if err != nil {
+		return t, fmt.Errorf("nrpc: invalid target %q: %v", s, err)
+	}
+	if len(u.Fragment) > 0 {
+		return t, fmt.Errorf("nrpc: invalid target %q: fragments are not supported", s)
+	}
+	t.NID = nid
+	path := strings.TrimPrefix(u.Path, "/")
+	if len(path) == 0 {
+		return t, fmt.Errorf("nrpc: invalid target %q: missing service", s)
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		return t, fmt.Errorf("nrpc: invalid target %q: path must be /service[/method]", s)
+	}
+	t.Service = parts[0]
+	if len(parts) == 2 {
+		if len(parts[1]) == 0 {
+			return t, fmt.Errorf("nrpc: invalid target %q: empty method", s)
+		}
+		t.Method = parts[1]
+	}
+	q := u.Query()
+	t.Prefix, t.Tenant = q.Get("prefix"), q.Get("tenant")
+	q.Del("prefix")
+	q.Del("tenant")
+	if len(q) > 0 {
+		t.Params = q
+	}
+	if err := t.validate(); err != nil {
+		return Target{}, err
+	}
+	return t, nil
+}
+
+func (t Target) validate() error {
+	if len(t.Service) == 0 {
+		return fmt.Errorf("nrpc: invalid target: missing service")
+	}
+	if err := validateToken("nid", t.NID); err != nil {
+		return err
+	}
+	if err := validateSubject("service", t.Service); err != nil {
+		return err
+	}
+	if err := validateToken("method", t.Method); err != nil {
+		return err
+	}
+	if err := validateSubject("prefix", t.Prefix); err != nil {
+		return err
+	}
+	return validateToken("tenant", t.Tenant)
+}
+
+// FullMethod returns the gRPC method name, /service/method.
+func (t Target) FullMethod() string {
+	return fmt.Sprintf("/%v/%v", t.Service, t.Method)
+}
+
+// Subject returns the subject the target method is called on, or the
+// subject prefix of the methods of the service if Method is empty.
+func (t Target) Subject() string {
+	prefix := t.Prefix
+	if len(prefix) == 0 {
+		prefix = defaultPrefix
+	}
+	return buildSubject(prefix, t.Tenant, t.NID, t.Service, t.Method)
+}
+
+// String returns the nrpc URI of the target, which ParseTarget parses back.
+func (t Target) String() string {
+	q := url.Values{}
+	for k, vs := range t.Params {
+		q[k] = vs
+	}
+	if len(t.Prefix) > 0 {
+		q.Set("prefix", t.Prefix)
+	}
+	if len(t.Tenant) > 0 {
+		q.Set("tenant", t.Tenant)
+	}
+	path := "/" + url.PathEscape(t.Service)
+	if len(t.Method) > 0 {
+		path += "/" + url.PathEscape(t.Method)
+	}
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return "nrpc://" + url.PathEscape(t.NID) + path
+}
@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TrailerTruncatedKey is added to a trailer that was truncated to fit the
+// size set by WithMaxTrailerSize.
+const TrailerTruncatedKey = "nrpc-trailer-truncated"
+
+// WithMaxTrailerSize limits the size of the header and of the trailer of a
+// call to n bytes, counted as the length of every key and value. Headers
+// beyond it are refused by SetHeader and SendHeader with
+// codes.ResourceExhausted. SetTrailer cannot fail, so a trailer beyond it is
+// logged when set and truncated when the call ends: the largest values are
+// dropped first, ties broken by key and then by the order they were set,
+// until the rest fits along with TrailerTruncatedKey.
+func WithMaxTrailerSize(n int) ServerOption {
+	return func(s *Server) {
+		s.maxTrailerSize = n
+	}
+}
+
+// metadataSize returns the size of md as counted by WithMaxTrailerSize.
+func metadataSize(md metadata.MD) int {
+	n := 0
+	for k, vs := range md {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+// checkHeader returns the error of SetHeader when adding header to the one
+// already set exceeds the limit.
+func (s *serverStream) checkHeader(header metadata.MD) error {
+	max := s.server.maxTrailerSize
+	if max <= 0 {
+		return nil
+	}
+	if size := metadataSize(s.header) + metadataSize(header); size > max {
+		return status.Errorf(codes.ResourceExhausted, "nrpc: header of %d bytes exceeds the limit of %d", size, max)
+	}
+	return nil
+}
+
+// truncateTrailer returns the trailer of the stream cut down to the limit,
+// see WithMaxTrailerSize.
+func (s *serverStream) truncateTrailer() metadata.MD {
+	max := s.server.maxTrailerSize
+	if max <= 0 || metadataSize(s.trailer) <= max {
+		return s.trailer
+	}
+	type entry struct {
+		key, value string
+		index      int
+	}
+	var entries []entry
+	for k, vs := range s.trailer {
+		for i, v := range vs {
+			entries = append(entries, entry{k, v, i})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if sa, sb := len(a.key)+len(a.value), len(b.key)+len(b.value); sa != sb {
+			return sa > sb
+		}
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.index < b.index
+	})
+	size := metadataSize(s.trailer) + len(TrailerTruncatedKey) + len("true")
+	for len(entries) > 0 && size > max {
+		size -= len(entries[0].key) + len(entries[0].value)
+		entries = entries[1:]
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].index < entries[j].index
+	})
+	trailer := metadata.Pairs(TrailerTruncatedKey, "true")
+	for _, e := range entries {
+		trailer.Append(e.key, e.value)
+	}
+	s.log.Warnf("trailer truncated to %d bytes, limit is %d", size, max)
+	return trailer
+}
@@ -0,0 +1,95 @@
+package rpc_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestMaxTrailerSize(t *testing.T) {
+	// echo-trailer-a is 24 bytes and echo-trailer-b 34, the marker 26
+	small, large := strings.Repeat("a", 10), strings.Repeat("b", 20)
+	for _, tc := range []struct {
+		max       int
+		truncated bool
+		kept      []string
+	}{
+		{58, false, []string{"echo-trailer-a", "echo-trailer-b"}},
+		{57, true, []string{"echo-trailer-a"}},
+		{49, true, nil},
+	} {
+		nc := nrpctest.RunNats(t)
+		cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithMaxTrailerSize(tc.max))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "echo-trailer-a", small, "echo-trailer-b", large)
+
+		var trailer metadata.MD
+		if _, err := cli.Unary(ctx, &echo.EchoRequest{}, grpc.Trailer(&trailer)); err != nil {
+			t.Fatalf("Unary: %v", err)
+		}
+		if got := len(trailer.Get(rpc.TrailerTruncatedKey)) == 1; got != tc.truncated {
+			t.Fatalf("got truncated %v with limit %d, want %v: %v", got, tc.max, tc.truncated, trailer)
+		}
+		for _, k := range []string{"echo-trailer-a", "echo-trailer-b"} {
+			kept := false
+			for _, w := range tc.kept {
+				kept = kept || w == k
+			}
+			if got := len(trailer.Get(k)) == 1; got != kept {
+				t.Fatalf("got %v kept %v with limit %d, want %v", k, got, tc.max, kept)
+			}
+		}
+	}
+}
+
+type bigHeaderServer struct {
+	echo.Server
+}
+
+func (b *bigHeaderServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	return stream.SendHeader(metadata.Pairs("big", req.Message))
+}
+
+func TestMaxTrailerSizeHeader(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartServer(t, nc, "srv", &bigHeaderServer{}, rpc.WithMaxTrailerSize(32))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// SetHeader of a unary call
+	md := metadata.AppendToOutgoingContext(ctx, "echo-header-a", strings.Repeat("a", 20))
+	if _, err := cli.Unary(md, &echo.EchoRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want %v", err, codes.ResourceExhausted)
+	}
+	// SendHeader of a stream, at and beyond the limit
+	for _, tc := range []struct {
+		size int
+		code codes.Code
+	}{
+		{29, codes.OK},
+		{30, codes.ResourceExhausted},
+	} {
+		var header metadata.MD
+		stream, err := cli.ServerStream(ctx, &echo.EchoRequest{Message: strings.Repeat("b", tc.size)}, grpc.Header(&header))
+		if err != nil {
+			t.Fatalf("ServerStream: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != tc.code && !(tc.code == codes.OK && err == io.EOF) {
+			t.Fatalf("got %v with %d bytes, want %v", err, tc.size, tc.code)
+		}
+		if got := len(header.Get("big")) == 1; got != (tc.code == codes.OK) {
+			t.Fatalf("got header %v with %d bytes", header, tc.size)
+		}
+	}
+}
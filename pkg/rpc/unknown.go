@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+)
+
+// WithUnknownStreamHandler serves the calls to the methods the server does
+// not register with handler instead of refusing them with
+// codes.Unimplemented, as grpc.UnknownServiceHandler does. The server then
+// also subscribes to every subject of its nid, so that the calls to
+// services it does not register reach it too. The handler receives and
+// sends the raw messages of the call as *Frame, see RawCodec, and finds its
+// gRPC method with grpc.MethodFromServerStream, which makes it suitable for
+// proxy.TransparentHandler. The stream interceptor applies to it, the call
+// being described as bidirectional.
+func WithUnknownStreamHandler(handler grpc.StreamHandler) ServerOption {
+	return func(s *Server) {
+		s.unknown = handler
+	}
+}
+
+// subscribeUnknown subscribes to every subject of nid for the unknown
+// handler, see WithUnknownStreamHandler. The caller holds s.mu.
+func (s *Server) subscribeUnknown(nid string) error {
+	subject := s.subjectPrefix(nid, ">")
+	s.log.Infof("QueueSubscribe: subject => %v, queue => %v", subject, unknownQueue)
+	sub, err := s.nc.QueueSubscribe(subject, unknownQueue, s.onUnknownMessage)
+	if err != nil {
+		s.log.Errorf("cannot subscribe to %v for the unknown services: %v", subject, err)
+		return err
+	}
+	s.subs[subject] = sub
+	return nil
+}
+
+// unknownQueue is the queue group of the subscriptions of the unknown
+// handler, which no service token collides with.
+const unknownQueue = "nrpc.unknown"
+
+// onUnknownMessage serves the messages of the wildcard subscription whose
+// service is not registered, the others arrive on its subscription too.
+func (s *Server) onUnknownMessage(msg *nats.Msg) {
+	s.mu.Lock()
+	_, token := s.splitSubject(msg.Subject)
+	if i := strings.LastIndexByte(token, '.'); i >= 0 {
+		token = token[:i]
+	}
+	_, ok := s.services[token]
+	s.mu.Unlock()
+	if !ok {
+		s.onMessage(msg)
+	}
+}
+
+// unknownHandler returns the handler of the call to method, the subject
+// of a method the server does not register, arrived on nid, see
+// WithUnknownStreamHandler.
+func (s *Server) unknownHandler(nid, method string) *methodHandler {
+	path := strings.TrimPrefix(method, s.subjectPrefix(nid, "")+".")
+	fullMethod := "/" + path
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		fullMethod = fmt.Sprintf("/%v/%v", path[:i], path[i+1:])
+	}
+	return &methodHandler{
+		fullMethod: fullMethod,
+		fn: serverStreamHandler(s.unknown, &grpc.StreamServerInfo{
+			FullMethod:     fullMethod,
+			IsClientStream: true,
+			IsServerStream: true,
+		}),
+		info: &serviceInfo{
+			recvBuffer: s.recvBuffer,
+			codec:      &RawCodec{protoCodec{opts: s.marshal}},
+		},
+		timeout: s.defaultTimeout,
+	}
+}
@@ -0,0 +1,65 @@
+package rpc_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUnknownStreamHandler(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	var mu sync.Mutex
+	var methods []string
+	unknown := func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		mu.Lock()
+		methods = append(methods, method)
+		mu.Unlock()
+		f := &rpc.Frame{}
+		if err := stream.RecvMsg(f); err != nil {
+			return err
+		}
+		req := &echo.EchoRequest{}
+		if err := proto.Unmarshal(f.Payload, req); err != nil {
+			return err
+		}
+		data, err := proto.Marshal(&echo.EchoResponse{Message: "unknown " + req.Message})
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(&rpc.Frame{Payload: data})
+	}
+	cli, _ := echo.StartEchoServer(t, nc, "srv", rpc.WithUnknownStreamHandler(unknown))
+	conn := rpc.NewClient(nc, "srv", "cli")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// registered methods are served by their handler only
+	if res, err := cli.Unary(ctx, &echo.EchoRequest{Message: "hello"}); err != nil || res.Message != "hello" {
+		t.Fatalf("Unary: got %v, %v, want hello", res, err)
+	}
+
+	for _, method := range []string{"/nrpctest.echo.Echo/Missing", "/other.Greeter/SayHello"} {
+		res := &echo.EchoResponse{}
+		if err := conn.Invoke(ctx, method, &echo.EchoRequest{Message: "hi"}, res); err != nil {
+			t.Fatalf("%v: %v", method, err)
+		}
+		if res.Message != "unknown hi" {
+			t.Fatalf("%v: got %q, want %q", method, res.Message, "unknown hi")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"/nrpctest.echo.Echo/Missing", "/other.Greeter/SayHello"}
+	if len(methods) != len(want) || methods[0] != want[0] || methods[1] != want[1] {
+		t.Fatalf("got methods %v, want %v", methods, want)
+	}
+}
@@ -0,0 +1,104 @@
+package rpc
+
+import (
+	"fmt"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/protos/nrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Warmup initializes, ahead of the first call, what the protobuf runtime
+// otherwise builds lazily on the first call of every method: the
+// marshaling of the nrpc envelopes, and of the request and response
+// messages of the methods registered so far through the codec of their
+// service, nested messages included. Call it once the services are
+// registered and before the server is announced. Services unknown to the
+// protobuf registry are skipped. Interceptors need no warm-up, they are
+// not chained per call.
+func (s *Server) Warmup() error {
+	envelopes := []proto.Message{
+		&nrpc.Request{Type: &nrpc.Request_Call{Call: &nrpc.Call{Metadata: &nrpc.Metadata{
+			Md: map[string]*nrpc.Strings{"": {}},
+		}}}},
+		&nrpc.Response{Type: &nrpc.Response_End{End: &nrpc.End{
+			Status:  status.New(codes.OK, "").Proto(),
+			Trailer: &nrpc.Metadata{},
+		}}},
+	}
+	for _, m := range envelopes {
+		if err := warm(protoCodec{opts: s.marshal}, m); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	var infos []*serviceInfo
+	for token, info := range s.services {
+		if !info.isAlias(token) {
+			infos = append(infos, info)
+		}
+	}
+	s.mu.Unlock()
+	for _, info := range infos {
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(info.name))
+		if err != nil {
+			continue
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		seen := make(map[protoreflect.FullName]bool)
+		for i := 0; i < sd.Methods().Len(); i++ {
+			md := sd.Methods().Get(i)
+			for _, desc := range []protoreflect.MessageDescriptor{md.Input(), md.Output()} {
+				if err := warmMessage(info.codec, desc, seen); err != nil {
+					return fmt.Errorf("nrpc: warming up %s: %v", md.FullName(), err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// warmMessage warms up the message described by desc and the messages of
+// its fields, skipping those in seen.
+func warmMessage(codec encoding.Codec, desc protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) error {
+	if seen[desc.FullName()] {
+		return nil
+	}
+	seen[desc.FullName()] = true
+	if !desc.IsMapEntry() {
+		mt, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+		if err != nil {
+			// not linked in, nothing to warm up
+			return nil
+		}
+		if err := warm(codec, mt.New().Interface()); err != nil {
+			return err
+		}
+	}
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if m := fields.Get(i).Message(); m != nil {
+			if err := warmMessage(codec, m, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warm runs m through a round trip of codec.
+func warm(codec encoding.Codec, m interface{}) error {
+	data, err := codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, m)
+}
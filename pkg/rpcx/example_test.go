@@ -0,0 +1,62 @@
+package rpcx_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpcx"
+)
+
+func ExampleRecv() {
+	var cli *rpc.Client // connected with rpc.NewClient
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := echo.NewEchoClient(cli).ServerStream(ctx, &echo.EchoRequest{ResponseCount: 10})
+	if err != nil {
+		return
+	}
+	r := rpcx.Recv[*echo.EchoResponse](stream, cancel)
+	for resp := range r.All() {
+		if resp.Index == 3 {
+			break // cancels the call
+		}
+		fmt.Println(resp.Message)
+	}
+	if err := r.Err(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func ExampleRecvServer() {
+	// in the ClientStream handler of an echo.EchoServer
+	handler := func(stream echo.Echo_ClientStreamServer) error {
+		r := rpcx.RecvServer[*echo.EchoRequest](stream)
+		var n int32
+		for range r.All() {
+			n++
+		}
+		if err := r.Err(); err != nil {
+			return err
+		}
+		return stream.SendAndClose(&echo.EchoResponse{Index: n})
+	}
+	_ = handler
+}
+
+func ExampleSend() {
+	var cli *rpc.Client // connected with rpc.NewClient
+	stream, err := echo.NewEchoClient(cli).ClientStream(context.Background())
+	if err != nil {
+		return
+	}
+	reqs := []*echo.EchoRequest{{Message: "a"}, {Message: "b"}, {Message: "c"}}
+	if err := rpcx.Send(stream, slices.Values(reqs), rpcx.WithBatch(64)); err != nil {
+		fmt.Println(err)
+		return
+	}
+	resp, err := stream.CloseAndRecv()
+	fmt.Println(resp.GetIndex(), err)
+}
@@ -0,0 +1,68 @@
+// Package rpcx provides generic helpers for calling gRPC methods and ranging
+// over streams, over NATS or any other grpc.ClientConnInterface. It is a
+// separate module so that the core packages keep supporting older Go
+// releases.
+package rpcx
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Unary calls the unary method, named like "/echo.Echo/SayHello", with req
+// and returns its response.
+func Unary[Req, Resp proto.Message](ctx context.Context, cc grpc.ClientConnInterface, method string, req Req, opts ...grpc.CallOption) (Resp, error) {
+	resp := newMessage[Resp]()
+	if err := cc.Invoke(ctx, method, req, resp, opts...); err != nil {
+		var zero Resp
+		return zero, err
+	}
+	return resp, nil
+}
+
+// ServerStream returns an iterator over the responses of the
+// server-streaming method called with req. The call starts when the
+// iteration does, and is cancelled when the iteration stops early. A failed
+// call ends the iteration with its error.
+func ServerStream[Req, Resp proto.Message](ctx context.Context, cc grpc.ClientConnInterface, method string, req Req, opts ...grpc.CallOption) iter.Seq2[Resp, error] {
+	return func(yield func(Resp, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var zero Resp
+		stream, err := cc.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method, opts...)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		if err := stream.SendMsg(req); err != nil {
+			yield(zero, err)
+			return
+		}
+		if err := stream.CloseSend(); err != nil {
+			yield(zero, err)
+			return
+		}
+		for {
+			resp := newMessage[Resp]()
+			if err := stream.RecvMsg(resp); err == io.EOF {
+				return
+			} else if err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(resp, nil) {
+				return
+			}
+		}
+	}
+}
+
+// newMessage allocates a message of the generated message type M.
+func newMessage[M proto.Message]() M {
+	var zero M
+	return zero.ProtoReflect().Type().New().Interface().(M)
+}
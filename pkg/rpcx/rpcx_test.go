@@ -0,0 +1,89 @@
+package rpcx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpcx"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	unaryMethod        = "/nrpctest.echo.Echo/Unary"
+	serverStreamMethod = "/nrpctest.echo.Echo/ServerStream"
+)
+
+func setup(t *testing.T) (*rpc.Client, context.Context) {
+	nc := nrpctest.RunNats(t)
+	echo.StartEchoServer(t, nc, "srv")
+	cli := rpc.NewClient(nc, "srv", "cli")
+	t.Cleanup(func() { cli.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return cli, ctx
+}
+
+func TestUnary(t *testing.T) {
+	cli, ctx := setup(t)
+	resp, err := rpcx.Unary[*echo.EchoRequest, *echo.EchoResponse](ctx, cli, unaryMethod, &echo.EchoRequest{Message: "hello"})
+	if err != nil {
+		t.Fatalf("Unary: %v", err)
+	}
+	if resp.Message != "hello" {
+		t.Fatalf("got %q, want %q", resp.Message, "hello")
+	}
+
+	req := &echo.EchoRequest{ErrorCode: int32(codes.NotFound), ErrorMessage: "gone"}
+	resp, err = rpcx.Unary[*echo.EchoRequest, *echo.EchoResponse](ctx, cli, unaryMethod, req)
+	if status.Code(err) != codes.NotFound || resp != nil {
+		t.Fatalf("got %v, %v, want nil, %v", resp, err, codes.NotFound)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	cli, ctx := setup(t)
+	var n int32
+	for resp, err := range rpcx.ServerStream[*echo.EchoRequest, *echo.EchoResponse](ctx, cli, serverStreamMethod, &echo.EchoRequest{Message: "hello", ResponseCount: 3}) {
+		if err != nil {
+			t.Fatalf("ServerStream: %v", err)
+		}
+		if resp.Message != "hello" || resp.Index != n {
+			t.Fatalf("got %v, want hello #%d", resp, n)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("got %d responses, want 3", n)
+	}
+
+	// stopping early cancels the call
+	n = 0
+	for _, err := range rpcx.ServerStream[*echo.EchoRequest, *echo.EchoResponse](ctx, cli, serverStreamMethod, &echo.EchoRequest{ResponseCount: 100}) {
+		if err != nil {
+			t.Fatalf("ServerStream: %v", err)
+		}
+		if n++; n == 2 {
+			break
+		}
+	}
+}
+
+func TestServerStreamError(t *testing.T) {
+	cli, ctx := setup(t)
+	req := &echo.EchoRequest{ErrorCode: int32(codes.PermissionDenied), ErrorMessage: "denied"}
+	var errs []error
+	for resp, err := range rpcx.ServerStream[*echo.EchoRequest, *echo.EchoResponse](ctx, cli, serverStreamMethod, req) {
+		if err == nil {
+			t.Fatalf("unexpected response %v", resp)
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || status.Code(errs[0]) != codes.PermissionDenied {
+		t.Fatalf("got %v, want a single %v", errs, codes.PermissionDenied)
+	}
+}
@@ -0,0 +1,126 @@
+package rpcx
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Receiver ranges over the messages received on a stream. The loop ends
+// when the stream does, after which Err reports why.
+type Receiver[M proto.Message] struct {
+	recv    func(interface{}) error
+	onBreak func()
+	err     error
+}
+
+// Recv receives the messages of type M the server sends on a client
+// stream, until it ends the call:
+//
+//	r := rpcx.Recv[*pb.Event](stream, cancel)
+//	for ev := range r.All() {
+//		...
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+//
+// Breaking out of the loop half-closes the stream and calls cancel, the
+// CancelFunc of the context the stream was created with, to end the call.
+// A nil cancel leaves the call running.
+func Recv[M proto.Message](stream grpc.ClientStream, cancel context.CancelFunc) *Receiver[M] {
+	return &Receiver[M]{
+		recv: stream.RecvMsg,
+		onBreak: func() {
+			stream.CloseSend()
+			if cancel != nil {
+				cancel()
+			}
+		},
+	}
+}
+
+// RecvServer receives the messages of type M the client sends on a server
+// stream, until it half-closes it. Breaking out of the loop leaves the
+// remaining messages unread; the call ends when the handler returns.
+func RecvServer[M proto.Message](stream grpc.ServerStream) *Receiver[M] {
+	return &Receiver[M]{recv: stream.RecvMsg}
+}
+
+// All returns an iterator over the received messages. A Receiver is ranged
+// over once.
+func (r *Receiver[M]) All() iter.Seq[M] {
+	return func(yield func(M) bool) {
+		for {
+			m := newMessage[M]()
+			if err := r.recv(m); err != nil {
+				if err != io.EOF {
+					r.err = err
+				}
+				return
+			}
+			if !yield(m) {
+				if r.onBreak != nil {
+					r.onBreak()
+				}
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error that ended the stream, nil when it ended normally or
+// the loop stopped early.
+func (r *Receiver[M]) Err() error {
+	return r.err
+}
+
+// SendOption configures Send.
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	batch int
+}
+
+// WithBatch makes Send wait every n messages until the NATS server has
+// processed those sent so far, so a fast producer does not queue up an
+// unbounded backlog in the connection. It applies to the streams of the
+// rpc package.
+func WithBatch(n int) SendOption {
+	return func(o *sendOptions) {
+		o.batch = n
+	}
+}
+
+// flusher is implemented by the client and server streams of the rpc
+// package.
+type flusher interface {
+	Flush() error
+}
+
+// Send sends the messages of msgs on stream, a grpc.ClientStream or
+// grpc.ServerStream, and returns the first error. It stops ranging over msgs
+// when sending fails; on a client stream the status of the call is then
+// returned by RecvMsg.
+func Send[M proto.Message](stream interface{ SendMsg(interface{}) error }, msgs iter.Seq[M], opts ...SendOption) error {
+	var o sendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	f, _ := stream.(flusher)
+	n := 0
+	for m := range msgs {
+		if err := stream.SendMsg(m); err != nil {
+			return err
+		}
+		if n++; o.batch > 0 && f != nil && n%o.batch == 0 {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
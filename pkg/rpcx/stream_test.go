@@ -0,0 +1,136 @@
+package rpcx_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpc/nrpctest/echo"
+	"github.com/cloudwebrtc/nats-grpc/pkg/rpcx"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// streamServer streams until the client ends the call and counts the
+// messages of client streams with the rpcx adapters.
+type streamServer struct {
+	echo.Server
+	cancelled chan struct{}
+}
+
+func (s *streamServer) ServerStream(req *echo.EchoRequest, stream echo.Echo_ServerStreamServer) error {
+	for i := int32(0); ; i++ {
+		if err := stream.Send(&echo.EchoResponse{Index: i}); err != nil {
+			break
+		}
+		if stream.Context().Err() != nil {
+			break
+		}
+	}
+	close(s.cancelled)
+	return stream.Context().Err()
+}
+
+func (s *streamServer) ClientStream(stream echo.Echo_ClientStreamServer) error {
+	r := rpcx.RecvServer[*echo.EchoRequest](stream)
+	var n int32
+	for range r.All() {
+		n++
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&echo.EchoResponse{Index: n})
+}
+
+func TestRecv(t *testing.T) {
+	cli, ctx := setup(t)
+	stream, err := echo.NewEchoClient(cli).ServerStream(ctx, &echo.EchoRequest{Message: "hello", ResponseCount: 3})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	r := rpcx.Recv[*echo.EchoResponse](stream, nil)
+	var got []int32
+	for resp := range r.All() {
+		got = append(got, resp.Index)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if want := []int32{0, 1, 2}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestRecvError(t *testing.T) {
+	cli, ctx := setup(t)
+	req := &echo.EchoRequest{ErrorCode: int32(codes.Unavailable), ErrorMessage: "down"}
+	stream, err := echo.NewEchoClient(cli).ServerStream(ctx, req)
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	r := rpcx.Recv[*echo.EchoResponse](stream, nil)
+	for resp := range r.All() {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if status.Code(r.Err()) != codes.Unavailable {
+		t.Fatalf("got %v, want %v", r.Err(), codes.Unavailable)
+	}
+}
+
+func TestRecvBreak(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	srv := &streamServer{cancelled: make(chan struct{})}
+	cli, _ := echo.StartServer(t, nc, "srv", srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sctx, scancel := context.WithCancel(ctx)
+	stream, err := cli.ServerStream(sctx, &echo.EchoRequest{})
+	if err != nil {
+		t.Fatalf("ServerStream: %v", err)
+	}
+	r := rpcx.Recv[*echo.EchoResponse](stream, scancel)
+	n := 0
+	for range r.All() {
+		if n++; n == 3 {
+			break
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if sctx.Err() == nil {
+		t.Fatalf("breaking the loop did not cancel the call")
+	}
+	<-srv.cancelled
+}
+
+func TestSend(t *testing.T) {
+	nc := nrpctest.RunNats(t)
+	cli, _ := echo.StartServer(t, nc, "srv", &streamServer{})
+	ctx := context.Background()
+
+	stream, err := cli.ClientStream(ctx)
+	if err != nil {
+		t.Fatalf("ClientStream: %v", err)
+	}
+	msgs := func(yield func(*echo.EchoRequest) bool) {
+		for i := 0; i < 5; i++ {
+			if !yield(&echo.EchoRequest{Message: "hello"}) {
+				return
+			}
+		}
+	}
+	if err := rpcx.Send(stream, msgs, rpcx.WithBatch(2)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv: %v", err)
+	}
+	if resp.Index != 5 {
+		t.Fatalf("server received %d messages, want 5", resp.Index)
+	}
+}
@@ -13,3 +13,13 @@ touch ${OUT_DIR}/.generated
 protoc -I ${SRC_DIR} \
 	--go_out=plugins=grpc:${OUT_DIR} \
 	${SRC_DIR}/nrpc/nrpc.proto
+
+protoc -I ./pkg/rpc \
+	--go_out=paths=source_relative:./pkg/rpc \
+	--go-grpc_out=paths=source_relative:./pkg/rpc \
+	./pkg/rpc/nrpctest/echo/echo.proto
+
+protoc -I ./pkg/rpc \
+	--go_out=paths=source_relative:./pkg/rpc \
+	--go-grpc_out=paths=source_relative:./pkg/rpc \
+	./pkg/rpc/admin/admin.proto